@@ -0,0 +1,101 @@
+// Package agent implements a local unlock agent that keeps the derived
+// storage key in memory behind a unix socket, so commands don't need to ask
+// for the encryption password every time.
+package agent
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// ErrUnsupported is returned on platforms without peer credential checks.
+var ErrUnsupported = errors.New("unlock agent is not supported on this platform")
+
+// ErrLocked is returned by Get when the agent holds no key.
+var ErrLocked = errors.New("agent is locked")
+
+type request struct {
+	Op      string        `json:"op"`
+	Key     string        `json:"key,omitempty"`
+	IdleTTL time.Duration `json:"idle_ttl,omitempty"`
+	MaxTTL  time.Duration `json:"max_ttl,omitempty"`
+}
+
+type response struct {
+	Error     string    `json:"error,omitempty"`
+	Key       string    `json:"key,omitempty"`
+	Unlocked  bool      `json:"unlocked,omitempty"`
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+}
+
+// Status describes the agent's current state.
+type Status struct {
+	Unlocked bool
+	// ExpiresAt is when the key will be wiped at the latest, taking both
+	// the idle and absolute TTLs into account.
+	ExpiresAt time.Time
+}
+
+// Get returns the key held by the agent at socketPath.
+func Get(socketPath string) ([]byte, error) {
+	resp, err := call(socketPath, request{Op: "get"})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Key == "" {
+		return nil, ErrLocked
+	}
+	return hex.DecodeString(resp.Key)
+}
+
+// Put hands key to the agent. It is wiped after idleTTL without use, or
+// after maxTTL regardless of use.
+func Put(socketPath string, key []byte, idleTTL, maxTTL time.Duration) error {
+	_, err := call(socketPath, request{
+		Op:      "put",
+		Key:     hex.EncodeToString(key),
+		IdleTTL: idleTTL,
+		MaxTTL:  maxTTL,
+	})
+	return err
+}
+
+// Lock wipes the key and stops the agent.
+func Lock(socketPath string) error {
+	_, err := call(socketPath, request{Op: "lock"})
+	return err
+}
+
+// GetStatus reports whether the agent is unlocked and when it will lock.
+func GetStatus(socketPath string) (Status, error) {
+	resp, err := call(socketPath, request{Op: "status"})
+	if err != nil {
+		return Status{}, err
+	}
+	return Status{Unlocked: resp.Unlocked, ExpiresAt: resp.ExpiresAt}, nil
+}
+
+func call(socketPath string, req request) (*response, error) {
+	conn, err := net.DialTimeout("unix", socketPath, time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to agent: %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, fmt.Errorf("sending to agent: %w", err)
+	}
+	var resp response
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("reading from agent: %w", err)
+	}
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	return &resp, nil
+}
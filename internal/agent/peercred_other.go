@@ -0,0 +1,9 @@
+//go:build !linux && !darwin
+
+package agent
+
+import "net"
+
+func checkPeerSupported() error { return ErrUnsupported }
+
+func peerUID(conn *net.UnixConn) (int, error) { return -1, ErrUnsupported }
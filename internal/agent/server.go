@@ -0,0 +1,170 @@
+//go:build !windows
+
+package agent
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type server struct {
+	mu         sync.Mutex
+	key        []byte
+	idleTTL    time.Duration
+	maxTTL     time.Duration
+	unlockedAt time.Time
+	lastUsed   time.Time
+
+	ln   net.Listener
+	once sync.Once
+}
+
+// Serve listens on socketPath and answers requests from processes owned by
+// the same user. It returns once the key is locked or expires, or on
+// SIGINT/SIGTERM, removing the socket on the way out.
+func Serve(socketPath string) error {
+	if err := checkPeerSupported(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0700); err != nil {
+		return fmt.Errorf("creating agent dir: %w", err)
+	}
+	if _, err := os.Stat(socketPath); err == nil {
+		if conn, err := net.DialTimeout("unix", socketPath, time.Second); err == nil {
+			conn.Close()
+			return fmt.Errorf("agent already running at %s", socketPath)
+		}
+		os.Remove(socketPath)
+	}
+
+	oldMask := syscall.Umask(0077)
+	ln, err := net.Listen("unix", socketPath)
+	syscall.Umask(oldMask)
+	if err != nil {
+		return fmt.Errorf("listening on %s: %w", socketPath, err)
+	}
+	defer os.Remove(socketPath)
+
+	s := &server{ln: ln}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigCh)
+	go func() {
+		<-sigCh
+		s.stop()
+	}()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	go func() {
+		for range ticker.C {
+			s.expire()
+		}
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return nil
+		}
+		go s.handle(conn.(*net.UnixConn))
+	}
+}
+
+func (s *server) handle(conn *net.UnixConn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	uid, err := peerUID(conn)
+	if err != nil || uid != os.Getuid() {
+		json.NewEncoder(conn).Encode(response{Error: "permission denied"})
+		return
+	}
+
+	var req request
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		return
+	}
+	json.NewEncoder(conn).Encode(s.dispatch(req))
+}
+
+func (s *server) dispatch(req request) response {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch req.Op {
+	case "get":
+		if s.key == nil {
+			return response{}
+		}
+		s.lastUsed = time.Now()
+		return response{Key: hex.EncodeToString(s.key), Unlocked: true, ExpiresAt: s.expiresAt()}
+	case "put":
+		key, err := hex.DecodeString(req.Key)
+		if err != nil || len(key) == 0 {
+			return response{Error: "invalid key"}
+		}
+		if req.IdleTTL <= 0 || req.MaxTTL <= 0 {
+			return response{Error: "invalid TTL"}
+		}
+		s.wipe()
+		s.key = key
+		s.idleTTL, s.maxTTL = req.IdleTTL, req.MaxTTL
+		s.unlockedAt = time.Now()
+		s.lastUsed = s.unlockedAt
+		return response{Unlocked: true, ExpiresAt: s.expiresAt()}
+	case "status":
+		if s.key == nil {
+			return response{}
+		}
+		return response{Unlocked: true, ExpiresAt: s.expiresAt()}
+	case "lock":
+		s.wipe()
+		go s.stop()
+		return response{}
+	default:
+		return response{Error: fmt.Sprintf("unknown op %q", req.Op)}
+	}
+}
+
+// expire wipes the key and stops the agent once either TTL has elapsed.
+func (s *server) expire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.key != nil && time.Now().After(s.expiresAt()) {
+		s.wipe()
+		go s.stop()
+	}
+}
+
+// expiresAt returns the earlier of the idle and absolute deadlines.
+// Callers must hold s.mu.
+func (s *server) expiresAt() time.Time {
+	idle := s.lastUsed.Add(s.idleTTL)
+	abs := s.unlockedAt.Add(s.maxTTL)
+	if idle.Before(abs) {
+		return idle
+	}
+	return abs
+}
+
+// wipe zeroes and drops the key. Callers must hold s.mu.
+func (s *server) wipe() {
+	for i := range s.key {
+		s.key[i] = 0
+	}
+	s.key = nil
+}
+
+func (s *server) stop() {
+	s.once.Do(func() { s.ln.Close() })
+}
@@ -0,0 +1,8 @@
+package agent
+
+// Serve is not supported on Windows: there is no way to check the peer
+// credentials of a unix socket connection.
+func Serve(socketPath string) error { return ErrUnsupported }
+
+// Start is not supported on Windows.
+func Start(socketPath string) error { return ErrUnsupported }
@@ -0,0 +1,37 @@
+//go:build !windows
+
+package agent
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// Start re-executes the current binary as "essh agent" in its own session,
+// detached from the terminal, and waits until its socket accepts connections.
+func Start(socketPath string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("locating essh binary: %w", err)
+	}
+	cmd := exec.Command(exe, "agent")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("starting agent: %w", err)
+	}
+	cmd.Process.Release()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if conn, err := net.DialTimeout("unix", socketPath, 100*time.Millisecond); err == nil {
+			conn.Close()
+			return nil
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return fmt.Errorf("agent did not start")
+}
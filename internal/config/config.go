@@ -15,6 +15,13 @@ const configFile = "config.json"
 type Config struct {
 	StoragePath string `json:"storage_path"`
 	KeyfilePath string `json:"keyfile_path,omitempty"`
+	// SystemKnownHosts also checks host keys against ~/.ssh/known_hosts.
+	SystemKnownHosts bool `json:"system_known_hosts,omitempty"`
+	// AgentIdleTTL and AgentMaxTTL control how long the unlock agent keeps
+	// the key: wiped after AgentIdleTTL without use, or AgentMaxTTL after
+	// unlocking. Values are Go durations such as "30m" or "8h".
+	AgentIdleTTL string `json:"agent_idle_ttl,omitempty"`
+	AgentMaxTTL  string `json:"agent_max_ttl,omitempty"`
 }
 
 // Dir returns the path to ~/.essh/.
@@ -35,6 +42,24 @@ func Path() (string, error) {
 	return filepath.Join(dir, configFile), nil
 }
 
+// KnownHostsPath returns the path to essh's own known_hosts file.
+func KnownHostsPath() (string, error) {
+	dir, err := Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "known_hosts"), nil
+}
+
+// AgentSocketPath returns the path to the unlock agent's socket.
+func AgentSocketPath() (string, error) {
+	dir, err := Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "agent.sock"), nil
+}
+
 // ExpandPath expands a leading ~ to the user's home directory.
 func ExpandPath(p string) string {
 	if strings.HasPrefix(p, "~/") {
@@ -0,0 +1,199 @@
+// Package diff produces line-based unified diffs.
+package diff
+
+import (
+	"fmt"
+	"strings"
+)
+
+// context is the number of unchanged lines shown around each change.
+const context = 3
+
+// maxEdits bounds the work done on very different inputs.
+const maxEdits = 1000
+
+type opKind byte
+
+const (
+	opEqual  opKind = ' '
+	opDelete opKind = '-'
+	opInsert opKind = '+'
+)
+
+// op is one line of an edit script: a[a] kept or deleted, or b[b] inserted.
+type op struct {
+	kind opKind
+	a, b int
+}
+
+// Unified returns a unified diff turning a into b, with nameA and nameB as
+// the file labels. It returns "" when a and b are equal.
+func Unified(nameA, nameB string, a, b []byte) string {
+	if string(a) == string(b) {
+		return ""
+	}
+	la, lb := splitLines(a), splitLines(b)
+	ops, ok := edits(la, lb)
+	if !ok {
+		return fmt.Sprintf("--- %s\n+++ %s\n(outputs are too different to diff: %d vs %d lines)\n", nameA, nameB, len(la), len(lb))
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", nameA, nameB)
+	for _, h := range hunks(ops) {
+		writeHunk(&sb, ops[h[0]:h[1]], la, lb)
+	}
+	return sb.String()
+}
+
+// splitLines splits on newlines, marking a missing final newline the way
+// diff(1) does.
+func splitLines(b []byte) []string {
+	if len(b) == 0 {
+		return nil
+	}
+	s := string(b)
+	noEOL := !strings.HasSuffix(s, "\n")
+	lines := strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+	if noEOL {
+		lines[len(lines)-1] += "\n\\ No newline at end of file"
+	}
+	return lines
+}
+
+// edits computes a shortest edit script with Myers' algorithm. It gives up,
+// returning false, after maxEdits differences.
+func edits(a, b []string) ([]op, bool) {
+	n, m := len(a), len(b)
+	max := n + m
+	if max > maxEdits {
+		max = maxEdits
+	}
+	off := max + 1
+	v := make([]int, 2*max+3)
+	var trace [][]int
+
+	end := -1
+	for d := 0; d <= max && end < 0; d++ {
+		trace = append(trace, append([]int(nil), v...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+				x = v[off+k+1]
+			} else {
+				x = v[off+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[off+k] = x
+			if x >= n && y >= m {
+				end = d
+				break
+			}
+		}
+	}
+	if end < 0 {
+		return nil, false
+	}
+
+	var ops []op
+	x, y := n, m
+	for d := end; d > 0; d-- {
+		v := trace[d]
+		k := x - y
+		prevK := k - 1
+		if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+			prevK = k + 1
+		}
+		prevX := v[off+prevK]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+			ops = append(ops, op{opEqual, x, y})
+		}
+		if x == prevX {
+			y--
+			ops = append(ops, op{opInsert, x, y})
+		} else {
+			x--
+			ops = append(ops, op{opDelete, x, y})
+		}
+	}
+	for x > 0 && y > 0 {
+		x--
+		y--
+		ops = append(ops, op{opEqual, x, y})
+	}
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops, true
+}
+
+// hunks returns [start, end) ranges of ops to print: each change with up to
+// context equal lines around it, merging changes that are close together.
+func hunks(ops []op) [][2]int {
+	var out [][2]int
+	for i := 0; i < len(ops); i++ {
+		if ops[i].kind == opEqual {
+			continue
+		}
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+		if len(out) > 0 && start <= out[len(out)-1][1] {
+			start = out[len(out)-1][0]
+			out = out[:len(out)-1]
+		}
+		end := i + 1
+		for end < len(ops) && ops[end].kind != opEqual {
+			end++
+		}
+		i = end - 1
+		end += context
+		if end > len(ops) {
+			end = len(ops)
+		}
+		out = append(out, [2]int{start, end})
+	}
+	return out
+}
+
+func writeHunk(sb *strings.Builder, ops []op, a, b []string) {
+	aStart, bStart := ops[0].a, ops[0].b
+	aLen, bLen := 0, 0
+	for _, o := range ops {
+		if o.kind != opInsert {
+			aLen++
+		}
+		if o.kind != opDelete {
+			bLen++
+		}
+	}
+	fmt.Fprintf(sb, "@@ -%s +%s @@\n", hunkRange(aStart, aLen), hunkRange(bStart, bLen))
+	for _, o := range ops {
+		var line string
+		if o.kind == opInsert {
+			line = b[o.b]
+		} else {
+			line = a[o.a]
+		}
+		fmt.Fprintf(sb, "%c%s\n", o.kind, line)
+	}
+}
+
+// hunkRange formats a 0-based start and length as diff(1) does.
+func hunkRange(start, n int) string {
+	if n == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if n == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, n)
+}
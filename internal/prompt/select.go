@@ -16,6 +16,15 @@ type SelectItem struct {
 // Select displays an interactive list and returns the selected index.
 // Arrow keys and j/k to move, Enter to select, Ctrl+C or q to cancel.
 func Select(label string, items []SelectItem, defaultIdx int) (int, error) {
+	return SelectFilter(label, items, defaultIdx, nil)
+}
+
+// SelectFilter is like Select, but "/" starts a filter query that narrows
+// the list to the items for which match(query, index) returns true. While
+// filtering, letters go to the query: arrow keys move, Backspace edits (and
+// leaves the filter once empty) and Ctrl+U clears it. A nil match behaves
+// like Select. Long lists scroll to fit the terminal.
+func SelectFilter(label string, items []SelectItem, defaultIdx int, match func(query string, idx int) bool) (int, error) {
 	if len(items) == 0 {
 		return -1, fmt.Errorf("no items to select")
 	}
@@ -31,11 +40,18 @@ func Select(label string, items []SelectItem, defaultIdx int) (int, error) {
 	}
 	defer term.Restore(fd, oldState)
 
-	selected := defaultIdx
-	if selected < 0 || selected >= len(items) {
-		selected = 0
+	// Show at most as many rows as fit below the label (and query line).
+	rows := len(items)
+	if _, height, err := term.GetSize(int(os.Stdout.Fd())); err == nil {
+		if fit := height - 3; fit < rows {
+			rows = fit
+		}
+	}
+	rows = min(max(rows, 1), len(items))
+	lines := rows
+	if match != nil {
+		lines++
 	}
-	total := len(items)
 
 	// Calculate label width for alignment
 	labelW := 0
@@ -45,21 +61,65 @@ func Select(label string, items []SelectItem, defaultIdx int) (int, error) {
 		}
 	}
 
+	filtering := false
+	query := ""
+	visible := make([]int, len(items))
+	for i := range items {
+		visible[i] = i
+	}
+	selected := 0
+	if defaultIdx >= 0 && defaultIdx < len(items) {
+		selected = defaultIdx
+	}
+	top := 0
+
+	filter := func() {
+		visible = visible[:0]
+		for i := range items {
+			if query == "" || match(query, i) {
+				visible = append(visible, i)
+			}
+		}
+		selected, top = 0, 0
+	}
+
 	// Print label and reserve space
 	fmt.Fprintf(os.Stdout, "%s\r\n", label)
-	for i := 0; i < total; i++ {
+	for i := 0; i < lines; i++ {
 		fmt.Fprintf(os.Stdout, "\r\n")
 	}
 
 	render := func() {
-		// Move cursor up to first item
-		fmt.Fprintf(os.Stdout, "\033[%dA", total)
-		for i, item := range items {
-			prefix := "  "
-			if i == selected {
-				prefix = "> "
+		if selected < top {
+			top = selected
+		}
+		if selected >= top+rows {
+			top = selected - rows + 1
+		}
+		// Move cursor up to the first line
+		fmt.Fprintf(os.Stdout, "\033[%dA", lines)
+		if match != nil {
+			if filtering {
+				fmt.Fprintf(os.Stdout, "\033[2K\r  Filter: %s\r\n", query)
+			} else {
+				fmt.Fprintf(os.Stdout, "\033[2K\r  (/ to filter)\r\n")
 			}
-			fmt.Fprintf(os.Stdout, "\033[2K\r  %s%-*s  %s\r\n", prefix, labelW, item.Label, item.Desc)
+		}
+		for row := 0; row < rows; row++ {
+			fmt.Fprintf(os.Stdout, "\033[2K\r")
+			pos := top + row
+			switch {
+			case pos < len(visible):
+				item := items[visible[pos]]
+				prefix := "  "
+				if pos == selected {
+					prefix = "> "
+				}
+				fmt.Fprintf(os.Stdout, "  %s%-*s  %s", prefix, labelW, item.Label, item.Desc)
+			case row == 0:
+				fmt.Fprintf(os.Stdout, "    (no matches)")
+			}
+			fmt.Fprintf(os.Stdout, "\r\n")
 		}
 	}
 
@@ -77,20 +137,23 @@ func Select(label string, items []SelectItem, defaultIdx int) (int, error) {
 			return -1, err
 		}
 
-		switch b {
-		case '\r', '\n':
-			return selected, nil
-		case 3, 'q': // Ctrl+C or q
+		switch {
+		case b == '\r' || b == '\n':
+			if len(visible) == 0 {
+				continue
+			}
+			return visible[selected], nil
+		case b == 3 || (b == 'q' && !filtering): // Ctrl+C or q
 			return -1, fmt.Errorf("cancelled")
-		case 'k':
+		case b == 'k' && !filtering:
 			if selected > 0 {
 				selected--
 			}
-		case 'j':
-			if selected < total-1 {
+		case b == 'j' && !filtering:
+			if selected < len(visible)-1 {
 				selected++
 			}
-		case '\x1b': // Escape sequence
+		case b == '\x1b': // Escape sequence
 			b2, err := readByte()
 			if err != nil {
 				return -1, err
@@ -106,11 +169,26 @@ func Select(label string, items []SelectItem, defaultIdx int) (int, error) {
 						selected--
 					}
 				case 'B': // down arrow
-					if selected < total-1 {
+					if selected < len(visible)-1 {
 						selected++
 					}
 				}
 			}
+		case b == '/' && match != nil && !filtering:
+			filtering = true
+		case filtering && (b == 127 || b == 8): // Backspace
+			if query == "" {
+				filtering = false
+				break
+			}
+			query = query[:len(query)-1]
+			filter()
+		case filtering && b == 21: // Ctrl+U
+			query = ""
+			filter()
+		case filtering && b >= ' ' && b < 127:
+			query += string(b)
+			filter()
 		default:
 			continue
 		}
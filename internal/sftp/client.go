@@ -0,0 +1,513 @@
+// Package sftp implements an SFTP (protocol version 3) client, as spoken
+// by OpenSSH and most other servers, over any reader/writer pair such as
+// an SSH "sftp" subsystem channel.
+package sftp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Client is an SFTP client. Its methods are safe for concurrent use, and
+// requests from concurrent callers are pipelined over the one channel.
+type Client struct {
+	w   io.WriteCloser
+	wmu sync.Mutex
+
+	mu      sync.Mutex
+	nextID  uint32
+	pending map[uint32]chan response
+	// err is set once the connection has failed; every later request
+	// returns it.
+	err error
+
+	exts map[string]string
+}
+
+// response is the reply to one request: its packet type and the body after
+// the request id, or the connection error that prevented a reply.
+type response struct {
+	typ  byte
+	body []byte
+	err  error
+}
+
+// ErrClosed is returned for requests after the connection has closed.
+var ErrClosed = errors.New("sftp: connection closed")
+
+// NewClient negotiates protocol version 3 over r and w, which are usually
+// an SSH session's stdout and stdin with the sftp subsystem started.
+// Closing the client closes w.
+func NewClient(r io.Reader, w io.WriteCloser) (*Client, error) {
+	if err := writePacket(w, fxpInit, uint32(3)); err != nil {
+		return nil, fmt.Errorf("sftp: sending init: %w", err)
+	}
+	typ, body, err := readPacket(r)
+	if err != nil {
+		return nil, fmt.Errorf("sftp: reading version: %w", err)
+	}
+	if typ != fxpVersion {
+		return nil, fmt.Errorf("sftp: expected version packet, got type %d", typ)
+	}
+	d := decoder{b: body}
+	if v := d.uint32(); d.err != nil || v < 3 {
+		return nil, fmt.Errorf("sftp: unsupported protocol version %d", v)
+	}
+	exts := map[string]string{}
+	for len(d.b) > 0 && d.err == nil {
+		name, data := d.string(), d.string()
+		exts[name] = data
+	}
+
+	c := &Client{w: w, pending: map[uint32]chan response{}, exts: exts}
+	go c.recv(r)
+	return c, nil
+}
+
+// Close ends the session. Pending requests fail with ErrClosed.
+func (c *Client) Close() error {
+	c.fail(ErrClosed)
+	return c.w.Close()
+}
+
+// HasExtension reports whether the server advertised the named extension,
+// e.g. "posix-rename@openssh.com".
+func (c *Client) HasExtension(name string) bool {
+	_, ok := c.exts[name]
+	return ok
+}
+
+// recv dispatches responses to the pending requests until r fails.
+func (c *Client) recv(r io.Reader) {
+	for {
+		typ, body, err := readPacket(r)
+		if err != nil {
+			if err == io.EOF {
+				err = ErrClosed
+			}
+			c.fail(err)
+			return
+		}
+		d := decoder{b: body}
+		id := d.uint32()
+		if d.err != nil {
+			c.fail(d.err)
+			return
+		}
+		c.mu.Lock()
+		ch := c.pending[id]
+		delete(c.pending, id)
+		c.mu.Unlock()
+		if ch == nil {
+			c.fail(fmt.Errorf("sftp: response to unknown request %d", id))
+			return
+		}
+		ch <- response{typ: typ, body: d.b}
+	}
+}
+
+// fail records err as the connection error and fails every pending request.
+func (c *Client) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.err = err
+	}
+	for id, ch := range c.pending {
+		ch <- response{err: c.err}
+		delete(c.pending, id)
+	}
+}
+
+// start sends a request and returns the channel its response arrives on,
+// without waiting for it.
+func (c *Client) start(typ byte, args ...any) (<-chan response, error) {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	id := c.nextID
+	// An argument that cannot be encoded fails this request only; the
+	// connection is still fine.
+	pkt, err := marshalPacket(typ, append([]any{id}, args...)...)
+	if err != nil {
+		c.mu.Unlock()
+		return nil, err
+	}
+	c.nextID++
+	ch := make(chan response, 1)
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	c.wmu.Lock()
+	_, err = c.w.Write(pkt)
+	c.wmu.Unlock()
+	if err != nil {
+		c.fail(err)
+		return nil, err
+	}
+	return ch, nil
+}
+
+// call sends a request and waits for its response.
+func (c *Client) call(typ byte, args ...any) (response, error) {
+	ch, err := c.start(typ, args...)
+	if err != nil {
+		return response{}, err
+	}
+	r := <-ch
+	return r, r.err
+}
+
+// status returns the error carried by a status response: nil for OK,
+// io.EOF for EOF, a *StatusError otherwise.
+func (r response) status() error {
+	if r.typ != fxpStatus {
+		return fmt.Errorf("sftp: expected status, got packet type %d", r.typ)
+	}
+	d := decoder{b: r.body}
+	code := d.uint32()
+	if d.err != nil {
+		return d.err
+	}
+	switch code {
+	case statusOK:
+		return nil
+	case statusEOF:
+		return io.EOF
+	}
+	// Some old servers omit the message.
+	return &StatusError{Code: code, Msg: d.string()}
+}
+
+// expect checks that r is of type typ, turning a status reply into its error.
+func (r response) expect(typ byte) error {
+	if r.typ == typ {
+		return nil
+	}
+	if r.typ == fxpStatus {
+		if err := r.status(); err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("sftp: unexpected packet type %d", r.typ)
+}
+
+// pathErr wraps a request error with the operation and path.
+func pathErr(op, p string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &fs.PathError{Op: op, Path: p, Err: err}
+}
+
+// doStatus sends a request whose reply is a plain status.
+func (c *Client) doStatus(op, p string, typ byte, args ...any) error {
+	r, err := c.call(typ, args...)
+	if err == nil {
+		err = r.status()
+	}
+	return pathErr(op, p, err)
+}
+
+func (c *Client) stat(op string, typ byte, p string) (fs.FileInfo, error) {
+	r, err := c.call(typ, p)
+	if err == nil {
+		err = r.expect(fxpAttrs)
+	}
+	if err != nil {
+		return nil, pathErr(op, p, err)
+	}
+	d := decoder{b: r.body}
+	a := d.attrs()
+	if d.err != nil {
+		return nil, pathErr(op, p, d.err)
+	}
+	return &fileInfo{name: path.Base(p), attrs: a}, nil
+}
+
+// Stat returns information about the file at p, following symlinks.
+func (c *Client) Stat(p string) (fs.FileInfo, error) {
+	return c.stat("stat", fxpStat, p)
+}
+
+// Lstat returns information about the file at p without following symlinks.
+func (c *Client) Lstat(p string) (fs.FileInfo, error) {
+	return c.stat("lstat", fxpLstat, p)
+}
+
+// ReadDir returns the entries of directory p, sorted by name, without "."
+// and "..". Entries are described as by Lstat.
+func (c *Client) ReadDir(p string) ([]fs.FileInfo, error) {
+	handle, err := c.openHandle("opendir", p, fxpOpendir, p)
+	if err != nil {
+		return nil, err
+	}
+	defer c.closeHandle(handle)
+
+	var entries []fs.FileInfo
+	for {
+		r, err := c.call(fxpReaddir, handle)
+		if err == nil {
+			err = r.expect(fxpName)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, pathErr("readdir", p, err)
+		}
+		names, err := decodeNames(r.body)
+		if err != nil {
+			return nil, pathErr("readdir", p, err)
+		}
+		for _, fi := range names {
+			if fi.name != "." && fi.name != ".." {
+				entries = append(entries, fi)
+			}
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// decodeNames decodes the entries of a name response.
+func decodeNames(body []byte) ([]*fileInfo, error) {
+	d := decoder{b: body}
+	n := d.uint32()
+	var names []*fileInfo
+	for i := uint32(0); i < n && d.err == nil; i++ {
+		name := d.string()
+		d.string() // longname, as in ls -l
+		names = append(names, &fileInfo{name: name, attrs: d.attrs()})
+	}
+	return names, d.err
+}
+
+// name sends a request answered by a single name, such as realpath.
+func (c *Client) name(op, p string, typ byte, args ...any) (string, error) {
+	r, err := c.call(typ, args...)
+	if err == nil {
+		err = r.expect(fxpName)
+	}
+	if err != nil {
+		return "", pathErr(op, p, err)
+	}
+	names, err := decodeNames(r.body)
+	if err == nil && len(names) != 1 {
+		err = fmt.Errorf("sftp: expected 1 name, got %d", len(names))
+	}
+	if err != nil {
+		return "", pathErr(op, p, err)
+	}
+	return names[0].name, nil
+}
+
+// RealPath canonicalizes p on the server; RealPath(".") is the initial
+// working directory, usually the user's home.
+func (c *Client) RealPath(p string) (string, error) {
+	return c.name("realpath", p, fxpRealpath, p)
+}
+
+// ReadLink returns the target of symlink p.
+func (c *Client) ReadLink(p string) (string, error) {
+	return c.name("readlink", p, fxpReadlink, p)
+}
+
+// Symlink creates link pointing at target.
+func (c *Client) Symlink(target, link string) error {
+	// OpenSSH swapped the argument order the draft specifies, and every
+	// other server followed it: target first, then the link.
+	return c.doStatus("symlink", link, fxpSymlink, target, link)
+}
+
+// Mkdir creates directory p with the given permissions.
+func (c *Client) Mkdir(p string, perm fs.FileMode) error {
+	return c.doStatus("mkdir", p, fxpMkdir, p, &Attrs{Flags: attrPermissions, Perm: permBits(perm)})
+}
+
+// MkdirAll creates directory p and any missing parents.
+func (c *Client) MkdirAll(p string, perm fs.FileMode) error {
+	if fi, err := c.Stat(p); err == nil {
+		if fi.IsDir() {
+			return nil
+		}
+		return pathErr("mkdir", p, errors.New("not a directory"))
+	}
+	if parent := path.Dir(p); parent != p && parent != "." && parent != "/" {
+		if err := c.MkdirAll(parent, perm); err != nil {
+			return err
+		}
+	}
+	if err := c.Mkdir(p, perm); err != nil {
+		// Another writer may have created it meanwhile.
+		if fi, serr := c.Stat(p); serr == nil && fi.IsDir() {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// Remove deletes file p. Use RemoveDir for directories.
+func (c *Client) Remove(p string) error {
+	return c.doStatus("remove", p, fxpRemove, p)
+}
+
+// RemoveDir deletes the empty directory p.
+func (c *Client) RemoveDir(p string) error {
+	return c.doStatus("rmdir", p, fxpRmdir, p)
+}
+
+// RemoveAll deletes directory p and everything in it, without following
+// symlinks.
+func (c *Client) RemoveAll(p string) error {
+	entries, err := c.ReadDir(p)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		full := path.Join(p, e.Name())
+		if e.IsDir() {
+			err = c.RemoveAll(full)
+		} else {
+			err = c.Remove(full)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return c.RemoveDir(p)
+}
+
+// Rename renames oldpath to newpath, replacing newpath if the server
+// supports posix-rename@openssh.com (plain SFTP v3 renames never replace).
+func (c *Client) Rename(oldpath, newpath string) error {
+	if c.HasExtension("posix-rename@openssh.com") {
+		return c.doStatus("rename", oldpath, fxpExtended, "posix-rename@openssh.com", oldpath, newpath)
+	}
+	return c.doStatus("rename", oldpath, fxpRename, oldpath, newpath)
+}
+
+// Chmod changes the permissions of p.
+func (c *Client) Chmod(p string, mode fs.FileMode) error {
+	return c.doStatus("chmod", p, fxpSetstat, p, &Attrs{Flags: attrPermissions, Perm: permBits(mode)})
+}
+
+// Chtimes changes the access and modification times of p.
+func (c *Client) Chtimes(p string, atime, mtime time.Time) error {
+	a := &Attrs{Flags: attrACModTime, Atime: uint32(atime.Unix()), Mtime: uint32(mtime.Unix())}
+	return c.doStatus("chtimes", p, fxpSetstat, p, a)
+}
+
+// StatVFS describes a file system, as returned by statvfs(2).
+type StatVFS struct {
+	BlockSize     uint64 // preferred block size
+	FragmentSize  uint64 // fundamental block size; the unit of the counts
+	Blocks        uint64
+	BlocksFree    uint64
+	BlocksAvail   uint64 // free blocks available to unprivileged users
+	Files         uint64
+	FilesFree     uint64
+	FilesAvail    uint64
+	FSID          uint64
+	Flag          uint64
+	MaxNameLength uint64
+}
+
+// Total, Free and Avail return sizes in bytes.
+func (s *StatVFS) Total() uint64 { return s.Blocks * s.FragmentSize }
+func (s *StatVFS) Free() uint64  { return s.BlocksFree * s.FragmentSize }
+func (s *StatVFS) Avail() uint64 { return s.BlocksAvail * s.FragmentSize }
+
+// StatVFS returns file system usage for the file system holding p. It needs
+// the statvfs@openssh.com extension.
+func (c *Client) StatVFS(p string) (*StatVFS, error) {
+	const ext = "statvfs@openssh.com"
+	if !c.HasExtension(ext) {
+		return nil, pathErr("statvfs", p, fmt.Errorf("server does not support %s: %w", ext, errors.ErrUnsupported))
+	}
+	r, err := c.call(fxpExtended, ext, p)
+	if err == nil {
+		err = r.expect(fxpExtendedReply)
+	}
+	if err != nil {
+		return nil, pathErr("statvfs", p, err)
+	}
+	d := decoder{b: r.body}
+	s := &StatVFS{
+		BlockSize: d.uint64(), FragmentSize: d.uint64(),
+		Blocks: d.uint64(), BlocksFree: d.uint64(), BlocksAvail: d.uint64(),
+		Files: d.uint64(), FilesFree: d.uint64(), FilesAvail: d.uint64(),
+		FSID: d.uint64(), Flag: d.uint64(), MaxNameLength: d.uint64(),
+	}
+	if d.err != nil {
+		return nil, pathErr("statvfs", p, d.err)
+	}
+	return s, nil
+}
+
+// openHandle sends an open or opendir request and returns the handle.
+func (c *Client) openHandle(op, p string, typ byte, args ...any) (string, error) {
+	r, err := c.call(typ, args...)
+	if err == nil {
+		err = r.expect(fxpHandle)
+	}
+	if err != nil {
+		return "", pathErr(op, p, err)
+	}
+	d := decoder{b: r.body}
+	handle := d.string()
+	if d.err != nil {
+		return "", pathErr(op, p, d.err)
+	}
+	return handle, nil
+}
+
+func (c *Client) closeHandle(handle string) error {
+	r, err := c.call(fxpClose, handle)
+	if err != nil {
+		return err
+	}
+	return r.status()
+}
+
+// Open opens p for reading.
+func (c *Client) Open(p string) (*File, error) {
+	return c.OpenFile(p, os.O_RDONLY, 0)
+}
+
+// Create creates or truncates p for writing, with perm if it is new.
+func (c *Client) Create(p string, perm fs.FileMode) (*File, error) {
+	return c.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+}
+
+// OpenFile opens p with os.OpenFile flags. perm applies to newly created
+// files, subject to the server's umask.
+func (c *Client) OpenFile(p string, flag int, perm fs.FileMode) (*File, error) {
+	attrs := &Attrs{}
+	if flag&os.O_CREATE != 0 {
+		attrs = &Attrs{Flags: attrPermissions, Perm: permBits(perm)}
+	}
+	handle, err := c.openHandle("open", p, fxpOpen, p, toPflags(flag), attrs)
+	if err != nil {
+		return nil, err
+	}
+	f := &File{c: c, path: p, handle: handle}
+	if flag&os.O_APPEND != 0 {
+		// Servers ignore offsets for append-mode handles, but keep ours
+		// right for Seek.
+		if fi, err := f.Stat(); err == nil {
+			f.offset = fi.Size()
+		}
+	}
+	return f, nil
+}
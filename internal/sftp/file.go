@@ -0,0 +1,302 @@
+package sftp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+)
+
+// chunkSize is the size of each read and write request. Every server
+// accepts 32 KiB; larger requests are often truncated.
+const chunkSize = 32 * 1024
+
+// maxInflight is how many read or write requests a File keeps outstanding
+// when streaming, so throughput is not bound by round trips.
+const maxInflight = 64
+
+// File is an open remote file. Like *os.File, it is not safe for
+// concurrent use, but several Files may be used at once.
+type File struct {
+	c      *Client
+	path   string
+	handle string
+	offset int64
+}
+
+// Name returns the path the file was opened with.
+func (f *File) Name() string { return f.path }
+
+// Close closes the handle.
+func (f *File) Close() error {
+	return pathErr("close", f.path, f.c.closeHandle(f.handle))
+}
+
+// Stat returns information about the open file.
+func (f *File) Stat() (fs.FileInfo, error) {
+	r, err := f.c.call(fxpFstat, f.handle)
+	if err == nil {
+		err = r.expect(fxpAttrs)
+	}
+	if err != nil {
+		return nil, pathErr("fstat", f.path, err)
+	}
+	d := decoder{b: r.body}
+	a := d.attrs()
+	if d.err != nil {
+		return nil, pathErr("fstat", f.path, d.err)
+	}
+	return &fileInfo{name: path.Base(f.path), attrs: a}, nil
+}
+
+// Seek sets the offset for the next Read or Write.
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		fi, err := f.Stat()
+		if err != nil {
+			return f.offset, err
+		}
+		offset += fi.Size()
+	default:
+		return f.offset, pathErr("seek", f.path, errors.New("invalid whence"))
+	}
+	if offset < 0 {
+		return f.offset, pathErr("seek", f.path, errors.New("negative offset"))
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// readChunk sends a read request for up to chunkSize bytes at off.
+func (f *File) readChunk(off int64, n int) (<-chan response, error) {
+	return f.c.start(fxpRead, f.handle, uint64(off), uint32(min(n, chunkSize)))
+}
+
+// readData waits for a read response and returns its data, or io.EOF.
+func readData(ch <-chan response) ([]byte, error) {
+	r := <-ch
+	if r.err != nil {
+		return nil, r.err
+	}
+	if err := r.expect(fxpData); err != nil {
+		return nil, err
+	}
+	d := decoder{b: r.body}
+	data := d.bytes()
+	return data, d.err
+}
+
+// ReadAt reads len(p) bytes at off, returning io.EOF if the file ends first.
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		ch, err := f.readChunk(off+int64(n), len(p)-n)
+		if err != nil {
+			return n, pathErr("read", f.path, err)
+		}
+		data, err := readData(ch)
+		if err == io.EOF {
+			return n, io.EOF
+		}
+		if err != nil {
+			return n, pathErr("read", f.path, err)
+		}
+		if len(data) == 0 {
+			return n, io.EOF
+		}
+		n += copy(p[n:], data)
+	}
+	return n, nil
+}
+
+// Read reads up to len(p) bytes with a single request.
+func (f *File) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	ch, err := f.readChunk(f.offset, len(p))
+	if err != nil {
+		return 0, pathErr("read", f.path, err)
+	}
+	data, err := readData(ch)
+	if err == io.EOF {
+		return 0, io.EOF
+	}
+	if err != nil {
+		return 0, pathErr("read", f.path, err)
+	}
+	n := copy(p, data)
+	f.offset += int64(n)
+	return n, nil
+}
+
+// WriteTo copies the file from the current offset to w, keeping several
+// reads in flight. io.Copy uses it when the source is a File.
+func (f *File) WriteTo(w io.Writer) (int64, error) {
+	type pending struct {
+		off int64
+		ch  <-chan response
+	}
+	var queue []pending
+	next := f.offset
+	eof := false
+	var written int64
+	for {
+		for !eof && len(queue) < maxInflight {
+			ch, err := f.readChunk(next, chunkSize)
+			if err != nil {
+				return written, pathErr("read", f.path, err)
+			}
+			queue = append(queue, pending{next, ch})
+			next += chunkSize
+		}
+		if len(queue) == 0 {
+			return written, nil
+		}
+
+		req := queue[0]
+		queue = queue[1:]
+		data, err := readData(req.ch)
+		if eof || err == io.EOF {
+			// Requests past the end of the file all fail with EOF.
+			eof = true
+			continue
+		}
+		if err != nil {
+			return written, pathErr("read", f.path, err)
+		}
+
+		// A short read leaves a gap before the next request's offset;
+		// fill it before moving on.
+		for off := req.off + int64(len(data)); ; {
+			n, werr := w.Write(data)
+			written += int64(n)
+			f.offset += int64(n)
+			if werr != nil {
+				return written, werr
+			}
+			end := req.off + chunkSize
+			if off >= end || len(data) == 0 {
+				break
+			}
+			ch, err := f.readChunk(off, int(end-off))
+			if err != nil {
+				return written, pathErr("read", f.path, err)
+			}
+			data, err = readData(ch)
+			if err == io.EOF {
+				eof = true
+				break
+			}
+			if err != nil {
+				return written, pathErr("read", f.path, err)
+			}
+			off += int64(len(data))
+		}
+	}
+}
+
+// writeChunk sends a write request for p at off.
+func (f *File) writeChunk(p []byte, off int64) (<-chan response, error) {
+	return f.c.start(fxpWrite, f.handle, uint64(off), p)
+}
+
+// waitWrites waits for the write responses in queue and returns the first
+// error.
+func waitWrites(queue []<-chan response) error {
+	var first error
+	for _, ch := range queue {
+		r := <-ch
+		err := r.err
+		if err == nil {
+			err = r.status()
+		}
+		if first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// WriteAt writes p at off.
+func (f *File) WriteAt(p []byte, off int64) (int, error) {
+	var queue []<-chan response
+	for n := 0; n < len(p); n += chunkSize {
+		ch, err := f.writeChunk(p[n:min(n+chunkSize, len(p))], off+int64(n))
+		if err != nil {
+			waitWrites(queue)
+			return 0, pathErr("write", f.path, err)
+		}
+		queue = append(queue, ch)
+	}
+	if err := waitWrites(queue); err != nil {
+		return 0, pathErr("write", f.path, err)
+	}
+	return len(p), nil
+}
+
+// Write writes p at the current offset.
+func (f *File) Write(p []byte) (int, error) {
+	n, err := f.WriteAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+// ReadFrom copies r to the file from the current offset, keeping several
+// writes in flight. io.Copy uses it when the destination is a File.
+func (f *File) ReadFrom(r io.Reader) (int64, error) {
+	var queue []<-chan response
+	var total int64
+	buf := make([]byte, chunkSize)
+	for {
+		n, rerr := io.ReadFull(r, buf)
+		if n > 0 {
+			if len(queue) == maxInflight {
+				if err := waitWrites(queue[:1]); err != nil {
+					waitWrites(queue[1:])
+					return total, pathErr("write", f.path, err)
+				}
+				queue = queue[1:]
+			}
+			// The request is encoded before writeChunk returns, so buf
+			// can be reused.
+			ch, err := f.writeChunk(buf[:n], f.offset)
+			if err != nil {
+				waitWrites(queue)
+				return total, pathErr("write", f.path, err)
+			}
+			queue = append(queue, ch)
+			f.offset += int64(n)
+			total += int64(n)
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			waitWrites(queue)
+			return total, rerr
+		}
+	}
+	if err := waitWrites(queue); err != nil {
+		return total, pathErr("write", f.path, err)
+	}
+	return total, nil
+}
+
+// Chmod changes the permissions of the open file.
+func (f *File) Chmod(mode fs.FileMode) error {
+	return f.c.doStatus("chmod", f.path, fxpFsetstat, f.handle, &Attrs{Flags: attrPermissions, Perm: permBits(mode)})
+}
+
+// Truncate changes the size of the open file.
+func (f *File) Truncate(size int64) error {
+	if size < 0 {
+		return pathErr("truncate", f.path, fmt.Errorf("negative size %d", size))
+	}
+	return f.c.doStatus("truncate", f.path, fxpFsetstat, f.handle, &Attrs{Flags: attrSize, Size: uint64(size)})
+}
@@ -0,0 +1,190 @@
+package sftp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// testServer serves one in-memory file over the SFTP protocol. Reads
+// return at most maxRead bytes, like servers that cap their replies.
+type testServer struct {
+	data    []byte
+	maxRead int
+}
+
+// serve answers requests from r on w until r is closed.
+func (s *testServer) serve(r io.Reader, w io.WriteCloser) {
+	defer w.Close()
+	for {
+		typ, body, err := readPacket(r)
+		if err != nil {
+			return
+		}
+		if typ == fxpInit {
+			writePacket(w, fxpVersion, uint32(3))
+			continue
+		}
+		d := decoder{b: body}
+		id := d.uint32()
+		switch typ {
+		case fxpOpen:
+			writePacket(w, fxpHandle, id, "h")
+		case fxpClose:
+			writePacket(w, fxpStatus, id, uint32(statusOK), "", "")
+		case fxpRead:
+			d.string()
+			off, n := d.uint64(), int(d.uint32())
+			if off >= uint64(len(s.data)) {
+				writePacket(w, fxpStatus, id, uint32(statusEOF), "", "")
+				continue
+			}
+			n = min(n, s.maxRead, len(s.data)-int(off))
+			writePacket(w, fxpData, id, s.data[off:int(off)+n])
+		default:
+			writePacket(w, fxpStatus, id, uint32(statusOpUnsupported), "", "")
+		}
+	}
+}
+
+// newTestClient connects a Client to s over in-memory pipes.
+func newTestClient(t *testing.T, s *testServer) *Client {
+	t.Helper()
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	go s.serve(sr, sw)
+	c, err := NewClient(cr, cw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func testData(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i * 7 / 3)
+	}
+	return b
+}
+
+func TestWriteTo(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		maxRead int
+		offset  int64
+	}{
+		{"empty", 0, chunkSize, 0},
+		{"one byte", 1, chunkSize, 0},
+		{"whole chunks", 4 * chunkSize, chunkSize, 0},
+		{"partial last chunk", 3*chunkSize + 123, chunkSize, 0},
+		{"more than in flight", (maxInflight+3)*chunkSize + 5, chunkSize, 0},
+		{"short reads", 3*chunkSize + 123, 1000, 0},
+		{"short reads ending mid-gap", 2*chunkSize + 500, 1000, 0},
+		{"from offset", 3*chunkSize + 123, 1000, chunkSize + 17},
+		{"offset at end", 100, chunkSize, 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &testServer{data: testData(tt.size), maxRead: tt.maxRead}
+			c := newTestClient(t, s)
+			f, err := c.Open("/file")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			if _, err := f.Seek(tt.offset, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+
+			var buf bytes.Buffer
+			n, err := f.WriteTo(&buf)
+			if err != nil {
+				t.Fatalf("WriteTo: %v", err)
+			}
+			want := s.data[tt.offset:]
+			if n != int64(len(want)) || !bytes.Equal(buf.Bytes(), want) {
+				t.Fatalf("got %d bytes (%d buffered), want %d; content equal: %v", n, buf.Len(), len(want), bytes.Equal(buf.Bytes(), want))
+			}
+			if f.offset != int64(tt.size) {
+				t.Errorf("offset after WriteTo: got %d, want %d", f.offset, tt.size)
+			}
+
+			// A second copy at the end of the file writes nothing.
+			buf.Reset()
+			if n, err := f.WriteTo(&buf); n != 0 || err != nil {
+				t.Errorf("WriteTo at EOF: got %d, %v", n, err)
+			}
+		})
+	}
+}
+
+// errWriter accepts limit bytes and then fails.
+type errWriter struct {
+	limit int
+}
+
+var errWrite = errors.New("write failed")
+
+func (w *errWriter) Write(p []byte) (int, error) {
+	if len(p) > w.limit {
+		n := w.limit
+		w.limit = 0
+		return n, errWrite
+	}
+	w.limit -= len(p)
+	return len(p), nil
+}
+
+func TestWriteToWriterError(t *testing.T) {
+	s := &testServer{data: testData(4 * chunkSize), maxRead: chunkSize}
+	c := newTestClient(t, s)
+	f, err := c.Open("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	n, err := f.WriteTo(&errWriter{limit: chunkSize + 10})
+	if err != errWrite || n != chunkSize+10 {
+		t.Fatalf("got %d, %v; want %d, %v", n, err, chunkSize+10, errWrite)
+	}
+	// The client still works after abandoning the reads in flight.
+	buf := make([]byte, 10)
+	if _, err := f.ReadAt(buf, 0); err != nil || !bytes.Equal(buf, s.data[:10]) {
+		t.Errorf("ReadAt after error: %v", err)
+	}
+}
+
+func TestReadAtShortReads(t *testing.T) {
+	s := &testServer{data: testData(5000), maxRead: 1000}
+	c := newTestClient(t, s)
+	f, err := c.Open("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	buf := make([]byte, 2500)
+	if n, err := f.ReadAt(buf, 100); n != len(buf) || err != nil || !bytes.Equal(buf, s.data[100:2600]) {
+		t.Errorf("ReadAt: got %d, %v", n, err)
+	}
+	if n, err := f.ReadAt(buf, 4000); n != 1000 || err != io.EOF {
+		t.Errorf("ReadAt past end: got %d, %v; want 1000, EOF", n, err)
+	}
+}
+
+func TestUnmarshalableRequestKeepsClient(t *testing.T) {
+	c := newTestClient(t, &testServer{data: testData(10), maxRead: chunkSize})
+	if _, err := c.call(fxpStat, 42); err == nil {
+		t.Fatal("request with an int argument succeeded")
+	}
+	f, err := c.Open("/file")
+	if err != nil {
+		t.Fatalf("Open after failed request: %v", err)
+	}
+	f.Close()
+}
@@ -0,0 +1,378 @@
+package sftp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// Packet types from draft-ietf-secsh-filexfer-02 (protocol version 3).
+const (
+	fxpInit          = 1
+	fxpVersion       = 2
+	fxpOpen          = 3
+	fxpClose         = 4
+	fxpRead          = 5
+	fxpWrite         = 6
+	fxpLstat         = 7
+	fxpFstat         = 8
+	fxpSetstat       = 9
+	fxpFsetstat      = 10
+	fxpOpendir       = 11
+	fxpReaddir       = 12
+	fxpRemove        = 13
+	fxpMkdir         = 14
+	fxpRmdir         = 15
+	fxpRealpath      = 16
+	fxpStat          = 17
+	fxpRename        = 18
+	fxpReadlink      = 19
+	fxpSymlink       = 20
+	fxpStatus        = 101
+	fxpHandle        = 102
+	fxpData          = 103
+	fxpName          = 104
+	fxpAttrs         = 105
+	fxpExtended      = 200
+	fxpExtendedReply = 201
+)
+
+// Open flags.
+const (
+	fxfRead   = 0x01
+	fxfWrite  = 0x02
+	fxfAppend = 0x04
+	fxfCreat  = 0x08
+	fxfTrunc  = 0x10
+	fxfExcl   = 0x20
+)
+
+// Attribute flags.
+const (
+	attrSize        = 0x01
+	attrUIDGID      = 0x02
+	attrPermissions = 0x04
+	attrACModTime   = 0x08
+	attrExtended    = 0x80000000
+)
+
+// Status codes.
+const (
+	statusOK               = 0
+	statusEOF              = 1
+	statusNoSuchFile       = 2
+	statusPermissionDenied = 3
+	statusFailure          = 4
+	statusBadMessage       = 5
+	statusNoConnection     = 6
+	statusConnectionLost   = 7
+	statusOpUnsupported    = 8
+)
+
+// maxPacket bounds incoming packets. Servers must accept 34000-byte
+// packets; replies are bounded by what we request plus headers.
+const maxPacket = 256 * 1024
+
+// StatusError is a failure status returned by the server.
+type StatusError struct {
+	Code uint32
+	Msg  string
+}
+
+func (e *StatusError) Error() string {
+	if e.Msg != "" {
+		return e.Msg
+	}
+	switch e.Code {
+	case statusNoSuchFile:
+		return "no such file"
+	case statusPermissionDenied:
+		return "permission denied"
+	case statusBadMessage:
+		return "bad message"
+	case statusNoConnection:
+		return "no connection"
+	case statusConnectionLost:
+		return "connection lost"
+	case statusOpUnsupported:
+		return "operation unsupported"
+	}
+	return fmt.Sprintf("failure (status %d)", e.Code)
+}
+
+// Is lets errors.Is match StatusErrors against fs.ErrNotExist,
+// fs.ErrPermission and errors.ErrUnsupported.
+func (e *StatusError) Is(target error) bool {
+	switch target {
+	case fs.ErrNotExist:
+		return e.Code == statusNoSuchFile
+	case fs.ErrPermission:
+		return e.Code == statusPermissionDenied
+	case errors.ErrUnsupported:
+		return e.Code == statusOpUnsupported
+	}
+	return false
+}
+
+// Attrs are the file attributes carried by the protocol. Flags records
+// which fields are present.
+type Attrs struct {
+	Flags uint32
+	Size  uint64
+	UID   uint32
+	GID   uint32
+	// Perm is the POSIX st_mode, file type bits included.
+	Perm  uint32
+	Atime uint32
+	Mtime uint32
+}
+
+// POSIX file type bits in Attrs.Perm.
+const (
+	modeType    = 0170000
+	modeFIFO    = 0010000
+	modeChar    = 0020000
+	modeDir     = 0040000
+	modeBlock   = 0060000
+	modeRegular = 0100000
+	modeSymlink = 0120000
+	modeSocket  = 0140000
+)
+
+// FileMode converts Perm to an fs.FileMode.
+func (a *Attrs) FileMode() fs.FileMode {
+	m := fs.FileMode(a.Perm & 0777)
+	switch a.Perm & modeType {
+	case modeDir:
+		m |= fs.ModeDir
+	case modeSymlink:
+		m |= fs.ModeSymlink
+	case modeFIFO:
+		m |= fs.ModeNamedPipe
+	case modeSocket:
+		m |= fs.ModeSocket
+	case modeChar:
+		m |= fs.ModeDevice | fs.ModeCharDevice
+	case modeBlock:
+		m |= fs.ModeDevice
+	}
+	if a.Perm&04000 != 0 {
+		m |= fs.ModeSetuid
+	}
+	if a.Perm&02000 != 0 {
+		m |= fs.ModeSetgid
+	}
+	if a.Perm&01000 != 0 {
+		m |= fs.ModeSticky
+	}
+	return m
+}
+
+// permBits converts the permission bits of m to POSIX mode bits.
+func permBits(m fs.FileMode) uint32 {
+	p := uint32(m.Perm())
+	if m&fs.ModeSetuid != 0 {
+		p |= 04000
+	}
+	if m&fs.ModeSetgid != 0 {
+		p |= 02000
+	}
+	if m&fs.ModeSticky != 0 {
+		p |= 01000
+	}
+	return p
+}
+
+// fileInfo implements fs.FileInfo for a name and its Attrs.
+type fileInfo struct {
+	name  string
+	attrs Attrs
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return int64(fi.attrs.Size) }
+func (fi *fileInfo) Mode() fs.FileMode  { return fi.attrs.FileMode() }
+func (fi *fileInfo) ModTime() time.Time { return time.Unix(int64(fi.attrs.Mtime), 0) }
+func (fi *fileInfo) IsDir() bool        { return fi.Mode().IsDir() }
+
+// Sys returns the *Attrs.
+func (fi *fileInfo) Sys() any { return &fi.attrs }
+
+// marshal appends the wire encoding of each arg to b. Strings and byte
+// slices are length-prefixed.
+func marshal(b []byte, args ...any) ([]byte, error) {
+	for _, arg := range args {
+		switch v := arg.(type) {
+		case byte:
+			b = append(b, v)
+		case uint32:
+			b = binary.BigEndian.AppendUint32(b, v)
+		case uint64:
+			b = binary.BigEndian.AppendUint64(b, v)
+		case string:
+			b = binary.BigEndian.AppendUint32(b, uint32(len(v)))
+			b = append(b, v...)
+		case []byte:
+			b = binary.BigEndian.AppendUint32(b, uint32(len(v)))
+			b = append(b, v...)
+		case *Attrs:
+			b = binary.BigEndian.AppendUint32(b, v.Flags&^attrExtended)
+			if v.Flags&attrSize != 0 {
+				b = binary.BigEndian.AppendUint64(b, v.Size)
+			}
+			if v.Flags&attrUIDGID != 0 {
+				b = binary.BigEndian.AppendUint32(b, v.UID)
+				b = binary.BigEndian.AppendUint32(b, v.GID)
+			}
+			if v.Flags&attrPermissions != 0 {
+				b = binary.BigEndian.AppendUint32(b, v.Perm)
+			}
+			if v.Flags&attrACModTime != 0 {
+				b = binary.BigEndian.AppendUint32(b, v.Atime)
+				b = binary.BigEndian.AppendUint32(b, v.Mtime)
+			}
+		default:
+			return nil, fmt.Errorf("sftp: cannot marshal %T", arg)
+		}
+	}
+	return b, nil
+}
+
+// decoder reads wire-encoded fields from a packet body. The first short
+// read sets err; later reads return zero values.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+var errShortPacket = errors.New("sftp: packet too short")
+
+func (d *decoder) uint32() uint32 {
+	if len(d.b) < 4 {
+		d.err = errShortPacket
+		return 0
+	}
+	v := binary.BigEndian.Uint32(d.b)
+	d.b = d.b[4:]
+	return v
+}
+
+func (d *decoder) uint64() uint64 {
+	if len(d.b) < 8 {
+		d.err = errShortPacket
+		return 0
+	}
+	v := binary.BigEndian.Uint64(d.b)
+	d.b = d.b[8:]
+	return v
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.uint32()
+	if d.err != nil || uint32(len(d.b)) < n {
+		d.err = errShortPacket
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes())
+}
+
+func (d *decoder) attrs() Attrs {
+	a := Attrs{Flags: d.uint32()}
+	if a.Flags&attrSize != 0 {
+		a.Size = d.uint64()
+	}
+	if a.Flags&attrUIDGID != 0 {
+		a.UID = d.uint32()
+		a.GID = d.uint32()
+	}
+	if a.Flags&attrPermissions != 0 {
+		a.Perm = d.uint32()
+	}
+	if a.Flags&attrACModTime != 0 {
+		a.Atime = d.uint32()
+		a.Mtime = d.uint32()
+	}
+	if a.Flags&attrExtended != 0 {
+		for n := d.uint32(); n > 0 && d.err == nil; n-- {
+			d.string()
+			d.string()
+		}
+	}
+	return a
+}
+
+// marshalPacket returns the length-prefixed encoding of a packet.
+func marshalPacket(typ byte, args ...any) ([]byte, error) {
+	b, err := marshal(make([]byte, 4, 64), append([]any{typ}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+	return b, nil
+}
+
+// writePacket writes one length-prefixed packet.
+func writePacket(w io.Writer, typ byte, args ...any) error {
+	b, err := marshalPacket(typ, args...)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// readPacket reads one packet and returns its type and body.
+func readPacket(r io.Reader) (byte, []byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n < 1 || n > maxPacket {
+		return 0, nil, fmt.Errorf("sftp: invalid packet length %d", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	return b[0], b[1:], nil
+}
+
+// toPflags converts os.OpenFile flags to SFTP open flags.
+func toPflags(flag int) uint32 {
+	var p uint32
+	switch flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR) {
+	case os.O_RDONLY:
+		p = fxfRead
+	case os.O_WRONLY:
+		p = fxfWrite
+	case os.O_RDWR:
+		p = fxfRead | fxfWrite
+	}
+	if flag&os.O_APPEND != 0 {
+		p |= fxfAppend
+	}
+	if flag&os.O_CREATE != 0 {
+		p |= fxfCreat
+	}
+	if flag&os.O_TRUNC != 0 {
+		p |= fxfTrunc
+	}
+	if flag&os.O_EXCL != 0 {
+		p |= fxfExcl
+	}
+	return p
+}
@@ -0,0 +1,126 @@
+package sftp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestMarshalDecode(t *testing.T) {
+	attrs := &Attrs{
+		Flags: attrSize | attrUIDGID | attrPermissions | attrACModTime,
+		Size:  1 << 40,
+		UID:   1000,
+		GID:   100,
+		Perm:  modeRegular | 0644,
+		Atime: 1700000000,
+		Mtime: 1700000001,
+	}
+	b, err := marshal(nil, byte(7), uint32(42), uint64(1<<33), "name", []byte{1, 2, 3}, attrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := decoder{b: b}
+	if len(d.b) == 0 || d.b[0] != 7 {
+		t.Fatalf("byte: got %v", d.b[:1])
+	}
+	d.b = d.b[1:]
+	if v := d.uint32(); v != 42 {
+		t.Errorf("uint32: got %d", v)
+	}
+	if v := d.uint64(); v != 1<<33 {
+		t.Errorf("uint64: got %d", v)
+	}
+	if v := d.string(); v != "name" {
+		t.Errorf("string: got %q", v)
+	}
+	if v := d.bytes(); !bytes.Equal(v, []byte{1, 2, 3}) {
+		t.Errorf("bytes: got %v", v)
+	}
+	if v := d.attrs(); v != *attrs {
+		t.Errorf("attrs: got %+v, want %+v", v, *attrs)
+	}
+	if d.err != nil || len(d.b) != 0 {
+		t.Errorf("decoder left err=%v, %d bytes", d.err, len(d.b))
+	}
+}
+
+func TestMarshalAttrsOmitsAbsentFields(t *testing.T) {
+	b, err := marshal(nil, &Attrs{Flags: attrPermissions | attrExtended, Size: 99, Perm: 0755})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Flags without the extended bit, then the permissions only.
+	want := []byte{0, 0, 0, attrPermissions, 0, 0, 0x01, 0xed}
+	if !bytes.Equal(b, want) {
+		t.Errorf("got %x, want %x", b, want)
+	}
+}
+
+func TestMarshalUnsupportedType(t *testing.T) {
+	if _, err := marshal(nil, uint32(1), 5); err == nil {
+		t.Fatal("marshal of an int succeeded")
+	}
+	if err := writePacket(io.Discard, fxpStat, 5); err == nil {
+		t.Fatal("writePacket of an int succeeded")
+	}
+}
+
+func TestDecodeAttrsSkipsExtensions(t *testing.T) {
+	b, _ := marshal(nil, uint32(attrSize|attrExtended), uint64(5), uint32(1), "ext@example.com", "data", uint32(9))
+	d := decoder{b: b}
+	a := d.attrs()
+	if d.err != nil || a.Size != 5 {
+		t.Fatalf("got %+v, err %v", a, d.err)
+	}
+	if v := d.uint32(); v != 9 {
+		t.Errorf("field after extensions: got %d", v)
+	}
+}
+
+func TestDecoderShortPacket(t *testing.T) {
+	d := decoder{b: []byte{0, 0, 0, 10, 'a'}}
+	if s := d.string(); s != "" || !errors.Is(d.err, errShortPacket) {
+		t.Fatalf("got %q, err %v", s, d.err)
+	}
+	if v := d.uint32(); v != 0 || d.err == nil {
+		t.Errorf("read after error: got %d, err %v", v, d.err)
+	}
+}
+
+func TestPacketRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writePacket(&buf, fxpOpen, uint32(3), "/tmp/x", uint32(fxfRead), &Attrs{}); err != nil {
+		t.Fatal(err)
+	}
+	if n := binary.BigEndian.Uint32(buf.Bytes()); int(n) != buf.Len()-4 {
+		t.Fatalf("length prefix %d for %d bytes", n, buf.Len()-4)
+	}
+	typ, body, err := readPacket(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := decoder{b: body}
+	id, p, flags, attrs := d.uint32(), d.string(), d.uint32(), d.attrs()
+	if typ != fxpOpen || id != 3 || p != "/tmp/x" || flags != fxfRead || attrs.Flags != 0 || d.err != nil {
+		t.Errorf("got type %d id %d path %q flags %d attrs %+v err %v", typ, id, p, flags, attrs, d.err)
+	}
+}
+
+func TestReadPacketErrors(t *testing.T) {
+	if _, _, err := readPacket(bytes.NewReader([]byte{0, 0, 0, 0})); err == nil {
+		t.Error("zero-length packet accepted")
+	}
+	if _, _, err := readPacket(bytes.NewReader([]byte{0xff, 0, 0, 0})); err == nil {
+		t.Error("oversized packet accepted")
+	}
+	if _, _, err := readPacket(bytes.NewReader([]byte{0, 0, 0, 5, fxpData})); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated packet: got %v", err)
+	}
+	if _, _, err := readPacket(bytes.NewReader(nil)); err != io.EOF {
+		t.Errorf("empty stream: got %v", err)
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !windows
+
+package ssh
+
+import (
+	"io/fs"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// accessTime returns the last access time of the local file path, or its
+// modification time if that cannot be read.
+func accessTime(path string, fi fs.FileInfo) time.Time {
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return fi.ModTime()
+	}
+	return time.Unix(st.Atim.Unix())
+}
@@ -0,0 +1,18 @@
+//go:build windows
+
+package ssh
+
+import (
+	"io/fs"
+	"syscall"
+	"time"
+)
+
+// accessTime returns the last access time of the local file path, or its
+// modification time if that cannot be read.
+func accessTime(path string, fi fs.FileInfo) time.Time {
+	if d, ok := fi.Sys().(*syscall.Win32FileAttributeData); ok {
+		return time.Unix(0, d.LastAccessTime.Nanoseconds())
+	}
+	return fi.ModTime()
+}
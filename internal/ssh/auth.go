@@ -1,60 +1,225 @@
 package ssh
 
 import (
+	"bytes"
+	"fmt"
 	"net"
 	"os"
 	"path/filepath"
+	"strings"
 
 	gossh "golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
 )
 
-func authMethods(password string) []gossh.AuthMethod {
-	methods := make([]gossh.AuthMethod, 0, 3)
+// Agent key modes control how keys from the SSH agent ($SSH_AUTH_SOCK) are
+// used relative to the server's stored key and the default ~/.ssh keys.
+const (
+	AgentKeysDefault = ""       // stored key, then agent keys, then default keys
+	AgentKeysPrefer  = "prefer" // agent keys first
+	AgentKeysOnly    = "only"   // agent keys only
+	AgentKeysOff     = "off"    // never contact the agent
+)
+
+// ParseAgentKeys validates an agent key mode. "default" is accepted as an
+// alias for AgentKeysDefault.
+func ParseAgentKeys(s string) (string, error) {
+	switch s {
+	case "", "default":
+		return AgentKeysDefault, nil
+	case AgentKeysPrefer, AgentKeysOnly, AgentKeysOff:
+		return s, nil
+	}
+	return "", fmt.Errorf("invalid agent key mode %q (use default, prefer, only or off)", s)
+}
+
+// Authentication methods, in the order tried by default.
+const (
+	AuthPublicKey           = "publickey"
+	AuthKeyboardInteractive = "keyboard-interactive"
+	AuthPassword            = "password"
+)
+
+var defaultAuthOrder = []string{AuthPublicKey, AuthKeyboardInteractive, AuthPassword}
+
+// ParseAuthMethods parses a comma-separated, ordered list of auth methods.
+// An empty string means the default order.
+func ParseAuthMethods(s string) ([]string, error) {
+	if s == "" || s == "default" {
+		return nil, nil
+	}
+	var methods []string
+	seen := make(map[string]bool)
+	for _, m := range strings.Split(s, ",") {
+		m = strings.TrimSpace(m)
+		switch m {
+		case AuthPublicKey, AuthKeyboardInteractive, AuthPassword:
+		default:
+			return nil, fmt.Errorf("invalid auth method %q (use publickey, keyboard-interactive or password)", m)
+		}
+		if !seen[m] {
+			seen[m] = true
+			methods = append(methods, m)
+		}
+	}
+	return methods, nil
+}
+
+// authMethods builds the auth methods for t in t.AuthMethods order.
+// agentClient may be nil; when set, its connection must stay open until
+// authentication has finished, since agent signers sign through it lazily.
+func authMethods(t *Target, agentClient agent.ExtendedAgent) ([]gossh.AuthMethod, error) {
+	// Explicit keys: the stored key, then identity files, in that order.
+	var explicit []gossh.Signer
+	var explicitPubs []gossh.PublicKey
+	if len(t.PrivateKey) > 0 {
+		signer, err := ParsePrivateKey(t.PrivateKey, t.Passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("parsing stored private key: %w", err)
+		}
+		explicit = append(explicit, signer)
+		explicitPubs = append(explicitPubs, signer.PublicKey())
+	}
+	signers, pubs := loadIdentities(t.IdentityFiles)
+	explicit = append(explicit, signers...)
+	explicitPubs = append(explicitPubs, pubs...)
+
+	publicKeys := gossh.PublicKeysCallback(func() ([]gossh.Signer, error) {
+		var agentSigners []gossh.Signer
+		if agentClient != nil {
+			agentSigners, _ = agentClient.Signers()
+		}
+		var defaults []gossh.Signer
+		if t.IdentitiesOnly {
+			// Like OpenSSH's IdentitiesOnly: agent keys are still used, but
+			// only those matching an explicitly configured identity.
+			agentSigners = filterSigners(agentSigners, explicitPubs)
+		} else {
+			defaults = loadDefaultKeySigners()
+		}
+
+		var signers []gossh.Signer
+		switch t.AgentKeys {
+		case AgentKeysOnly:
+			signers = agentSigners
+		case AgentKeysPrefer:
+			signers = concatSigners(agentSigners, explicit, defaults)
+		case AgentKeysOff:
+			signers = concatSigners(explicit, defaults)
+		default:
+			signers = concatSigners(explicit, agentSigners, defaults)
+		}
+		return dedupSigners(signers), nil
+	})
+
+	password := t.Password
+	keyboardInteractive := gossh.RetryableAuthMethod(gossh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		answers := make([]string, len(questions))
+		for i := range questions {
+			answers[i] = password
+		}
+		return answers, nil
+	}), 3)
+	passwordAuth := gossh.RetryableAuthMethod(gossh.PasswordCallback(func() (string, error) {
+		return password, nil
+	}), 3)
+
+	order := t.AuthMethods
+	if len(order) == 0 {
+		order = defaultAuthOrder
+	}
+	methods := make([]gossh.AuthMethod, 0, len(order))
+	for _, m := range order {
+		switch m {
+		case AuthPublicKey:
+			methods = append(methods, publicKeys)
+		case AuthKeyboardInteractive:
+			// Key-only servers have no stored password; don't waste auth attempts.
+			if password != "" {
+				methods = append(methods, keyboardInteractive)
+			}
+		case AuthPassword:
+			if password != "" {
+				methods = append(methods, passwordAuth)
+			}
+		}
+	}
+	return methods, nil
+}
 
-	if signers := loadSigners(); len(signers) > 0 {
-		methods = append(methods, gossh.PublicKeys(signers...))
+// loadIdentities reads identity files. Keys that can't be parsed (e.g.
+// passphrase-protected) contribute only their public key, read from the
+// ".pub" file next to them, so a matching agent key can still be selected.
+func loadIdentities(paths []string) ([]gossh.Signer, []gossh.PublicKey) {
+	var signers []gossh.Signer
+	var pubs []gossh.PublicKey
+	for _, path := range paths {
+		if data, err := os.ReadFile(path); err == nil {
+			if signer, err := gossh.ParsePrivateKey(data); err == nil {
+				signers = append(signers, signer)
+				pubs = append(pubs, signer.PublicKey())
+				continue
+			}
+		}
+		if data, err := os.ReadFile(path + ".pub"); err == nil {
+			if pub, _, _, _, err := gossh.ParseAuthorizedKey(data); err == nil {
+				pubs = append(pubs, pub)
+			}
+		}
 	}
+	return signers, pubs
+}
 
-	methods = append(methods,
-		gossh.RetryableAuthMethod(gossh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
-			answers := make([]string, len(questions))
-			for i := range questions {
-				answers[i] = password
+// filterSigners keeps the signers whose public key is in allowed.
+func filterSigners(signers []gossh.Signer, allowed []gossh.PublicKey) []gossh.Signer {
+	var out []gossh.Signer
+	for _, s := range signers {
+		for _, pub := range allowed {
+			if bytes.Equal(s.PublicKey().Marshal(), pub.Marshal()) {
+				out = append(out, s)
+				break
 			}
-			return answers, nil
-		}), 3),
-		gossh.RetryableAuthMethod(gossh.PasswordCallback(func() (string, error) {
-			return password, nil
-		}), 3),
-	)
-
-	return methods
+		}
+	}
+	return out
 }
 
-func loadSigners() []gossh.Signer {
-	signers := loadAgentSigners()
-	signers = append(signers, loadDefaultKeySigners()...)
-	return signers
+func concatSigners(lists ...[]gossh.Signer) []gossh.Signer {
+	var out []gossh.Signer
+	for _, l := range lists {
+		out = append(out, l...)
+	}
+	return out
+}
+
+// dedupSigners drops signers whose public key was already offered, so the
+// same key isn't tried twice against MaxAuthTries.
+func dedupSigners(signers []gossh.Signer) []gossh.Signer {
+	seen := make(map[string]bool)
+	out := signers[:0:0]
+	for _, s := range signers {
+		k := string(s.PublicKey().Marshal())
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		out = append(out, s)
+	}
+	return out
 }
 
-func loadAgentSigners() []gossh.Signer {
+// dialAgent connects to the SSH agent at $SSH_AUTH_SOCK. It returns nil if
+// no agent is available.
+func dialAgent() net.Conn {
 	sock := os.Getenv("SSH_AUTH_SOCK")
 	if sock == "" {
 		return nil
 	}
-
 	conn, err := net.Dial("unix", sock)
 	if err != nil {
 		return nil
 	}
-	defer conn.Close()
-
-	signers, err := agent.NewClient(conn).Signers()
-	if err != nil {
-		return nil
-	}
-	return signers
+	return conn
 }
 
 func loadDefaultKeySigners() []gossh.Signer {
@@ -20,41 +20,43 @@ import (
 // Connect establishes an SSH connection and starts an interactive shell session.
 // If the connection drops, it auto-reconnects with backoff for up to
 // maxAutoRetryDuration; after that it pauses and waits for the user to press
-// Enter to retry.
-func Connect(host string, port int, user, password string) error {
+// Enter to retry. Port forwards in t.Forwards run alongside the shell and are
+// re-established on every reconnect. When the remote shell exits, Connect
+// returns nil for status 0, or an error from which ExitStatus recovers the
+// exit status and signal name.
+func Connect(t *Target) error {
 	fd := int(os.Stdin.Fd())
 
-	for {
-		_, err := runSession(host, port, user, password, fd)
-		if err == nil || isCleanExit(err) {
-			return nil
-		}
-		fmt.Fprintf(os.Stderr, "\r\nConnection lost: %v\r\n", err)
+	fwd, err := openForwards(t.Forwards)
+	if err != nil {
+		return err
+	}
+	defer fwd.Close()
 
-		if err := reconnectLoop(host, port, user, password, fd); err != nil {
-			return err
-		}
+	_, err = runSession(t, fd, fwd)
+	if err == nil || isCleanExit(err) || isHostKeyError(err) {
+		return err
 	}
+	fmt.Fprintf(os.Stderr, "\r\nConnection lost: %v\r\n", err)
+
+	return reconnectLoop(t, fd, fwd)
 }
 
-func reconnectLoop(host string, port int, user, password string, fd int) error {
+func reconnectLoop(t *Target, fd int, fwd *forwardSet) error {
 	for {
-		err := autoReconnect(host, port, user, password, fd)
-		if err == nil {
-			return nil
-		}
+		err := autoReconnect(t, fd, fwd)
 		if !errors.Is(err, errAutoRetryExhausted) {
 			return err
 		}
 
-		if err := waitForEnter(host, port, user); err != nil {
+		if err := waitForEnter(t); err != nil {
 			return err
 		}
 
-		fmt.Fprintf(os.Stderr, "Reconnecting to %s@%s:%d...\r\n", user, host, port)
-		_, err = runSession(host, port, user, password, fd)
-		if err == nil || isCleanExit(err) {
-			return nil
+		fmt.Fprintf(os.Stderr, "Reconnecting to %s@%s:%d...\r\n", t.User, t.Host, t.Port)
+		_, err = runSession(t, fd, fwd)
+		if err == nil || isCleanExit(err) || isHostKeyError(err) {
+			return err
 		}
 		fmt.Fprintf(os.Stderr, "Connection lost: %v\r\n", err)
 	}
@@ -62,7 +64,7 @@ func reconnectLoop(host string, port int, user, password string, fd int) error {
 
 var errAutoRetryExhausted = errors.New("auto-retry exhausted")
 
-func autoReconnect(host string, port int, user, password string, fd int) error {
+func autoReconnect(t *Target, fd int, fwd *forwardSet) error {
 	backoff := time.Second
 	deadline := time.Now().Add(maxAutoRetryDuration)
 
@@ -70,11 +72,11 @@ func autoReconnect(host string, port int, user, password string, fd int) error {
 		fmt.Fprintf(os.Stderr, "Reconnecting in %s (Enter to retry now)...\r\n", backoff)
 		sleepOrEnter(backoff)
 
-		fmt.Fprintf(os.Stderr, "Reconnecting to %s@%s:%d...\r\n", user, host, port)
+		fmt.Fprintf(os.Stderr, "Reconnecting to %s@%s:%d...\r\n", t.User, t.Host, t.Port)
 		start := time.Now()
-		connected, err := runSession(host, port, user, password, fd)
-		if err == nil || isCleanExit(err) {
-			return nil
+		connected, err := runSession(t, fd, fwd)
+		if err == nil || isCleanExit(err) || isHostKeyError(err) {
+			return err
 		}
 		fmt.Fprintf(os.Stderr, "Connection lost: %v\r\n", err)
 
@@ -88,10 +90,10 @@ func autoReconnect(host string, port int, user, password string, fd int) error {
 	return errAutoRetryExhausted
 }
 
-func waitForEnter(host string, port int, user string) error {
+func waitForEnter(t *Target) error {
 	fmt.Fprintf(os.Stderr,
 		"\r\nAuto-reconnect paused after %s. Press Enter to retry %s@%s:%d, or Ctrl+C to quit.\r\n",
-		maxAutoRetryDuration, user, host, port)
+		maxAutoRetryDuration, t.User, t.Host, t.Port)
 	reader := bufio.NewReader(os.Stdin)
 	_, err := reader.ReadString('\n')
 	return err
@@ -101,13 +103,18 @@ func waitForEnter(host string, port int, user string) error {
 // reports whether Dial succeeded — callers use this to distinguish a failed
 // connection (TCP timeout, host down) from a session that connected and then
 // dropped, since the two have very different retry semantics.
-func runSession(host string, port int, user, password string, fd int) (bool, error) {
-	client, err := Dial(host, port, user, password)
+func runSession(t *Target, fd int, fwd *forwardSet) (bool, error) {
+	client, err := Dial(t)
 	if err != nil {
 		return false, err
 	}
 	defer client.Close()
 
+	if err := fwd.attach(client); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\r\n", err)
+	}
+	defer fwd.detach()
+
 	session, err := client.NewSession()
 	if err != nil {
 		return true, fmt.Errorf("creating session: %w", err)
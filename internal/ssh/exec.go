@@ -0,0 +1,95 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// Exec runs command on t and streams stdin, stdout and stderr. No PTY is
+// allocated unless tty is true, so output stays byte-exact for scripts.
+// A non-zero remote exit is returned as an error that ExitStatus recognizes.
+func Exec(t *Target, command string, tty bool) error {
+	client, err := Dial(t)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return fmt.Errorf("creating session: %w", err)
+	}
+	defer session.Close()
+
+	if tty {
+		restore, err := requestExecPty(session)
+		if err != nil {
+			return err
+		}
+		defer restore()
+	}
+
+	session.Stdout = os.Stdout
+	session.Stderr = os.Stderr
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("getting stdin pipe: %w", err)
+	}
+
+	stdinDone := make(chan struct{})
+	go func() {
+		io.Copy(stdin, os.Stdin)
+		stdin.Close()
+		close(stdinDone)
+	}()
+	defer interruptStdinReader(stdinDone)
+
+	if err := session.Start(command); err != nil {
+		return fmt.Errorf("starting command: %w", err)
+	}
+	return session.Wait()
+}
+
+// requestExecPty requests a PTY sized like the local terminal and, when stdin
+// is a terminal, puts it in raw mode. The returned func restores it.
+func requestExecPty(session *ssh.Session) (func(), error) {
+	width, height, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil {
+		width, height = 80, 24
+	}
+	modes := ssh.TerminalModes{
+		ssh.ECHO:          1,
+		ssh.TTY_OP_ISPEED: 14400,
+		ssh.TTY_OP_OSPEED: 14400,
+	}
+	if err := session.RequestPty("xterm-256color", height, width, modes); err != nil {
+		return nil, fmt.Errorf("requesting PTY: %w", err)
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return func() {}, nil
+	}
+	oldState, err := term.MakeRaw(fd)
+	if err != nil {
+		return nil, fmt.Errorf("setting raw mode: %w", err)
+	}
+	return func() { term.Restore(fd, oldState) }, nil
+}
+
+// ExitStatus reports the status of a remote command or shell that exited
+// unsuccessfully: its exit code, or 128 plus the signal number (as shells
+// report it) along with the signal name if it was killed. ok is false for
+// nil and for errors that are not remote exits, such as connection failures.
+func ExitStatus(err error) (status int, signal string, ok bool) {
+	var exitErr *ssh.ExitError
+	if !errors.As(err, &exitErr) {
+		return 0, "", false
+	}
+	return exitErr.ExitStatus(), exitErr.Signal(), true
+}
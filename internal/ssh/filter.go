@@ -0,0 +1,282 @@
+package ssh
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"essh/internal/sftp"
+)
+
+// ignoreFiles are the per-directory pattern files read with
+// Filter.IgnoreFiles; rules in the later one win.
+var ignoreFiles = []string{".gitignore", ".esshignore"}
+
+// Filter selects what a recursive transfer copies with gitignore-style
+// patterns: "*", "?" and "[...]" match within a path element and "**"
+// across them; a pattern with a slash other than a trailing one matches
+// from the root of the tree, and one without matches names at any depth;
+// a trailing slash matches only directories. The last matching pattern
+// decides, and an excluded directory is skipped with everything in it.
+// A nil *Filter copies everything.
+type Filter struct {
+	rules []filterRule
+	// IgnoreFiles also applies the patterns of .gitignore and .esshignore
+	// files found in the source tree to their directory and below, and
+	// skips .git directories. Patterns given to the Filter still win.
+	IgnoreFiles bool
+}
+
+// Exclude skips entries matching pattern.
+func (f *Filter) Exclude(pattern string) error {
+	return f.add(pattern, false)
+}
+
+// Include copies entries matching pattern even when an earlier pattern
+// excludes them.
+func (f *Filter) Include(pattern string) error {
+	return f.add(pattern, true)
+}
+
+// ExcludeFrom adds the patterns in the file name, one per line in
+// .gitignore syntax.
+func (f *Filter) ExcludeFrom(name string) error {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	rules, err := parseRules(data, "")
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	f.rules = append(f.rules, rules...)
+	return nil
+}
+
+func (f *Filter) add(pattern string, negate bool) error {
+	r, ok, err := parseRule(pattern, "")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("empty pattern %q", pattern)
+	}
+	if negate {
+		r.negate = !r.negate
+	}
+	f.rules = append(f.rules, r)
+	return nil
+}
+
+// filterRule is one pattern. base is the directory of the ignore file it
+// came from, relative to the root of the tree.
+type filterRule struct {
+	segments []string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+	base     string
+}
+
+// parseRules parses the lines of an ignore file in the directory base.
+func parseRules(data []byte, base string) ([]filterRule, error) {
+	var rules []filterRule
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; sc.Scan(); n++ {
+		r, ok, err := parseRule(sc.Text(), base)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		if ok {
+			rules = append(rules, r)
+		}
+	}
+	return rules, sc.Err()
+}
+
+// parseRule parses a pattern line; ok is false for blank lines and
+// comments.
+func parseRule(line, base string) (r filterRule, ok bool, err error) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || line[0] == '#' {
+		return r, false, nil
+	}
+	switch {
+	case line[0] == '!':
+		r.negate = true
+		line = line[1:]
+	case strings.HasPrefix(line, `\!`), strings.HasPrefix(line, `\#`):
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		r.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if strings.Contains(line, "/") {
+		r.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+	if line == "" {
+		return r, false, nil
+	}
+	r.segments = strings.Split(line, "/")
+	for _, s := range r.segments {
+		if _, err := path.Match(s, ""); err != nil {
+			return r, false, fmt.Errorf("bad pattern %q", line)
+		}
+	}
+	r.base = base
+	return r, true, nil
+}
+
+// match reports whether the entry at rel, relative to the root of the
+// tree, matches r.
+func (r *filterRule) match(rel string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	if r.base != "" {
+		rel = strings.TrimPrefix(rel, r.base+"/")
+	}
+	if !r.anchored {
+		ok, _ := path.Match(r.segments[0], path.Base(rel))
+		return ok
+	}
+	return matchSegments(r.segments, strings.Split(rel, "/"))
+}
+
+// matchSegments matches a path element by element, "**" standing for any
+// number of elements.
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			pattern = pattern[1:]
+			if len(pattern) == 0 {
+				// "dir/**" matches everything inside dir.
+				return len(name) > 0
+			}
+			for i := range name {
+				if matchSegments(pattern, name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// readFunc reads the file name in a directory of the source tree.
+type readFunc func(name string) ([]byte, error)
+
+// localReader reads files in the local directory dir.
+func localReader(dir string) readFunc {
+	return func(name string) ([]byte, error) {
+		return os.ReadFile(filepath.Join(dir, name))
+	}
+}
+
+// remoteReader reads files in the remote directory dir over SFTP.
+func remoteReader(sc *sftp.Client, dir string) readFunc {
+	return func(name string) ([]byte, error) {
+		f, err := sc.Open(path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		var b bytes.Buffer
+		_, err = b.ReadFrom(f)
+		return b.Bytes(), err
+	}
+}
+
+// dirFilter is a Filter in one directory of a tree, with the rules of the
+// ignore files above it. A nil *dirFilter excludes nothing.
+type dirFilter struct {
+	f     *Filter
+	rel   string
+	rules []filterRule
+	// subs caches entered subdirectories, so that walking the tree again,
+	// as the size count before a transfer and the transfer itself do,
+	// reads each ignore file once.
+	subs map[string]*dirFilter
+}
+
+// root returns the filter for the root directory of a tree, whose files
+// read reads.
+func (f *Filter) root(read readFunc) *dirFilter {
+	if f == nil {
+		return nil
+	}
+	d := &dirFilter{f: f}
+	d.load(read)
+	return d
+}
+
+// enter returns the filter for the subdirectory name, whose files read
+// reads the first time it is entered.
+func (d *dirFilter) enter(name string, read readFunc) *dirFilter {
+	if d == nil {
+		return nil
+	}
+	if sub, ok := d.subs[name]; ok {
+		return sub
+	}
+	sub := &dirFilter{f: d.f, rel: path.Join(d.rel, name), rules: d.rules[:len(d.rules):len(d.rules)]}
+	sub.load(read)
+	if d.subs == nil {
+		d.subs = map[string]*dirFilter{}
+	}
+	d.subs[name] = sub
+	return sub
+}
+
+// load adds the rules of the directory's ignore files. Unreadable files
+// and bad patterns in them are skipped, as git does.
+func (d *dirFilter) load(read readFunc) {
+	if !d.f.IgnoreFiles {
+		return
+	}
+	for _, name := range ignoreFiles {
+		data, err := read(name)
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if r, ok, err := parseRule(line, d.rel); ok && err == nil {
+				d.rules = append(d.rules, r)
+			}
+		}
+	}
+}
+
+// excluded reports whether the entry name in the directory is skipped.
+func (d *dirFilter) excluded(name string, isDir bool) bool {
+	if d == nil {
+		return false
+	}
+	rel := path.Join(d.rel, name)
+	excluded := d.f.IgnoreFiles && isDir && name == ".git"
+	for i := range d.rules {
+		if d.rules[i].match(rel, isDir) {
+			excluded = !d.rules[i].negate
+		}
+	}
+	for i := range d.f.rules {
+		if d.f.rules[i].match(rel, isDir) {
+			excluded = !d.f.rules[i].negate
+		}
+	}
+	return excluded
+}
@@ -0,0 +1,213 @@
+package ssh
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// HostResult is the outcome of running a command on one server.
+type HostResult struct {
+	Name string
+	// Status is the remote exit status, or 255 when Err is set.
+	Status int
+	// Signal names the signal that killed the command, if any.
+	Signal string
+	// Err is set when the command could not run to completion: the
+	// connection failed, dropped or timed out.
+	Err      error
+	Duration time.Duration
+}
+
+// OK reports whether the command ran and exited 0.
+func (r HostResult) OK() bool {
+	return r.Err == nil && r.Status == 0
+}
+
+// FleetOptions control RunFleet.
+type FleetOptions struct {
+	// Workers caps how many servers run at once; 0 means all of them.
+	Workers int
+	// Timeout bounds each server, from dialing to the command's exit.
+	Timeout time.Duration
+	// Output returns the writers for target i's stdout and stderr. When nil,
+	// output is discarded.
+	Output func(i int) (stdout, stderr io.Writer)
+	// Done, if set, is called as each server finishes. Calls are serialized.
+	Done func(i int, r HostResult)
+}
+
+// RunFleet runs command on every target concurrently, without a PTY or
+// stdin, and returns the results in target order.
+func RunFleet(targets []*Target, command string, opts FleetOptions) []HostResult {
+	workers := opts.Workers
+	if workers <= 0 || workers > len(targets) {
+		workers = len(targets)
+	}
+
+	results := make([]HostResult, len(targets))
+	jobs := make(chan int)
+	var doneMu sync.Mutex
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				stdout, stderr := io.Discard, io.Discard
+				if opts.Output != nil {
+					stdout, stderr = opts.Output(i)
+				}
+				results[i] = runHost(targets[i], command, stdout, stderr, opts.Timeout)
+				if opts.Done != nil {
+					doneMu.Lock()
+					opts.Done(i, results[i])
+					doneMu.Unlock()
+				}
+			}
+		}()
+	}
+	for i := range targets {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return results
+}
+
+// runHost runs command on t and classifies the outcome.
+func runHost(t *Target, command string, stdout, stderr io.Writer, timeout time.Duration) HostResult {
+	start := time.Now()
+	err := runCommand(t, command, stdout, stderr, timeout)
+	r := HostResult{Name: t.Name, Duration: time.Since(start)}
+	if status, signal, ok := ExitStatus(err); ok {
+		r.Status, r.Signal = status, signal
+	} else if err != nil {
+		r.Status, r.Err = 255, err
+	}
+	return r
+}
+
+// runCommand dials t and runs command. With a timeout, the connection is
+// closed once it expires, whether still dialing or running.
+func runCommand(t *Target, command string, stdout, stderr io.Writer, timeout time.Duration) error {
+	type dialResult struct {
+		client *ssh.Client
+		err    error
+	}
+	dialed := make(chan dialResult, 1)
+	go func() {
+		client, err := Dial(t)
+		dialed <- dialResult{client, err}
+	}()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	var client *ssh.Client
+	select {
+	case d := <-dialed:
+		if d.err != nil {
+			return d.err
+		}
+		client = d.client
+	case <-expired:
+		// Close the client if the dial completes after all.
+		go func() {
+			if d := <-dialed; d.client != nil {
+				d.client.Close()
+			}
+		}()
+		return fmt.Errorf("timed out after %s while connecting", timeout)
+	}
+	defer client.Close()
+
+	var timedOut atomic.Bool
+	if expired != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-expired:
+				timedOut.Store(true)
+				client.Close()
+			case <-stop:
+			}
+		}()
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		return fmt.Errorf("creating session: %w", err)
+	}
+	defer session.Close()
+
+	session.Stdout = stdout
+	session.Stderr = stderr
+	err = session.Run(command)
+	if timedOut.Load() {
+		return fmt.Errorf("timed out after %s", timeout)
+	}
+	var missing *ssh.ExitMissingError
+	if errors.As(err, &missing) {
+		return errors.New("connection closed before the command exited")
+	}
+	return err
+}
+
+// LineWriter prefixes every line written to it and writes whole lines to
+// an underlying writer shared with other LineWriters, so output from
+// concurrent servers never interleaves mid-line.
+type LineWriter struct {
+	mu     *sync.Mutex
+	out    io.Writer
+	prefix string
+	buf    []byte
+}
+
+// NewLineWriter returns a LineWriter writing to out. Writers that share out
+// must share mu.
+func NewLineWriter(out io.Writer, mu *sync.Mutex, prefix string) *LineWriter {
+	return &LineWriter{mu: mu, out: out, prefix: prefix}
+}
+
+func (w *LineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		if err := w.writeLine(w.buf[:i+1]); err != nil {
+			return len(p), err
+		}
+		w.buf = w.buf[i+1:]
+	}
+}
+
+// Flush writes any unterminated last line, adding the newline.
+func (w *LineWriter) Flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	line := append(w.buf, '\n')
+	w.buf = nil
+	return w.writeLine(line)
+}
+
+func (w *LineWriter) writeLine(line []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err := fmt.Fprintf(w.out, "%s%s", w.prefix, line)
+	return err
+}
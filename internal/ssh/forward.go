@@ -0,0 +1,419 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Forward describes a port forward. A local forward (-L) listens on
+// BindAddr:BindPort locally and dials Host:Port from the server; a remote
+// forward (-R) listens on the server and dials Host:Port locally; a dynamic
+// forward runs a local SOCKS proxy and has no fixed destination.
+type Forward struct {
+	Remote   bool
+	Dynamic  bool
+	BindAddr string
+	BindPort int
+	Host     string
+	Port     int
+}
+
+// ParseForward parses "[bind:]port:host:hostport". IPv6 addresses may be
+// given in brackets. The bind address defaults to 127.0.0.1, on the server
+// for remote forwards; a remote port of 0 lets the server pick one.
+func ParseForward(spec string, remote bool) (Forward, error) {
+	parts, err := splitForwardSpec(spec)
+	if err != nil {
+		return Forward{}, err
+	}
+	f := Forward{Remote: remote, BindAddr: "127.0.0.1"}
+	switch len(parts) {
+	case 3:
+	case 4:
+		f.BindAddr = parts[0]
+		parts = parts[1:]
+	default:
+		return Forward{}, fmt.Errorf("invalid forward %q — expected [bind:]port:host:hostport", spec)
+	}
+	if f.BindPort, err = parsePort(parts[0], true); err != nil {
+		return Forward{}, fmt.Errorf("invalid forward %q: %w", spec, err)
+	}
+	f.Host = parts[1]
+	if f.Port, err = parsePort(parts[2], false); err != nil {
+		return Forward{}, fmt.Errorf("invalid forward %q: %w", spec, err)
+	}
+	if f.Host == "" {
+		return Forward{}, fmt.Errorf("invalid forward %q: empty host", spec)
+	}
+	return f, nil
+}
+
+// splitForwardSpec splits on colons, keeping bracketed IPv6 addresses whole.
+func splitForwardSpec(spec string) ([]string, error) {
+	var parts []string
+	for spec != "" {
+		if strings.HasPrefix(spec, "[") {
+			end := strings.Index(spec, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("invalid forward %q: unclosed [", spec)
+			}
+			parts = append(parts, spec[1:end])
+			spec = strings.TrimPrefix(spec[end+1:], ":")
+			continue
+		}
+		part, rest, found := strings.Cut(spec, ":")
+		parts = append(parts, part)
+		spec = rest
+		if found && rest == "" {
+			parts = append(parts, "")
+		}
+	}
+	return parts, nil
+}
+
+func parsePort(s string, allowZero bool) (int, error) {
+	p, err := strconv.Atoi(s)
+	if err != nil || p < 0 || p > 65535 || (p == 0 && !allowZero) {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return p, nil
+}
+
+// BindAddress returns the listen address: local for -L, remote for -R.
+func (f Forward) BindAddress() string {
+	return net.JoinHostPort(f.BindAddr, strconv.Itoa(f.BindPort))
+}
+
+// Destination returns the address connections are tunnelled to.
+func (f Forward) Destination() string {
+	return net.JoinHostPort(f.Host, strconv.Itoa(f.Port))
+}
+
+func (f Forward) String() string {
+	if f.Dynamic {
+		return "SOCKS proxy " + f.BindAddress()
+	}
+	if f.Remote {
+		return "remote " + f.BindAddress() + " -> " + f.Destination()
+	}
+	return f.BindAddress() + " -> " + f.Destination()
+}
+
+// forwarder hands the current client to listeners. The client is swapped out
+// on every reconnect; connections arriving in between wait for the next one.
+type forwarder struct {
+	mu     sync.Mutex
+	client *ssh.Client
+	ready  chan struct{}
+}
+
+func newForwarder() *forwarder {
+	return &forwarder{ready: make(chan struct{})}
+}
+
+func (fw *forwarder) set(client *ssh.Client) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	fw.client = client
+	if client != nil {
+		close(fw.ready)
+	} else {
+		fw.ready = make(chan struct{})
+	}
+}
+
+// get returns the current client, waiting up to timeout for a reconnect.
+func (fw *forwarder) get(timeout time.Duration) *ssh.Client {
+	fw.mu.Lock()
+	client, ready := fw.client, fw.ready
+	fw.mu.Unlock()
+	if client != nil {
+		return client
+	}
+	select {
+	case <-ready:
+		fw.mu.Lock()
+		defer fw.mu.Unlock()
+		return fw.client
+	case <-time.After(timeout):
+		return nil
+	}
+}
+
+// serveLocal accepts connections on ln and tunnels each to f's destination.
+func (fw *forwarder) serveLocal(ln net.Listener, f Forward) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			remote, err := fw.dial(f.Destination())
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\r\n", f, err)
+				return
+			}
+			defer remote.Close()
+			pipe(conn, remote)
+		}()
+	}
+}
+
+// serveRemote accepts connections forwarded by the server on ln and dials
+// f's destination locally for each.
+func serveRemote(ln net.Listener, f Forward) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			local, err := net.DialTimeout("tcp", f.Destination(), dialTimeout)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\r\n", f, err)
+				return
+			}
+			defer local.Close()
+			pipe(conn, local)
+		}()
+	}
+}
+
+// pipe copies in both directions until either side is done.
+func pipe(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(a, b)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(b, a)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// forwardSet runs a set of forwards across reconnects. Local listeners are
+// opened once and outlive individual connections; remote listeners belong to
+// a connection and are registered again by attach after every reconnect.
+// Messages use "\r\n" since they may be printed while the terminal is raw.
+type forwardSet struct {
+	fw        *forwarder
+	forwards  []Forward
+	listeners []net.Listener
+	remote    []net.Listener
+	// allocated remembers server-chosen ports for "-R 0:..." forwards so a
+	// reconnect asks for the same port again.
+	allocated map[int]int
+}
+
+// openForwards starts listening for the local and dynamic forwards.
+func openForwards(forwards []Forward) (*forwardSet, error) {
+	s := &forwardSet{fw: newForwarder(), forwards: forwards, allocated: map[int]int{}}
+	for _, f := range forwards {
+		if f.Remote {
+			continue
+		}
+		ln, err := net.Listen("tcp", f.BindAddress())
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("listening on %s: %w", f.BindAddress(), err)
+		}
+		s.listeners = append(s.listeners, ln)
+		if f.Dynamic {
+			fmt.Fprintf(os.Stderr, "Listening as %s\r\n", f)
+			go s.fw.serveSocks(ln, f)
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "Forwarding %s\r\n", f)
+		go s.fw.serveLocal(ln, f)
+	}
+	return s, nil
+}
+
+// attach routes local forwards through client and registers the remote
+// forwards on it. Failed remote forwards are reported in the returned error;
+// the others stay active.
+func (s *forwardSet) attach(client *ssh.Client) error {
+	s.fw.set(client)
+
+	var errs []error
+	for i, f := range s.forwards {
+		if !f.Remote {
+			continue
+		}
+		ln, err := s.listenRemote(client, i, f)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("remote forward %s: %w", f.BindAddress(), err))
+			continue
+		}
+		s.remote = append(s.remote, ln)
+
+		actual := f
+		if addr, ok := ln.Addr().(*net.TCPAddr); ok {
+			actual.BindPort = addr.Port
+		}
+		if f.BindPort == 0 {
+			s.allocated[i] = actual.BindPort
+			fmt.Fprintf(os.Stderr, "Allocated port %d for remote forward to %s\r\n", actual.BindPort, f.Destination())
+		}
+		fmt.Fprintf(os.Stderr, "Forwarding %s\r\n", actual)
+		go serveRemote(ln, actual)
+	}
+	return errors.Join(errs...)
+}
+
+// listenRemote asks the server to listen for forward i, preferring the port
+// allocated on a previous connection.
+func (s *forwardSet) listenRemote(client *ssh.Client, i int, f Forward) (net.Listener, error) {
+	if port, ok := s.allocated[i]; ok {
+		prev := f
+		prev.BindPort = port
+		if ln, err := client.Listen("tcp", prev.BindAddress()); err == nil {
+			return ln, nil
+		}
+	}
+	return client.Listen("tcp", f.BindAddress())
+}
+
+// detach stops the remote forwards of the current connection and makes new
+// local connections wait for the next attach.
+func (s *forwardSet) detach() {
+	s.fw.set(nil)
+	for _, ln := range s.remote {
+		ln.Close()
+	}
+	s.remote = nil
+}
+
+// Close stops every forward.
+func (s *forwardSet) Close() {
+	s.detach()
+	for _, ln := range s.listeners {
+		ln.Close()
+	}
+}
+
+// RunForwards dials t and serves forwards until interrupted. Local listeners
+// stay open across connection drops; the connection itself is re-established
+// with the same backoff used for interactive sessions, and remote forwards
+// are registered again on each new connection. The first connection must
+// succeed, and authentication or host key failures are never retried.
+func RunForwards(t *Target, forwards []Forward) error {
+	fwd, err := openForwards(forwards)
+	if err != nil {
+		return err
+	}
+	defer fwd.Close()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(stop)
+
+	backoff := time.Second
+	first := true
+	for {
+		client, err := Dial(t)
+		if err != nil {
+			// A server that was never reached or rejects our credentials
+			// won't fix itself; only a lost network is worth waiting out.
+			if first || !isTransientDialError(err) {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "Connection failed: %v\nRetrying in %s...\n", err, backoff)
+			select {
+			case <-stop:
+				return nil
+			case <-time.After(backoff):
+			}
+			backoff = nextBackoff(backoff)
+			continue
+		}
+
+		fmt.Fprintf(os.Stderr, "Connected to %s@%s:%d\n", t.User, t.Host, t.Port)
+		if err := fwd.attach(client); err != nil {
+			// Nothing else to do if the requested forwards can't be set up
+			// at all; after a reconnect, keep whatever still works.
+			if first {
+				client.Close()
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		}
+		first = false
+		start := time.Now()
+
+		lost := make(chan struct{})
+		go func() {
+			client.Wait()
+			close(lost)
+		}()
+		go keepAlive(client, lost)
+
+		select {
+		case <-stop:
+			client.Close()
+			return nil
+		case <-lost:
+		}
+		fwd.detach()
+		client.Close()
+
+		if time.Since(start) >= sessionStableThreshold {
+			backoff = time.Second
+		}
+		fmt.Fprintf(os.Stderr, "Connection lost, reconnecting in %s...\n", backoff)
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(backoff):
+		}
+		backoff = nextBackoff(backoff)
+	}
+}
+
+const keepAliveInterval = 15 * time.Second
+
+// keepAlive pings the server periodically and closes the client if a ping
+// fails or goes unanswered, so silent network drops are noticed.
+func keepAlive(client *ssh.Client, done <-chan struct{}) {
+	ticker := time.NewTicker(keepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		reply := make(chan error, 1)
+		go func() {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			reply <- err
+		}()
+		select {
+		case err := <-reply:
+			if err != nil {
+				client.Close()
+				return
+			}
+		case <-time.After(keepAliveInterval):
+			client.Close()
+			return
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+
+	"essh/internal/sftp"
+)
+
+// HasGlob reports whether p contains wildcard characters.
+func HasGlob(p string) bool {
+	return strings.ContainsAny(p, "*?[")
+}
+
+// ExpandRemote returns the remote paths matching pattern, which may use
+// *, ? and [...] in any path element like a shell glob. The matching is
+// done by listing directories over SFTP, or by a shell on servers without
+// SFTP with everything but the wildcards quoted, so a pattern cannot run
+// commands. A pattern without wildcards is returned as is.
+func ExpandRemote(client *ssh.Client, pattern string, opts TransferOptions) ([]string, error) {
+	if !HasGlob(pattern) {
+		return []string{pattern}, nil
+	}
+	sc, err := opts.sftpClient(client)
+	if err != nil {
+		return nil, err
+	}
+	var matches []string
+	if sc != nil {
+		defer sc.Close()
+		// SFTP takes "~" literally; the shell below expands it itself.
+		var expanded string
+		if expanded, err = sftpPath(sc, pattern); err == nil {
+			matches, err = sftpGlob(sc, expanded)
+		}
+	} else {
+		matches, err = shellGlob(client, pattern)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("%s: no matches", pattern)
+	}
+	return matches, nil
+}
+
+// sftpGlob expands pattern like filepath.Glob, listing directories over
+// SFTP. Hidden files only match patterns that start with a dot.
+func sftpGlob(sc *sftp.Client, pattern string) ([]string, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("%s: %w", pattern, err)
+	}
+	dir, file := path.Split(pattern)
+	if dir != "/" {
+		dir = strings.TrimSuffix(dir, "/")
+	}
+	if !HasGlob(dir) {
+		return globDir(sc, dir, file, nil)
+	}
+	dirs, err := sftpGlob(sc, dir)
+	if err != nil {
+		return nil, err
+	}
+	var matches []string
+	for _, d := range dirs {
+		if matches, err = globDir(sc, d, file, matches); err != nil {
+			return nil, err
+		}
+	}
+	return matches, nil
+}
+
+// globDir appends the entries of dir matching file to matches.
+func globDir(sc *sftp.Client, dir, file string, matches []string) ([]string, error) {
+	if !HasGlob(file) {
+		p := path.Join(dir, file)
+		if _, err := sc.Lstat(p); err == nil {
+			matches = append(matches, p)
+		}
+		return matches, nil
+	}
+	entries, err := sc.ReadDir(remoteDir(dir))
+	if err != nil {
+		// Like a shell, a directory that cannot be read matches nothing.
+		return matches, nil
+	}
+	var names []string
+	for _, fi := range entries {
+		name := fi.Name()
+		if strings.HasPrefix(name, ".") && !strings.HasPrefix(file, ".") {
+			continue
+		}
+		if ok, _ := path.Match(file, name); ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		matches = append(matches, path.Join(dir, name))
+	}
+	return matches, nil
+}
+
+// shellGlob expands pattern with the server's shell.
+func shellGlob(client *ssh.Client, pattern string) ([]string, error) {
+	out, err := runOutput(client, fmt.Sprintf(`for f in %s; do [ -e "$f" ] || [ -h "$f" ] || continue; printf '%%s\0' "$f"; done`, globQuote(pattern)))
+	if err != nil {
+		return nil, fmt.Errorf("expanding %s on the server: %w", pattern, err)
+	}
+	var matches []string
+	for _, m := range strings.Split(out, "\x00") {
+		if m != "" {
+			matches = append(matches, m)
+		}
+	}
+	return matches, nil
+}
+
+// globQuote quotes pattern for a POSIX shell like remoteArg, but leaves
+// *, ? and bracket expressions of plain characters to be expanded.
+func globQuote(pattern string) string {
+	var b strings.Builder
+	if strings.HasPrefix(pattern, "~/") {
+		b.WriteString("~/")
+		pattern = pattern[2:]
+	}
+	var lit strings.Builder
+	flush := func() {
+		if lit.Len() > 0 {
+			b.WriteString(shellQuote(lit.String()))
+			lit.Reset()
+		}
+	}
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*', '?':
+			flush()
+			b.WriteByte(c)
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end > 0 && safeBracket(pattern[i+1:i+1+end]) {
+				flush()
+				b.WriteString(pattern[i : i+2+end])
+				i += 1 + end
+				continue
+			}
+			lit.WriteByte(c)
+		default:
+			lit.WriteByte(c)
+		}
+	}
+	flush()
+	return b.String()
+}
+
+// safeBracket reports whether the inside of a bracket expression holds
+// only characters that mean nothing else to the shell.
+func safeBracket(s string) bool {
+	for _, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune("-_.!^,+:@%", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// IsRemoteDir reports whether p is a directory on the server.
+func IsRemoteDir(client *ssh.Client, p string, opts TransferOptions) (bool, error) {
+	sc, err := opts.sftpClient(client)
+	if err != nil {
+		return false, err
+	}
+	if sc == nil {
+		isDir, _, err := remoteStat(client, p)
+		return isDir, err
+	}
+	defer sc.Close()
+	if p, err = sftpPath(sc, p); err != nil {
+		return false, err
+	}
+	fi, err := sc.Stat(p)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	return fi.IsDir(), nil
+}
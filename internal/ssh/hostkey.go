@@ -0,0 +1,295 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/term"
+
+	"essh/internal/prompt"
+)
+
+// KnownHosts verifies server host keys against essh's own known_hosts file,
+// optionally consulting extra read-only files such as ~/.ssh/known_hosts.
+// Keys accepted on first use are appended to Path.
+type KnownHosts struct {
+	Path  string
+	Extra []string
+}
+
+// HostKeyError is returned when a server presents a key that differs from
+// the one on record. Reconnect loops treat it as fatal instead of retrying.
+type HostKeyError struct {
+	Addr string
+	Got  string
+	Want []string
+	Hint string
+}
+
+func (e *HostKeyError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "host key for %s has changed — someone may be intercepting the connection\n", e.Addr)
+	for _, w := range e.Want {
+		fmt.Fprintf(&b, "  - expected: %s\n", w)
+	}
+	fmt.Fprintf(&b, "  + received: %s\n", e.Got)
+	b.WriteString(e.Hint)
+	return b.String()
+}
+
+// errUntrustedHostKey is returned when the user declines (or cannot be asked)
+// to trust a host key seen for the first time.
+var errUntrustedHostKey = errors.New("host key not trusted")
+
+// isHostKeyError reports whether err is a host key verification failure.
+// Retrying such a connection cannot succeed, so reconnect loops give up.
+func isHostKeyError(err error) bool {
+	var hkErr *HostKeyError
+	return errors.As(err, &hkErr) || errors.Is(err, errUntrustedHostKey)
+}
+
+// hostKeyMu serializes trust prompts and known_hosts writes.
+var hostKeyMu sync.Mutex
+
+// describeKey formats a key as "<type> SHA256:<fingerprint>".
+func describeKey(key ssh.PublicKey) string {
+	return key.Type() + " " + ssh.FingerprintSHA256(key)
+}
+
+// load builds a knownhosts callback from Path and every existing Extra file.
+// Path is created if missing so that accepted keys have somewhere to go.
+func (k *KnownHosts) load() (ssh.HostKeyCallback, error) {
+	var files []string
+	if k.Path != "" {
+		if err := os.MkdirAll(filepath.Dir(k.Path), 0700); err != nil {
+			return nil, fmt.Errorf("creating known_hosts dir: %w", err)
+		}
+		f, err := os.OpenFile(k.Path, os.O_CREATE|os.O_RDONLY, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("opening known_hosts: %w", err)
+		}
+		f.Close()
+		files = append(files, k.Path)
+	}
+	for _, p := range k.Extra {
+		if _, err := os.Stat(p); err == nil {
+			files = append(files, p)
+		}
+	}
+	if len(files) == 0 {
+		return func(string, net.Addr, ssh.PublicKey) error { return &knownhosts.KeyError{} }, nil
+	}
+	cb, err := knownhosts.New(files...)
+	if err != nil {
+		return nil, fmt.Errorf("reading known_hosts: %w", err)
+	}
+	return cb, nil
+}
+
+// add appends key for addr to Path.
+func (k *KnownHosts) add(addr string, key ssh.PublicKey) error {
+	if k.Path == "" {
+		return nil
+	}
+	f, err := os.OpenFile(k.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("opening known_hosts: %w", err)
+	}
+	defer f.Close()
+	line := knownhosts.Line([]string{knownhosts.Normalize(addr)}, key)
+	if _, err := fmt.Fprintln(f, line); err != nil {
+		return fmt.Errorf("writing known_hosts: %w", err)
+	}
+	return nil
+}
+
+// Remove deletes every line for addr from Path and reports how many were
+// removed. Hashed entries cannot be matched and are left alone.
+func (k *KnownHosts) Remove(addr string) (int, error) {
+	if k.Path == "" {
+		return 0, nil
+	}
+	data, err := os.ReadFile(k.Path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("reading known_hosts: %w", err)
+	}
+
+	host := knownhosts.Normalize(addr)
+	var kept []string
+	removed := 0
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		if knownHostsLineMatches(line, host) {
+			removed++
+			continue
+		}
+		kept = append(kept, line)
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+
+	out := strings.Join(kept, "\n")
+	if len(kept) > 0 {
+		out += "\n"
+	}
+	if err := os.WriteFile(k.Path, []byte(out), 0600); err != nil {
+		return 0, fmt.Errorf("writing known_hosts: %w", err)
+	}
+	return removed, nil
+}
+
+// knownHostsLineMatches reports whether a known_hosts line lists host
+// (already normalized) among its comma-separated host patterns.
+func knownHostsLineMatches(line, host string) bool {
+	fields := strings.Fields(line)
+	if len(fields) > 0 && strings.HasPrefix(fields[0], "@") {
+		fields = fields[1:]
+	}
+	if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+		return false
+	}
+	for _, pattern := range strings.Split(fields[0], ",") {
+		if pattern == host {
+			return true
+		}
+	}
+	return false
+}
+
+// knownAlgorithms returns the host key algorithms already on record for addr,
+// so the handshake negotiates a key type we can actually verify instead of
+// reporting a different (but legitimate) key as changed.
+func knownAlgorithms(cb ssh.HostKeyCallback, addr string) []string {
+	probe, err := ssh.NewPublicKey(ed25519.PublicKey(make([]byte, ed25519.PublicKeySize)))
+	if err != nil {
+		return nil
+	}
+	var keyErr *knownhosts.KeyError
+	if err := cb(addr, &net.TCPAddr{}, probe); !errors.As(err, &keyErr) {
+		return nil
+	}
+	var algos []string
+	for _, w := range keyErr.Want {
+		algos = append(algos, keyAlgorithms(w.Key.Type())...)
+	}
+	return algos
+}
+
+// keyAlgorithms maps a key type to the signature algorithms that use it.
+func keyAlgorithms(keyType string) []string {
+	if keyType == ssh.KeyAlgoRSA {
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	}
+	return []string{keyType}
+}
+
+// hostKeyConfig returns the callback and preferred algorithms for dialing t.
+// Once a key has been accepted it is pinned on t, and later dials with the
+// same Target (e.g. auto-reconnects) only accept that exact key.
+func (t *Target) hostKeyConfig(addr string) (ssh.HostKeyCallback, []string, error) {
+	if t.HostKey != nil {
+		pinned := t.HostKey
+		cb := func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if bytes.Equal(key.Marshal(), pinned.Marshal()) {
+				return nil
+			}
+			return &HostKeyError{
+				Addr: addr,
+				Got:  describeKey(key),
+				Want: []string{describeKey(pinned) + " (accepted earlier in this session)"},
+				Hint: "Refusing to reconnect.",
+			}
+		}
+		return cb, keyAlgorithms(pinned.Type()), nil
+	}
+
+	if t.HostKeyFingerprint != "" {
+		cb := func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if key.Type() == t.HostKeyAlgorithm && ssh.FingerprintSHA256(key) == t.HostKeyFingerprint {
+				t.HostKey = key
+				return nil
+			}
+			return &HostKeyError{
+				Addr: addr,
+				Got:  describeKey(key),
+				Want: []string{t.HostKeyAlgorithm + " " + t.HostKeyFingerprint + " (pinned in essh storage)"},
+				Hint: fmt.Sprintf("If the server was legitimately rebuilt, run 'essh hostkey reset %s' and reconnect.", t.Name),
+			}
+		}
+		return cb, keyAlgorithms(t.HostKeyAlgorithm), nil
+	}
+
+	db := func(string, net.Addr, ssh.PublicKey) error { return &knownhosts.KeyError{} }
+	if t.KnownHosts != nil {
+		var err error
+		if db, err = t.KnownHosts.load(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	cb := func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := db(hostname, remote, key)
+		if err == nil {
+			t.HostKey = key
+			return nil
+		}
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) {
+			return err
+		}
+		if len(keyErr.Want) > 0 {
+			hkErr := &HostKeyError{Addr: addr, Got: describeKey(key)}
+			for _, w := range keyErr.Want {
+				hkErr.Want = append(hkErr.Want, fmt.Sprintf("%s (%s:%d)", describeKey(w.Key), w.Filename, w.Line))
+			}
+			hkErr.Hint = "If the server was legitimately rebuilt, delete the old line(s) listed above and reconnect."
+			return hkErr
+		}
+		if err := t.confirmHostKey(addr, key); err != nil {
+			return err
+		}
+		t.HostKey = key
+		return nil
+	}
+	return cb, knownAlgorithms(db, addr), nil
+}
+
+// confirmHostKey asks the user whether to trust a key seen for the first time
+// and records it in known_hosts when they agree.
+func (t *Target) confirmHostKey(addr string, key ssh.PublicKey) error {
+	hostKeyMu.Lock()
+	defer hostKeyMu.Unlock()
+
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return fmt.Errorf("%w: %s is not in known_hosts (%s) — connect interactively once to trust it", errUntrustedHostKey, addr, describeKey(key))
+	}
+
+	fmt.Printf("The authenticity of host %s can't be established.\n", addr)
+	fmt.Printf("%s key fingerprint is %s.\n", key.Type(), ssh.FingerprintSHA256(key))
+	ok, err := prompt.Confirm("Trust this host and continue connecting? [y/N] ")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%w: %s", errUntrustedHostKey, addr)
+	}
+	if t.KnownHosts != nil {
+		if err := t.KnownHosts.add(addr, key); err != nil {
+			return err
+		}
+		fmt.Printf("Added %s to %s\n", addr, t.KnownHosts.Path)
+	}
+	return nil
+}
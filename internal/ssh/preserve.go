@@ -0,0 +1,93 @@
+package ssh
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"essh/internal/sftp"
+)
+
+// fileTimes are the times kept by -p, as carried by an SCP T record.
+type fileTimes struct {
+	mtime, atime time.Time
+}
+
+// localTimes returns the times of the local file path.
+func localTimes(path string, fi fs.FileInfo) fileTimes {
+	return fileTimes{fi.ModTime(), accessTime(path, fi)}
+}
+
+// remoteTimes returns the times of a file listed over SFTP.
+func remoteTimes(fi fs.FileInfo) fileTimes {
+	t := fileTimes{fi.ModTime(), fi.ModTime()}
+	if a, ok := fi.Sys().(*sftp.Attrs); ok && a.Atime != 0 {
+		t.atime = time.Unix(int64(a.Atime), 0)
+	}
+	return t
+}
+
+// record returns the SCP T record for t: "T<mtime> 0 <atime> 0".
+func (t fileTimes) record() string {
+	return fmt.Sprintf("T%d 0 %d 0\n", t.mtime.Unix(), t.atime.Unix())
+}
+
+// parseTimes parses an SCP T record.
+func parseTimes(line string) (fileTimes, error) {
+	parts := strings.Fields(strings.TrimPrefix(line, "T"))
+	if len(parts) != 4 {
+		return fileTimes{}, fmt.Errorf("invalid scp times: %q", line)
+	}
+	mtime, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return fileTimes{}, fmt.Errorf("invalid mtime in %q: %w", line, err)
+	}
+	atime, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return fileTimes{}, fmt.Errorf("invalid atime in %q: %w", line, err)
+	}
+	return fileTimes{time.Unix(mtime, 0), time.Unix(atime, 0)}, nil
+}
+
+// setLocal gives the local file path the permissions perm and times t.
+func setLocal(path string, perm fs.FileMode, t fileTimes) error {
+	if err := os.Chmod(path, perm); err != nil {
+		return err
+	}
+	return os.Chtimes(path, t.atime, t.mtime)
+}
+
+// setRemote gives the remote file p the permissions perm and times t.
+func setRemote(sc *sftp.Client, p string, perm fs.FileMode, t fileTimes) error {
+	if err := sc.Chmod(p, perm); err != nil {
+		return err
+	}
+	return sc.Chtimes(p, t.atime, t.mtime)
+}
+
+// replaceLink creates the symlink link pointing at target on the server,
+// replacing a file already there.
+func replaceLink(sc *sftp.Client, target, link string) error {
+	if fi, err := sc.Lstat(link); err == nil && !fi.IsDir() {
+		sc.Remove(link)
+	}
+	if err := sc.Symlink(target, link); err != nil {
+		return fmt.Errorf("creating symlink %s: %w", link, err)
+	}
+	return nil
+}
+
+// replaceLocalLink creates the local symlink link pointing at target,
+// replacing a file already there.
+func replaceLocalLink(target, link string) error {
+	if fi, err := os.Lstat(link); err == nil && !fi.IsDir() {
+		os.Remove(link)
+	}
+	if err := os.Symlink(target, link); err != nil {
+		return fmt.Errorf("creating symlink %s: %w", link, err)
+	}
+	return nil
+}
@@ -0,0 +1,366 @@
+package ssh
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+
+	"essh/internal/sftp"
+)
+
+const (
+	// progressRedraw is how often the status line is redrawn on a terminal.
+	progressRedraw = 100 * time.Millisecond
+	// progressLogInterval is how often a progress line is logged when
+	// stdout is not a terminal.
+	progressLogInterval = 10 * time.Second
+	// rateWindow is how far back the transfer rate is averaged, so it
+	// follows changes in throughput without jumping on every chunk.
+	rateWindow = 5 * time.Second
+)
+
+// progress prints the messages of a transfer and reports how far it has
+// got: as a status line redrawn in place on a terminal, or as a log line
+// every progressLogInterval otherwise.
+type progress struct {
+	out   io.Writer
+	tty   bool
+	quiet bool
+
+	// line is the text printed since the last newline; the status line is
+	// drawn after it.
+	line  string
+	drawn bool
+	last  time.Time
+
+	// The file being transferred. done includes bytes skipped by resuming.
+	label string
+	size  int64
+	done  int64
+
+	// Totals across a recursive transfer; totalFiles and totalBytes are -1
+	// when the size of the tree is not known in advance.
+	tree       bool
+	files      int
+	totalFiles int
+	totalBytes int64
+	totalDone  int64
+
+	// moved counts the bytes actually sent, for the rate.
+	start   time.Time
+	moved   int64
+	samples []rateSample
+}
+
+type rateSample struct {
+	t time.Time
+	n int64
+}
+
+func newProgress(opts TransferOptions) *progress {
+	now := time.Now()
+	return &progress{
+		out:        os.Stdout,
+		tty:        term.IsTerminal(int(os.Stdout.Fd())),
+		quiet:      opts.Quiet,
+		totalFiles: -1,
+		totalBytes: -1,
+		last:       now,
+		start:      now,
+		samples:    []rateSample{{now, 0}},
+	}
+}
+
+// printf prints a message, unless the transfer is quiet.
+func (p *progress) printf(format string, args ...any) {
+	if p.quiet {
+		return
+	}
+	p.clear()
+	s := fmt.Sprintf(format, args...)
+	fmt.Fprint(p.out, s)
+	if i := strings.LastIndexByte(s, '\n'); i >= 0 {
+		p.line = s[i+1:]
+	} else {
+		p.line += s
+	}
+}
+
+// close ends a line left open by a transfer that failed part way, so the
+// error is printed on a line of its own.
+func (p *progress) close() {
+	if p.quiet {
+		return
+	}
+	p.clear()
+	if p.line != "" {
+		fmt.Fprintln(p.out)
+		p.line = ""
+	}
+}
+
+// beginTree marks the start of a recursive transfer of files files
+// totalling bytes bytes; pass -1 for both if that is not known.
+func (p *progress) beginTree(files int, bytes int64) {
+	p.tree = true
+	p.totalFiles = files
+	p.totalBytes = bytes
+}
+
+// startFile starts reporting the transfer of a file of size bytes, of
+// which the first offset are already at the destination.
+func (p *progress) startFile(label string, size, offset int64) {
+	p.label = label
+	p.size = size
+	p.done = offset
+	p.totalDone += offset
+}
+
+// skip records n bytes of the current file that did not need copying.
+func (p *progress) skip(n int64) {
+	p.done += n
+	p.totalDone += n
+}
+
+// endFile stops reporting the current file.
+func (p *progress) endFile() {
+	p.files++
+	if !p.quiet {
+		p.clear()
+	}
+}
+
+// add records n more bytes of the current file.
+func (p *progress) add(n int) {
+	p.done += int64(n)
+	p.totalDone += int64(n)
+	p.moved += int64(n)
+	if p.quiet {
+		return
+	}
+	now := time.Now()
+	if p.tty && now.Sub(p.last) >= progressRedraw {
+		p.draw(now)
+	} else if !p.tty && now.Sub(p.last) >= progressLogInterval {
+		p.log(now)
+	}
+}
+
+// draw redraws the status line after the current line's text.
+func (p *progress) draw(now time.Time) {
+	p.last = now
+	status := p.status(now)
+	if p.tree {
+		status = "  " + p.label + "  " + status
+	} else {
+		status = p.line + " " + status
+	}
+	if w, _, err := term.GetSize(int(os.Stdout.Fd())); err == nil && w > 1 {
+		status = fitWidth(status, w-1)
+	}
+	fmt.Fprintf(p.out, "\r%s\033[K", status)
+	p.drawn = true
+}
+
+// clear removes the status line, leaving the current line's text.
+func (p *progress) clear() {
+	if p.drawn {
+		fmt.Fprintf(p.out, "\r%s\033[K", p.line)
+		p.drawn = false
+	}
+}
+
+// log prints the progress on a line of its own.
+func (p *progress) log(now time.Time) {
+	p.last = now
+	if p.line != "" {
+		fmt.Fprintln(p.out)
+		p.line = ""
+	}
+	fmt.Fprintf(p.out, "  %s: %s\n", p.label, p.status(now))
+}
+
+// status describes the progress of the current file and, for recursive
+// transfers, of the whole tree.
+func (p *progress) status(now time.Time) string {
+	rate := p.rate(now)
+	s := fmt.Sprintf("%3d%%  %s / %s  %s/s", percent(p.done, p.size), formatSize(p.done), formatSize(p.size), formatSize(int64(rate)))
+	left := p.size - p.done
+	if p.tree {
+		if p.totalBytes >= 0 {
+			s += fmt.Sprintf("  [total %d%% of %s, file %d/%d]", percent(p.totalDone, p.totalBytes), formatSize(p.totalBytes), p.files+1, p.totalFiles)
+			left = p.totalBytes - p.totalDone
+		} else {
+			s += fmt.Sprintf("  [total %s, file %d]", formatSize(p.totalDone), p.files+1)
+		}
+	}
+	return s + "  ETA " + formatETA(left, rate)
+}
+
+// rate returns the bytes per second over the last rateWindow.
+func (p *progress) rate(now time.Time) float64 {
+	p.samples = append(p.samples, rateSample{now, p.moved})
+	for len(p.samples) > 2 && now.Sub(p.samples[1].t) >= rateWindow {
+		p.samples = p.samples[1:]
+	}
+	first := p.samples[0]
+	secs := now.Sub(first.t).Seconds()
+	if secs <= 0 {
+		return 0
+	}
+	return float64(p.moved-first.n) / secs
+}
+
+// summary describes a finished recursive transfer.
+func (p *progress) summary() string {
+	elapsed := time.Since(p.start)
+	s := fmt.Sprintf("%d files, %s in %s", p.files, formatSize(p.moved), elapsed.Round(100*time.Millisecond))
+	if secs := elapsed.Seconds(); secs > 0 && p.moved > 0 {
+		s += fmt.Sprintf(" (%s/s)", formatSize(int64(float64(p.moved)/secs)))
+	}
+	return s
+}
+
+// reader counts what is read from r as progress of the current file.
+func (p *progress) reader(r io.Reader) io.Reader {
+	return &progressReader{r, p}
+}
+
+// writer counts what is written to w as progress of the current file.
+func (p *progress) writer(w io.Writer) io.Writer {
+	return &progressWriter{w, p}
+}
+
+type progressReader struct {
+	r io.Reader
+	p *progress
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.p.add(n)
+	return n, err
+}
+
+type progressWriter struct {
+	w io.Writer
+	p *progress
+}
+
+func (w *progressWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.p.add(n)
+	return n, err
+}
+
+// percent returns done as a percentage of total, 100 for an empty total.
+func percent(done, total int64) int {
+	if total <= 0 {
+		return 100
+	}
+	return int(done * 100 / total)
+}
+
+// formatETA returns the time to move left bytes at rate bytes per second
+// as "m:ss" or "h:mm:ss".
+func formatETA(left int64, rate float64) string {
+	if left <= 0 {
+		return "0:00"
+	}
+	if rate <= 0 {
+		return "--:--"
+	}
+	secs := int64(float64(left)/rate + 0.5)
+	if secs >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", secs/3600, secs/60%60, secs%60)
+	}
+	return fmt.Sprintf("%d:%02d", secs/60, secs%60)
+}
+
+// fitWidth shortens s to width runes by dropping its end.
+func fitWidth(s string, width int) string {
+	if utf8.RuneCountInString(s) <= width {
+		return s
+	}
+	r := []rune(s)
+	return string(r[:width])
+}
+
+// localTreeSize counts the files a recursive upload of root sends, leaving
+// out what fl excludes.
+func localTreeSize(root string, fl *dirFilter) (files int, bytes int64) {
+	info, err := os.Stat(root)
+	if err != nil || !info.IsDir() {
+		if err == nil && info.Mode().IsRegular() {
+			return 1, info.Size()
+		}
+		return 0, 0
+	}
+	entries, _ := os.ReadDir(root)
+	for _, e := range entries {
+		full := filepath.Join(root, e.Name())
+		switch {
+		case fl.excluded(e.Name(), e.IsDir()):
+		case e.IsDir():
+			n, size := localTreeSize(full, fl.enter(e.Name(), localReader(full)))
+			files += n
+			bytes += size
+		case e.Type().IsRegular():
+			if fi, err := e.Info(); err == nil {
+				files++
+				bytes += fi.Size()
+			}
+		}
+	}
+	return files, bytes
+}
+
+// remoteTreeSize counts the files a recursive SFTP download of root
+// receives, following symlinks like the download does unless links is
+// set and leaving out what fl excludes. It returns -1s if the tree cannot
+// be read.
+func remoteTreeSize(sc *sftp.Client, root string, info fs.FileInfo, links bool, fl *dirFilter) (files int, bytes int64) {
+	if !info.IsDir() {
+		return 1, info.Size()
+	}
+	entries, err := sc.ReadDir(root)
+	if err != nil {
+		return -1, -1
+	}
+	for _, fi := range entries {
+		name := fi.Name()
+		full := path.Join(root, name)
+		if fl.excluded(name, fi.IsDir()) {
+			continue
+		}
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			if links {
+				continue
+			}
+			if fi, err = sc.Stat(full); err != nil {
+				continue
+			}
+		}
+		switch {
+		case fi.IsDir():
+			n, size := remoteTreeSize(sc, full, fi, links, fl.enter(name, remoteReader(sc, full)))
+			if n < 0 {
+				return -1, -1
+			}
+			files += n
+			bytes += size
+		case fi.Mode().IsRegular():
+			files++
+			bytes += fi.Size()
+		}
+	}
+	return files, bytes
+}
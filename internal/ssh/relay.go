@@ -0,0 +1,518 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/term"
+
+	"essh/internal/sftp"
+)
+
+// Relay copies a file on the server src is connected to into dstPath on
+// the server of dst, streaming it through this machine. If dstPath is a
+// directory, the file is created inside it.
+func Relay(src *ssh.Client, srcPath string, dst *ssh.Client, dstPath string, opts TransferOptions) error {
+	return relay(src, srcPath, dst, dstPath, false, opts)
+}
+
+// RelayRecursive is Relay for a file or directory tree.
+func RelayRecursive(src *ssh.Client, srcPath string, dst *ssh.Client, dstPath string, opts TransferOptions) error {
+	return relay(src, srcPath, dst, dstPath, true, opts)
+}
+
+func relay(src *ssh.Client, srcPath string, dst *ssh.Client, dstPath string, recursive bool, opts TransferOptions) error {
+	if opts.Resume {
+		return errors.New("--resume is not supported for copies between servers")
+	}
+	p := newProgress(opts)
+	defer p.close()
+
+	from, err := opts.sftpClient(src)
+	if err != nil {
+		return fmt.Errorf("source: %w", err)
+	}
+	var to *sftp.Client
+	if from != nil {
+		defer from.Close()
+		if to, err = opts.sftpClient(dst); err != nil {
+			return fmt.Errorf("destination: %w", err)
+		}
+	}
+	if to == nil {
+		// SFTP is needed on both ends; otherwise pass scp's own protocol
+		// between the two servers, like "scp -3".
+		if opts.Links && recursive {
+			return errors.New("--links needs SFTP on both servers")
+		}
+		if opts.Filter != nil && recursive {
+			return errors.New("filters need SFTP on both servers")
+		}
+		return scpRelay(src, remoteDir(srcPath), dst, remoteDir(dstPath), recursive, opts, p)
+	}
+	defer to.Close()
+
+	if srcPath, err = sftpPath(from, srcPath); err != nil {
+		return fmt.Errorf("source: %w", err)
+	}
+	if dstPath, err = sftpPath(to, dstPath); err != nil {
+		return fmt.Errorf("destination: %w", err)
+	}
+	x := &sftpRelay{from: from, to: to, opts: opts, p: p}
+	if recursive {
+		return x.copyRecursive(srcPath, dstPath)
+	}
+	return x.copy(srcPath, dstPath)
+}
+
+// sftpRelay copies between two SFTP sessions.
+type sftpRelay struct {
+	from, to *sftp.Client
+	opts     TransferOptions
+	p        *progress
+}
+
+func (x *sftpRelay) copy(srcPath, dstPath string) error {
+	info, err := x.from.Stat(srcPath)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory (use -r to copy recursively)", srcPath)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", srcPath)
+	}
+
+	name := remoteBase(x.from, srcPath)
+	x.p.printf("Copying %s (%s)...", name, formatSize(info.Size()))
+	dst := remoteTarget(x.to, dstPath, name)
+	if err := x.copyFile(srcPath, name, dst, info.Size(), info.Mode().Perm()); err != nil {
+		return err
+	}
+	if err := x.keep(dst, info); err != nil {
+		return err
+	}
+	x.p.printf("done\n")
+	return nil
+}
+
+func (x *sftpRelay) copyRecursive(srcPath, dstPath string) error {
+	info, err := x.from.Stat(srcPath)
+	if err != nil {
+		return err
+	}
+	dst := remoteTarget(x.to, dstPath, remoteBase(x.from, srcPath))
+
+	fl := x.opts.Filter.root(remoteReader(x.from, srcPath))
+	x.p.beginTree(remoteTreeSize(x.from, srcPath, info, x.opts.Links, fl))
+	switch {
+	case info.IsDir():
+		x.p.printf("Copying directory %s...\n", srcPath)
+		err = x.copyDir(srcPath, dst, info, fl)
+	case info.Mode().IsRegular():
+		x.p.printf("Copying %s (%s)...\n", path.Base(srcPath), formatSize(info.Size()))
+		err = x.copyTreeFile(srcPath, dst, info)
+	default:
+		err = fmt.Errorf("%s is not a regular file or directory", srcPath)
+	}
+	if err != nil {
+		return err
+	}
+
+	x.p.printf("done: %s\n", x.p.summary())
+	return nil
+}
+
+func (x *sftpRelay) copyTreeFile(srcPath, dst string, info fs.FileInfo) error {
+	if err := x.copyFile(srcPath, srcPath, dst, info.Size(), info.Mode().Perm()); err != nil {
+		return err
+	}
+	if err := x.keep(dst, info); err != nil {
+		return err
+	}
+	x.p.printf("  %s (%s)\n", srcPath, formatSize(info.Size()))
+	return nil
+}
+
+func (x *sftpRelay) copyDir(srcPath, dst string, info fs.FileInfo, fl *dirFilter) error {
+	if err := x.to.Mkdir(dst, info.Mode().Perm()); err != nil {
+		if fi, serr := x.to.Stat(dst); serr != nil || !fi.IsDir() {
+			return fmt.Errorf("creating dir %s: %w", dst, err)
+		}
+	}
+
+	entries, err := x.from.ReadDir(srcPath)
+	if err != nil {
+		return err
+	}
+	for _, fi := range entries {
+		name := fi.Name()
+		full := path.Join(srcPath, name)
+		target := path.Join(dst, name)
+		if fl.excluded(name, fi.IsDir()) {
+			continue
+		}
+		if fi.Mode()&fs.ModeSymlink != 0 && x.opts.Links {
+			link, err := x.from.ReadLink(full)
+			if err != nil {
+				return err
+			}
+			if err := replaceLink(x.to, link, target); err != nil {
+				return err
+			}
+			x.p.printf("  %s -> %s\n", full, link)
+			continue
+		}
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			if fi, err = x.from.Stat(full); err != nil {
+				x.p.printf("  skipping broken symlink: %s\n", full)
+				continue
+			}
+		}
+		switch {
+		case fi.IsDir():
+			err = x.copyDir(full, target, fi, fl.enter(name, remoteReader(x.from, full)))
+		case fi.Mode().IsRegular():
+			err = x.copyTreeFile(full, target, fi)
+		default:
+			x.p.printf("  skipping non-regular: %s\n", full)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return x.keep(dst, info)
+}
+
+// keep gives dst the permissions and times of the source file with -p.
+func (x *sftpRelay) keep(dst string, info fs.FileInfo) error {
+	if !x.opts.Preserve {
+		return nil
+	}
+	return setRemote(x.to, dst, info.Mode().Perm(), remoteTimes(info))
+}
+
+// copyFile copies srcPath to dst, reporting progress under label.
+func (x *sftpRelay) copyFile(srcPath, label, dst string, size int64, perm fs.FileMode) error {
+	in, err := x.from.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := x.to.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	// A pipe between the two keeps both the reads and the writes
+	// pipelined, where io.Copy would only use one side's.
+	pr, pw := io.Pipe()
+	read := make(chan error, 1)
+	go func() {
+		_, err := in.WriteTo(pw)
+		pw.CloseWithError(err)
+		read <- err
+	}()
+	x.p.startFile(label, size, 0)
+	_, err = out.ReadFrom(x.p.reader(pr))
+	x.p.endFile()
+	pr.CloseWithError(errors.New("copy aborted"))
+	if rerr := <-read; err == nil {
+		err = rerr
+	}
+	if err != nil {
+		out.Close()
+		return fmt.Errorf("copying %s: %w", srcPath, err)
+	}
+	return out.Close()
+}
+
+// scpRelay runs "scp -f" on src and "scp -t" on dst and passes the
+// protocol between them, watching it to report progress.
+func scpRelay(src *ssh.Client, srcPath string, dst *ssh.Client, dstPath string, recursive bool, opts TransferOptions, p *progress) error {
+	from, err := startSCP(src, scpCommand("f", srcPath, recursive, opts))
+	if err != nil {
+		return fmt.Errorf("source: %w", err)
+	}
+	defer from.session.Close()
+	to, err := startSCP(dst, scpCommand("t", dstPath, recursive, opts))
+	if err != nil {
+		return fmt.Errorf("destination: %w", err)
+	}
+	defer to.session.Close()
+
+	// The receiver speaks first; its acknowledgements are passed back to
+	// the sender.
+	ack := func() error {
+		if err := readAck(to.stdout); err != nil {
+			return fmt.Errorf("destination: %w", err)
+		}
+		_, err := from.stdin.Write([]byte{0})
+		return err
+	}
+	if err := ack(); err != nil {
+		return err
+	}
+
+	if recursive {
+		p.beginTree(-1, -1)
+		p.printf("Copying %s...\n", srcPath)
+	}
+	var dirs []string
+	for {
+		line, err := readLine(from.stdout)
+		if err == io.EOF && line == "" {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("source: reading directive: %w", err)
+		}
+		if line == "" {
+			continue
+		}
+		switch line[0] {
+		case 0x01, 0x02:
+			return fmt.Errorf("source: scp remote error: %s", strings.TrimSpace(line[1:]))
+		}
+		if _, err := io.WriteString(to.stdin, line+"\n"); err != nil {
+			return fmt.Errorf("destination: %w", err)
+		}
+		if err := ack(); err != nil {
+			return err
+		}
+
+		switch line[0] {
+		case 'D':
+			_, _, name, err := parseCDLine(line)
+			if err != nil {
+				return err
+			}
+			dirs = append(dirs, name)
+		case 'E':
+			if len(dirs) > 0 {
+				dirs = dirs[:len(dirs)-1]
+			}
+		case 'C':
+			_, size, name, err := parseCDLine(line)
+			if err != nil {
+				return err
+			}
+			label := path.Join(append(dirs[:len(dirs):len(dirs)], name)...)
+			if !recursive {
+				p.printf("Copying %s (%s)...", name, formatSize(size))
+			}
+			p.startFile(label, size, 0)
+			_, err = io.CopyN(to.stdin, p.reader(from.stdout), size)
+			p.endFile()
+			if err != nil {
+				return fmt.Errorf("copying %s: %w", label, err)
+			}
+			// Pass on the sender's completion byte and the receiver's ack.
+			if err := readAck(from.stdout); err != nil {
+				return fmt.Errorf("source: %w", err)
+			}
+			if _, err := to.stdin.Write([]byte{0}); err != nil {
+				return fmt.Errorf("destination: %w", err)
+			}
+			if err := ack(); err != nil {
+				return err
+			}
+			if recursive {
+				p.printf("  %s (%s)\n", label, formatSize(size))
+			} else {
+				p.printf("done\n")
+			}
+		}
+	}
+
+	to.stdin.Close()
+	if err := to.session.Wait(); err != nil {
+		return fmt.Errorf("destination: scp session: %w", err)
+	}
+	if err := from.session.Wait(); err != nil {
+		return fmt.Errorf("source: scp session: %w", err)
+	}
+	if recursive {
+		p.printf("done: %s\n", p.summary())
+	}
+	return nil
+}
+
+// scpProcess is an scp command running on a server.
+type scpProcess struct {
+	session *ssh.Session
+	stdin   io.WriteCloser
+	stdout  io.Reader
+}
+
+func startSCP(client *ssh.Client, command string) (*scpProcess, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("creating session: %w", err)
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, fmt.Errorf("getting stdin pipe: %w", err)
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, fmt.Errorf("getting stdout pipe: %w", err)
+	}
+	if err := session.Start(command); err != nil {
+		session.Close()
+		return nil, fmt.Errorf("starting scp: %w", err)
+	}
+	return &scpProcess{session, stdin, stdout}, nil
+}
+
+// DirectCopy copies srcPaths on the server src is connected to straight to
+// dst, by running a single scp on the source server. The source authenticates to
+// dst with dst's keys through a forwarded agent and checks dst's host key
+// as verified by this machine; the data does not pass through here. The
+// local SSH agent is only forwarded with opts.ForwardAgent.
+func DirectCopy(src *ssh.Client, srcPaths []string, dst *Target, dstPath string, recursive bool, opts TransferOptions) error {
+	if len(dst.Jump) > 0 {
+		return fmt.Errorf("--direct cannot reach %s: it is behind a jump host, and the source server connects to it directly; copy without --direct instead", dst.Name)
+	}
+	if opts.Resume {
+		return errors.New("--resume is not supported for copies between servers")
+	}
+	if opts.Links {
+		return errors.New("--links is not supported with --direct")
+	}
+	if opts.Filter != nil {
+		return errors.New("filters are not supported with --direct")
+	}
+	// Connect once from here to verify dst's host key.
+	check, err := Dial(dst)
+	if err != nil {
+		return fmt.Errorf("destination: %w", err)
+	}
+	check.Close()
+
+	keyring, err := forwardedKeys(dst)
+	if err != nil {
+		return err
+	}
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	switch {
+	case keyring != nil:
+		err = agent.ForwardToAgent(src, keyring)
+	case opts.ForwardAgent && sock != "" && dst.AgentKeys != AgentKeysOff:
+		fmt.Fprintf(os.Stderr, "Warning: forwarding your SSH agent to the source server; every key in it is usable from there until the copy ends\n")
+		err = agent.ForwardToRemote(src, sock)
+	case sock != "" && dst.AgentKeys != AgentKeysOff:
+		return fmt.Errorf("--direct needs a key for %s: store one with the server, or pass -A to forward your SSH agent to the source server (every key in it becomes usable there)", dst.Name)
+	default:
+		return fmt.Errorf("--direct needs a key for %s: the source server logs in to it with a forwarded agent, which cannot use a password", dst.Name)
+	}
+	if err != nil {
+		return fmt.Errorf("forwarding keys: %w", err)
+	}
+
+	session, err := src.NewSession()
+	if err != nil {
+		return fmt.Errorf("creating session: %w", err)
+	}
+	defer session.Close()
+	if err := agent.RequestAgentForwarding(session); err != nil {
+		return fmt.Errorf("forwarding keys: %w", err)
+	}
+
+	// With a terminal, scp shows its own progress meter.
+	fd := int(os.Stdout.Fd())
+	if !opts.Quiet && term.IsTerminal(fd) {
+		w, h, err := term.GetSize(fd)
+		if err != nil || w <= 0 {
+			w, h = 80, 24
+		}
+		if err := session.RequestPty("xterm", h, w, ssh.TerminalModes{ssh.ECHO: 0}); err != nil {
+			return fmt.Errorf("requesting pty: %w", err)
+		}
+	}
+	session.Stdout = os.Stdout
+	session.Stderr = os.Stderr
+
+	host := dst.Host
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	line := knownhosts.Line([]string{knownhosts.Normalize(dst.Addr())}, dst.HostKey)
+	scp := "scp"
+	if recursive {
+		scp += " -r"
+	}
+	if opts.Quiet {
+		scp += " -q"
+	}
+	if opts.Preserve {
+		scp += " -p"
+	}
+	sources := make([]string, len(srcPaths))
+	for i, p := range srcPaths {
+		sources[i] = remoteArg(p)
+	}
+	command := fmt.Sprintf(`f=$(mktemp) || exit 1
+printf '%%s\n' %s > "$f"
+%s -o BatchMode=yes -o StrictHostKeyChecking=yes -o UserKnownHostsFile="$f" -o GlobalKnownHostsFile=/dev/null -P %d %s %s
+rc=$?
+rm -f "$f"
+exit $rc`, shellQuote(line), scp, dst.Port, strings.Join(sources, " "), shellQuote(fmt.Sprintf("%s@%s:%s", dst.User, host, dstPath)))
+	if err := session.Run(command); err != nil {
+		return fmt.Errorf("scp on the source server: %w", err)
+	}
+	return nil
+}
+
+// forwardedKeys returns an agent holding t's stored key and identity files,
+// or nil if it has none.
+func forwardedKeys(t *Target) (agent.Agent, error) {
+	keyring := agent.NewKeyring()
+	n := 0
+	if len(t.PrivateKey) > 0 {
+		var key any
+		var err error
+		if t.Passphrase != "" {
+			key, err = ssh.ParseRawPrivateKeyWithPassphrase(t.PrivateKey, []byte(t.Passphrase))
+		} else {
+			key, err = ssh.ParseRawPrivateKey(t.PrivateKey)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parsing stored private key: %w", err)
+		}
+		if err := keyring.Add(agent.AddedKey{PrivateKey: key, Comment: t.Name}); err != nil {
+			return nil, err
+		}
+		n++
+	}
+	for _, p := range t.IdentityFiles {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			continue
+		}
+		// Protected identity files are left to the SSH agent.
+		key, err := ssh.ParseRawPrivateKey(data)
+		if err != nil {
+			continue
+		}
+		if err := keyring.Add(agent.AddedKey{PrivateKey: key, Comment: p}); err != nil {
+			return nil, err
+		}
+		n++
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	return keyring, nil
+}
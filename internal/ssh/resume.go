@@ -0,0 +1,443 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// resumeOffset returns where to continue a copy of a size-byte source into
+// a destination that already holds have bytes: have if same confirms the
+// destination is a prefix of the source, 0 to start over.
+func resumeOffset(have, size int64, same func() (bool, error)) (int64, error) {
+	if have <= 0 || have > size {
+		return 0, nil
+	}
+	ok, err := same()
+	if err != nil {
+		return 0, fmt.Errorf("verifying partial file: %w", err)
+	}
+	if !ok {
+		return 0, nil
+	}
+	return have, nil
+}
+
+// resumeNote finishes a "Uploading x..." line for a copy that started at
+// offset.
+func resumeNote(offset, size int64) string {
+	switch {
+	case offset == 0:
+		return "done"
+	case offset == size:
+		return "already complete"
+	}
+	return fmt.Sprintf("done (resumed at %s)", formatSize(offset))
+}
+
+// treeNote is resumeNote for the per-file lines of recursive transfers.
+func treeNote(offset, size int64) string {
+	switch {
+	case offset == 0:
+		return ""
+	case offset == size:
+		return ", already complete"
+	}
+	return fmt.Sprintf(", resumed at %s", formatSize(offset))
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// remoteArg quotes remotePath for the server's shell, leaving a leading ~/
+// unquoted so it still names the home directory. An empty path is the
+// login directory.
+func remoteArg(remotePath string) string {
+	remotePath = remoteDir(remotePath)
+	if strings.HasPrefix(remotePath, "~/") {
+		return "~/" + shellQuote(remotePath[2:])
+	}
+	return shellQuote(remotePath)
+}
+
+// runOutput runs command on client and returns its stdout.
+func runOutput(client *ssh.Client, command string) (string, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return "", fmt.Errorf("creating session: %w", err)
+	}
+	defer session.Close()
+	out, err := session.Output(command)
+	return string(out), err
+}
+
+// localPrefixHash returns the hex SHA-256 of the first n bytes of a local
+// file.
+func localPrefixHash(localPath string, n int64) (string, error) {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.CopyN(h, f, n); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// remotePrefixHash returns the hex SHA-256 of the first n bytes of a remote
+// file, computed on the server so the data does not cross the network.
+func remotePrefixHash(client *ssh.Client, remotePath string, n int64) (string, error) {
+	out, err := runOutput(client, fmt.Sprintf("head -c %d < %s | { sha256sum 2>/dev/null || shasum -a 256; }", n, remoteArg(remotePath)))
+	if err != nil {
+		return "", fmt.Errorf("hashing %s on the server: %w", remotePath, err)
+	}
+	fields := strings.Fields(out)
+	if len(fields) == 0 || len(fields[0]) != sha256.Size*2 {
+		return "", fmt.Errorf("hashing %s on the server: unexpected output %q", remotePath, out)
+	}
+	return fields[0], nil
+}
+
+// samePrefix reports whether the first n bytes of a local and a remote file
+// are identical, by hash on the server or, where the server cannot run
+// commands (SFTP-only accounts), by reading the whole prefix back over SFTP
+// and hashing it locally.
+func (x *sftpTransfer) samePrefix(localPath, remotePath string, n int64) (bool, error) {
+	want, err := localPrefixHash(localPath, n)
+	if err != nil {
+		return false, err
+	}
+	if x.client != nil {
+		if got, err := remotePrefixHash(x.client, remotePath, n); err == nil {
+			return got == want, nil
+		}
+	}
+
+	rf, err := x.sc.Open(remotePath)
+	if err != nil {
+		return false, err
+	}
+	defer rf.Close()
+	h := sha256.New()
+	w := &prefixWriter{w: h, n: n}
+	if _, err := rf.WriteTo(w); err != nil && err != errPrefixDone {
+		return false, err
+	}
+	if w.n > 0 {
+		return false, nil
+	}
+	return hex.EncodeToString(h.Sum(nil)) == want, nil
+}
+
+// errPrefixDone stops a copy into a prefixWriter once it has its n bytes.
+var errPrefixDone = errors.New("prefix complete")
+
+// prefixWriter passes the first n bytes written to w and then fails with
+// errPrefixDone, so a streaming copy stops at the prefix.
+type prefixWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	if int64(len(b)) > p.n {
+		b = b[:p.n]
+	}
+	n, err := p.w.Write(b)
+	p.n -= int64(n)
+	if err == nil && p.n == 0 {
+		err = errPrefixDone
+	}
+	return n, err
+}
+
+// execSamePrefix is samePrefix for servers without SFTP.
+func execSamePrefix(client *ssh.Client, localPath, remotePath string, n int64) (bool, error) {
+	want, err := localPrefixHash(localPath, n)
+	if err != nil {
+		return false, err
+	}
+	got, err := remotePrefixHash(client, remotePath, n)
+	if err != nil {
+		return false, err
+	}
+	return got == want, nil
+}
+
+// remoteStat describes remotePath using the shell: whether it is a
+// directory, and the size of a regular file (-1 if there is none).
+func remoteStat(client *ssh.Client, remotePath string) (isDir bool, size int64, err error) {
+	out, err := runOutput(client, fmt.Sprintf(`p=%s; if [ -d "$p" ]; then echo d; elif [ -f "$p" ]; then echo f; wc -c < "$p"; else echo -; fi`, remoteArg(remotePath)))
+	if err != nil {
+		return false, 0, fmt.Errorf("checking %s: %w", remotePath, err)
+	}
+	fields := strings.Fields(out)
+	switch {
+	case len(fields) == 1 && fields[0] == "d":
+		return true, -1, nil
+	case len(fields) == 1 && fields[0] == "-":
+		return false, -1, nil
+	case len(fields) == 2 && fields[0] == "f":
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err == nil {
+			return false, size, nil
+		}
+	}
+	return false, 0, fmt.Errorf("checking %s: unexpected output %q", remotePath, out)
+}
+
+// execResumeUpload uploads a single file like scpUpload, but continues a
+// matching partial remote file by appending to it with cat.
+func execResumeUpload(client *ssh.Client, localPath, remotePath string, opts TransferOptions, p *progress) error {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return fmt.Errorf("stat local file: %w", err)
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory (use -r to upload recursively)", localPath)
+	}
+
+	dst := remoteDir(remotePath)
+	isDir, have, err := remoteStat(client, dst)
+	if err != nil {
+		return err
+	}
+	if isDir {
+		dst = path.Join(dst, filepath.Base(localPath))
+		if _, have, err = remoteStat(client, dst); err != nil {
+			return err
+		}
+	}
+	offset, err := resumeOffset(have, info.Size(), func() (bool, error) {
+		return execSamePrefix(client, localPath, dst, have)
+	})
+	if err != nil {
+		return err
+	}
+	if offset > 0 && opts.Preserve {
+		p.printf("%s: resuming with -p needs SFTP, copying again from the start\n", filepath.Base(localPath))
+		offset = 0
+	}
+	if offset == 0 {
+		return scpUpload(client, localPath, dst, opts, p)
+	}
+
+	p.printf("Uploading %s (%s)...", filepath.Base(localPath), formatSize(info.Size()))
+	if offset < info.Size() {
+		p.startFile(filepath.Base(localPath), info.Size(), offset)
+		err := execAppend(client, localPath, dst, offset, p)
+		p.endFile()
+		if err != nil {
+			return err
+		}
+	}
+	p.printf("%s\n", resumeNote(offset, info.Size()))
+	return nil
+}
+
+// execAppend appends localPath from offset onwards to the remote file dst.
+func execAppend(client *ssh.Client, localPath, dst string, offset int64, p *progress) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return fmt.Errorf("opening local file: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		return fmt.Errorf("creating session: %w", err)
+	}
+	defer session.Close()
+	session.Stdin = p.reader(f)
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+	if err := session.Run("cat >> " + remoteArg(dst)); err != nil {
+		return fmt.Errorf("appending to %s: %w %s", dst, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// execResumeDownload downloads a single file like scpDownload, but
+// continues a matching partial local file from the server's tail output.
+func execResumeDownload(client *ssh.Client, remotePath, localPath string, opts TransferOptions, p *progress) error {
+	isDir, size, err := remoteStat(client, remotePath)
+	if err != nil {
+		return err
+	}
+	if isDir {
+		return fmt.Errorf("%s is a directory (use -r to download recursively)", remotePath)
+	}
+	if size < 0 {
+		// Let scp report the error.
+		return scpDownload(client, remotePath, localPath, opts, p)
+	}
+
+	name := path.Base(remoteDir(remotePath))
+	dst := localPath
+	if fi, err := os.Stat(localPath); err == nil && fi.IsDir() {
+		dst = filepath.Join(localPath, name)
+	}
+	var have int64
+	if fi, err := os.Stat(dst); err == nil && fi.Mode().IsRegular() {
+		have = fi.Size()
+	}
+	offset, err := resumeOffset(have, size, func() (bool, error) {
+		return execSamePrefix(client, dst, remotePath, have)
+	})
+	if err != nil {
+		return err
+	}
+	if offset > 0 && opts.Preserve {
+		p.printf("%s: resuming with -p needs SFTP, copying again from the start\n", name)
+		offset = 0
+	}
+	if offset == 0 {
+		return scpDownload(client, remotePath, dst, opts, p)
+	}
+
+	p.printf("Downloading %s (%s)...", name, formatSize(size))
+	if offset < size {
+		p.startFile(name, size, offset)
+		err := execTail(client, remotePath, dst, offset, size, p)
+		p.endFile()
+		if err != nil {
+			return err
+		}
+	}
+	p.printf("%s\n", resumeNote(offset, size))
+	return nil
+}
+
+// execTail writes the remote file remotePath from offset onwards into the
+// local file dst at the same offset.
+func execTail(client *ssh.Client, remotePath, dst string, offset, size int64, p *progress) error {
+	f, err := os.OpenFile(dst, os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("opening %s: %w", dst, err)
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		return fmt.Errorf("creating session: %w", err)
+	}
+	defer session.Close()
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("getting stdout pipe: %w", err)
+	}
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+	if err := session.Start(fmt.Sprintf("tail -c +%d %s", offset+1, remoteArg(remotePath))); err != nil {
+		return fmt.Errorf("starting tail: %w", err)
+	}
+	// Stop at the size seen earlier in case the file is still growing.
+	if _, err := io.CopyN(p.writer(f), stdout, size-offset); err != nil {
+		return fmt.Errorf("receiving file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("closing %s: %w", dst, err)
+	}
+	session.Close()
+	return nil
+}
+
+// errResumeNeedsSFTP is returned for recursive transfers with Resume when
+// the server does not offer SFTP.
+var errResumeNeedsSFTP = errors.New("resuming directory transfers needs SFTP")
+
+// RetryTransfer dials t and runs transfer, which should resume rather than
+// restart partial files. If the connection fails or drops, it redials with
+// the same backoff as auto-reconnect and runs transfer again, until
+// maxAutoRetryDuration passes without a connection that lasted
+// sessionStableThreshold. The first dial must succeed, and later ones are
+// only retried on network errors, never on authentication or host key
+// failures.
+func RetryTransfer(t *Target, transfer func(client *ssh.Client) error) error {
+	backoff := time.Second
+	deadline := time.Now().Add(maxAutoRetryDuration)
+	everConnected := false
+	for {
+		start := time.Now()
+		connected, lost, err := runTransfer(t, transfer)
+		if !lost {
+			return err
+		}
+		if !connected && (!everConnected || !isTransientDialError(err)) {
+			return err
+		}
+		everConnected = true
+		if connected && time.Since(start) >= sessionStableThreshold {
+			backoff = time.Second
+			deadline = time.Now().Add(maxAutoRetryDuration)
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			return fmt.Errorf("giving up after retrying for %s: %w", maxAutoRetryDuration, err)
+		}
+		fmt.Fprintf(os.Stderr, "Transfer interrupted: %v\nRetrying in %s...\n", err, backoff)
+		time.Sleep(backoff)
+		backoff = nextBackoff(backoff)
+	}
+}
+
+// runTransfer runs transfer on a new connection to t. lost reports whether
+// it failed because the connection failed or dropped, rather than because
+// of the transfer itself.
+func runTransfer(t *Target, transfer func(client *ssh.Client) error) (connected, lost bool, err error) {
+	client, err := Dial(t)
+	if err != nil {
+		return false, true, err
+	}
+	defer client.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go keepAlive(client, done)
+	closed := make(chan struct{})
+	go func() {
+		client.Wait()
+		close(closed)
+	}()
+
+	err = transfer(client)
+	if err == nil {
+		return true, false, nil
+	}
+	select {
+	case <-closed:
+		return true, true, err
+	default:
+	}
+	reply := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		reply <- err
+	}()
+	select {
+	case perr := <-reply:
+		return true, perr != nil, err
+	case <-time.After(keepAliveInterval):
+		return true, true, err
+	}
+}
@@ -4,15 +4,31 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
 
 	"golang.org/x/crypto/ssh"
+
+	"essh/internal/sftp"
 )
 
-// Upload sends a local file to a remote path via the SCP protocol.
-func Upload(client *ssh.Client, localPath, remotePath string) error {
+// scpCommand returns the scp command run on the server in mode "t" (sink)
+// or "f" (source), adding -p to carry times and permissions.
+func scpCommand(mode, remotePath string, recursive bool, opts TransferOptions) string {
+	flags := "-"
+	if opts.Preserve {
+		flags += "p"
+	}
+	if recursive {
+		flags += "r"
+	}
+	return "scp " + flags + mode + " " + remoteArg(remotePath)
+}
+
+// scpUpload sends a local file to a remote path via the SCP protocol.
+func scpUpload(client *ssh.Client, localPath, remotePath string, opts TransferOptions, p *progress) error {
 	f, err := os.Open(localPath)
 	if err != nil {
 		return fmt.Errorf("opening local file: %w", err)
@@ -27,7 +43,7 @@ func Upload(client *ssh.Client, localPath, remotePath string) error {
 		return fmt.Errorf("%s is a directory (use -r to upload recursively)", localPath)
 	}
 
-	fmt.Printf("Uploading %s (%s)...", filepath.Base(localPath), formatSize(info.Size()))
+	p.printf("Uploading %s (%s)...", filepath.Base(localPath), formatSize(info.Size()))
 
 	session, err := client.NewSession()
 	if err != nil {
@@ -45,7 +61,7 @@ func Upload(client *ssh.Client, localPath, remotePath string) error {
 		return fmt.Errorf("getting stdout pipe: %w", err)
 	}
 
-	if err := session.Start("scp -t " + remotePath); err != nil {
+	if err := session.Start(scpCommand("t", remotePath, false, opts)); err != nil {
 		return fmt.Errorf("starting scp: %w", err)
 	}
 
@@ -54,8 +70,14 @@ func Upload(client *ssh.Client, localPath, remotePath string) error {
 		return fmt.Errorf("initial ack: %w", err)
 	}
 
+	if opts.Preserve {
+		if err := sendTimes(stdin, stdout, localPath, info); err != nil {
+			return err
+		}
+	}
+
 	// Send file header: C<mode> <size> <filename>
-	header := fmt.Sprintf("C0644 %d %s\n", info.Size(), filepath.Base(localPath))
+	header := fmt.Sprintf("C%04o %d %s\n", info.Mode().Perm(), info.Size(), filepath.Base(localPath))
 	if _, err := io.WriteString(stdin, header); err != nil {
 		return fmt.Errorf("sending header: %w", err)
 	}
@@ -65,7 +87,10 @@ func Upload(client *ssh.Client, localPath, remotePath string) error {
 	}
 
 	// Send file content
-	if _, err := io.Copy(stdin, f); err != nil {
+	p.startFile(filepath.Base(localPath), info.Size(), 0)
+	_, err = io.Copy(stdin, p.reader(f))
+	p.endFile()
+	if err != nil {
 		return fmt.Errorf("sending file: %w", err)
 	}
 
@@ -83,17 +108,30 @@ func Upload(client *ssh.Client, localPath, remotePath string) error {
 		return fmt.Errorf("scp session: %w", err)
 	}
 
-	fmt.Println("done")
+	p.printf("done\n")
 	return nil
 }
 
-// UploadRecursive sends a local file or directory tree to a remote path.
-func UploadRecursive(client *ssh.Client, localPath, remotePath string) error {
+// scpUploadRecursive sends a local file or directory tree to a remote path.
+func scpUploadRecursive(client *ssh.Client, localPath, remotePath string, opts TransferOptions, p *progress) error {
 	info, err := os.Stat(localPath)
 	if err != nil {
 		return fmt.Errorf("stat local path: %w", err)
 	}
 
+	// SCP cannot carry symlinks, so with --links they are created over
+	// SFTP once the files are there. Where the tree lands must be worked
+	// out before scp creates it.
+	var sc *sftp.Client
+	var dst string
+	if opts.Links && info.IsDir() {
+		if sc, err = NewSFTP(client); err != nil {
+			return fmt.Errorf("--links over SCP needs SFTP to create symlinks: %w", err)
+		}
+		defer sc.Close()
+		dst = remoteTarget(sc, remotePath, filepath.Base(localPath))
+	}
+
 	session, err := client.NewSession()
 	if err != nil {
 		return fmt.Errorf("creating session: %w", err)
@@ -109,7 +147,7 @@ func UploadRecursive(client *ssh.Client, localPath, remotePath string) error {
 		return fmt.Errorf("getting stdout pipe: %w", err)
 	}
 
-	if err := session.Start("scp -rt " + remotePath); err != nil {
+	if err := session.Start(scpCommand("t", remotePath, true, opts)); err != nil {
 		return fmt.Errorf("starting scp: %w", err)
 	}
 
@@ -117,14 +155,17 @@ func UploadRecursive(client *ssh.Client, localPath, remotePath string) error {
 		return fmt.Errorf("initial ack: %w", err)
 	}
 
+	x := &scpSender{stdin: stdin, stdout: stdout, opts: opts, p: p}
+	fl := opts.Filter.root(localReader(localPath))
+	p.beginTree(localTreeSize(localPath, fl))
 	if info.IsDir() {
-		fmt.Printf("Uploading directory %s...\n", localPath)
-		if err := sendDir(stdin, stdout, localPath); err != nil {
+		p.printf("Uploading directory %s...\n", localPath)
+		if err := x.sendDir(localPath, "", fl); err != nil {
 			return err
 		}
 	} else {
-		fmt.Printf("Uploading %s (%s)...\n", filepath.Base(localPath), formatSize(info.Size()))
-		if err := sendFile(stdin, stdout, localPath, info); err != nil {
+		p.printf("Uploading %s (%s)...\n", filepath.Base(localPath), formatSize(info.Size()))
+		if err := x.sendFile(localPath, info); err != nil {
 			return err
 		}
 	}
@@ -134,11 +175,50 @@ func UploadRecursive(client *ssh.Client, localPath, remotePath string) error {
 		return fmt.Errorf("scp session: %w", err)
 	}
 
-	fmt.Println("done")
+	for _, l := range x.links {
+		link := path.Join(dst, l.rel)
+		if err := replaceLink(sc, l.target, link); err != nil {
+			return err
+		}
+		p.printf("  %s -> %s\n", l.local, l.target)
+	}
+	if opts.Preserve {
+		// Creating the links touched their directories again.
+		for _, l := range x.links {
+			dir := filepath.Dir(l.local)
+			if fi, err := os.Stat(dir); err == nil {
+				setRemote(sc, path.Dir(path.Join(dst, l.rel)), fi.Mode().Perm(), localTimes(dir, fi))
+			}
+		}
+	}
+
+	p.printf("done: %s\n", p.summary())
 	return nil
 }
 
-func sendFile(stdin io.Writer, stdout io.Reader, path string, info os.FileInfo) error {
+// scpSender sends files and directories to an "scp -t" on the server.
+type scpSender struct {
+	stdin  io.Writer
+	stdout io.Reader
+	opts   TransferOptions
+	p      *progress
+	// links are the symlinks found with --links, left for the caller to
+	// create as SCP cannot.
+	links []scpLink
+}
+
+// scpLink is a symlink at local, rel from the root of the tree.
+type scpLink struct {
+	local, rel, target string
+}
+
+func (x *scpSender) sendFile(path string, info os.FileInfo) error {
+	stdin, stdout, p := x.stdin, x.stdout, x.p
+	if x.opts.Preserve {
+		if err := sendTimes(stdin, stdout, path, info); err != nil {
+			return err
+		}
+	}
 	f, err := os.Open(path)
 	if err != nil {
 		return fmt.Errorf("opening %s: %w", path, err)
@@ -153,7 +233,10 @@ func sendFile(stdin io.Writer, stdout io.Reader, path string, info os.FileInfo)
 	if err := readAck(stdout); err != nil {
 		return fmt.Errorf("header ack for %s: %w", path, err)
 	}
-	if _, err := io.Copy(stdin, f); err != nil {
+	p.startFile(path, info.Size(), 0)
+	_, err = io.Copy(stdin, p.reader(f))
+	p.endFile()
+	if err != nil {
 		return fmt.Errorf("sending %s: %w", path, err)
 	}
 	if _, err := stdin.Write([]byte{0}); err != nil {
@@ -162,15 +245,21 @@ func sendFile(stdin io.Writer, stdout io.Reader, path string, info os.FileInfo)
 	if err := readAck(stdout); err != nil {
 		return fmt.Errorf("final ack for %s: %w", path, err)
 	}
-	fmt.Printf("  %s (%s)\n", path, formatSize(info.Size()))
+	p.printf("  %s (%s)\n", path, formatSize(info.Size()))
 	return nil
 }
 
-func sendDir(stdin io.Writer, stdout io.Reader, path string) error {
+func (x *scpSender) sendDir(path, rel string, fl *dirFilter) error {
+	stdin, stdout, p := x.stdin, x.stdout, x.p
 	info, err := os.Stat(path)
 	if err != nil {
 		return fmt.Errorf("stat %s: %w", path, err)
 	}
+	if x.opts.Preserve {
+		if err := sendTimes(stdin, stdout, path, info); err != nil {
+			return err
+		}
+	}
 	mode := info.Mode().Perm()
 	header := fmt.Sprintf("D%04o 0 %s\n", mode, filepath.Base(path))
 	if _, err := io.WriteString(stdin, header); err != nil {
@@ -187,21 +276,32 @@ func sendDir(stdin io.Writer, stdout io.Reader, path string) error {
 
 	for _, e := range entries {
 		full := filepath.Join(path, e.Name())
+		if fl.excluded(e.Name(), e.IsDir()) {
+			continue
+		}
 		if e.IsDir() {
-			if err := sendDir(stdin, stdout, full); err != nil {
+			if err := x.sendDir(full, filepath.ToSlash(filepath.Join(rel, e.Name())), fl.enter(e.Name(), localReader(full))); err != nil {
 				return err
 			}
 			continue
 		}
+		if e.Type()&os.ModeSymlink != 0 && x.opts.Links {
+			target, err := os.Readlink(full)
+			if err != nil {
+				return fmt.Errorf("reading symlink %s: %w", full, err)
+			}
+			x.links = append(x.links, scpLink{full, filepath.ToSlash(filepath.Join(rel, e.Name())), target})
+			continue
+		}
 		if !e.Type().IsRegular() {
-			fmt.Printf("  skipping non-regular: %s\n", full)
+			p.printf("  skipping non-regular: %s\n", full)
 			continue
 		}
 		fi, err := e.Info()
 		if err != nil {
 			return fmt.Errorf("stat %s: %w", full, err)
 		}
-		if err := sendFile(stdin, stdout, full, fi); err != nil {
+		if err := x.sendFile(full, fi); err != nil {
 			return err
 		}
 	}
@@ -215,8 +315,8 @@ func sendDir(stdin io.Writer, stdout io.Reader, path string) error {
 	return nil
 }
 
-// Download retrieves a remote file to a local path via the SCP protocol.
-func Download(client *ssh.Client, remotePath, localPath string) error {
+// scpDownload retrieves a remote file to a local path via the SCP protocol.
+func scpDownload(client *ssh.Client, remotePath, localPath string, opts TransferOptions, p *progress) error {
 	session, err := client.NewSession()
 	if err != nil {
 		return fmt.Errorf("creating session: %w", err)
@@ -233,7 +333,7 @@ func Download(client *ssh.Client, remotePath, localPath string) error {
 		return fmt.Errorf("getting stdout pipe: %w", err)
 	}
 
-	if err := session.Start("scp -f " + remotePath); err != nil {
+	if err := session.Start(scpCommand("f", remotePath, false, opts)); err != nil {
 		return fmt.Errorf("starting scp: %w", err)
 	}
 
@@ -242,17 +342,31 @@ func Download(client *ssh.Client, remotePath, localPath string) error {
 		return fmt.Errorf("sending initial ack: %w", err)
 	}
 
-	// Read file header: C<mode> <size> <filename>
+	// Read file header: C<mode> <size> <filename>, after the file's times
+	// with -p
 	header, err := readLine(stdout)
 	if err != nil {
 		return fmt.Errorf("reading header: %w", err)
 	}
 
+	var times fileTimes
+	if opts.Preserve && strings.HasPrefix(header, "T") {
+		if times, err = parseTimes(header); err != nil {
+			return err
+		}
+		if _, err := stdin.Write([]byte{0}); err != nil {
+			return fmt.Errorf("ack T: %w", err)
+		}
+		if header, err = readLine(stdout); err != nil {
+			return fmt.Errorf("reading header: %w", err)
+		}
+	}
+
 	if len(header) == 0 || header[0] != 'C' {
 		return fmt.Errorf("unexpected scp header: %q", header)
 	}
 
-	size, filename, err := parseHeader(header)
+	mode, size, filename, err := parseCDLine(header)
 	if err != nil {
 		return err
 	}
@@ -263,7 +377,7 @@ func Download(client *ssh.Client, remotePath, localPath string) error {
 		localPath = filepath.Join(localPath, filename)
 	}
 
-	fmt.Printf("Downloading %s (%s)...", filename, formatSize(size))
+	p.printf("Downloading %s (%s)...", filename, formatSize(size))
 
 	// Send OK to acknowledge header
 	if _, err := stdin.Write([]byte{0}); err != nil {
@@ -271,15 +385,26 @@ func Download(client *ssh.Client, remotePath, localPath string) error {
 	}
 
 	// Read file content
-	f, err := os.Create(localPath)
+	f, err := os.OpenFile(localPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
 	if err != nil {
 		return fmt.Errorf("creating local file: %w", err)
 	}
 	defer f.Close()
 
-	if _, err := io.CopyN(f, stdout, size); err != nil {
+	p.startFile(filename, size, 0)
+	_, err = io.CopyN(p.writer(f), stdout, size)
+	p.endFile()
+	if err != nil {
 		return fmt.Errorf("receiving file: %w", err)
 	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("closing %s: %w", localPath, err)
+	}
+	if opts.Preserve {
+		if err := setLocal(localPath, mode, times); err != nil {
+			return err
+		}
+	}
 
 	// Read trailing zero byte
 	buf := make([]byte, 1)
@@ -297,12 +422,12 @@ func Download(client *ssh.Client, remotePath, localPath string) error {
 		return fmt.Errorf("scp session: %w", err)
 	}
 
-	fmt.Println("done")
+	p.printf("done\n")
 	return nil
 }
 
-// DownloadRecursive retrieves a remote file or directory tree to a local path.
-func DownloadRecursive(client *ssh.Client, remotePath, localPath string) error {
+// scpDownloadRecursive retrieves a remote file or directory tree to a local path.
+func scpDownloadRecursive(client *ssh.Client, remotePath, localPath string, opts TransferOptions, p *progress) error {
 	session, err := client.NewSession()
 	if err != nil {
 		return fmt.Errorf("creating session: %w", err)
@@ -318,7 +443,7 @@ func DownloadRecursive(client *ssh.Client, remotePath, localPath string) error {
 		return fmt.Errorf("getting stdout pipe: %w", err)
 	}
 
-	if err := session.Start("scp -rf " + remotePath); err != nil {
+	if err := session.Start(scpCommand("f", remotePath, true, opts)); err != nil {
 		return fmt.Errorf("starting scp: %w", err)
 	}
 
@@ -328,6 +453,16 @@ func DownloadRecursive(client *ssh.Client, remotePath, localPath string) error {
 	}
 
 	var stack []string
+	// With -p, a T record gives the times of the next file or directory;
+	// a directory's are applied when it is finished, after its files.
+	var times *fileTimes
+	type dirAttrs struct {
+		mode  os.FileMode
+		times *fileTimes
+	}
+	var attrs []dirAttrs
+	// scp does not announce the size of the tree up front.
+	p.beginTree(-1, -1)
 
 	if _, err := stdin.Write([]byte{0}); err != nil {
 		return fmt.Errorf("initial ack: %w", err)
@@ -349,7 +484,13 @@ func DownloadRecursive(client *ssh.Client, remotePath, localPath string) error {
 		case 0x01, 0x02:
 			return fmt.Errorf("scp remote error: %s", strings.TrimSpace(line[1:]))
 		case 'T':
-			// timestamps — ack and ignore (not requested, but tolerate)
+			if opts.Preserve {
+				t, err := parseTimes(line)
+				if err != nil {
+					return err
+				}
+				times = &t
+			}
 			if _, err := stdin.Write([]byte{0}); err != nil {
 				return fmt.Errorf("ack T: %w", err)
 			}
@@ -362,9 +503,15 @@ func DownloadRecursive(client *ssh.Client, remotePath, localPath string) error {
 			if _, err := stdin.Write([]byte{0}); err != nil {
 				return fmt.Errorf("header ack: %w", err)
 			}
-			if err := receiveFile(stdin, stdout, dst, mode, size); err != nil {
+			if err := receiveFile(stdin, stdout, dst, mode, size, p); err != nil {
 				return err
 			}
+			if times != nil {
+				if err := setLocal(dst, mode, *times); err != nil {
+					return err
+				}
+				times = nil
+			}
 		case 'D':
 			mode, _, name, err := parseCDLine(line)
 			if err != nil {
@@ -375,12 +522,20 @@ func DownloadRecursive(client *ssh.Client, remotePath, localPath string) error {
 				return fmt.Errorf("creating dir %s: %w", dst, err)
 			}
 			stack = append(stack, dst)
+			attrs = append(attrs, dirAttrs{mode, times})
+			times = nil
 			if _, err := stdin.Write([]byte{0}); err != nil {
 				return fmt.Errorf("dir ack: %w", err)
 			}
 		case 'E':
 			if len(stack) > 0 {
-				stack = stack[:len(stack)-1]
+				dir, a := stack[len(stack)-1], attrs[len(attrs)-1]
+				stack, attrs = stack[:len(stack)-1], attrs[:len(attrs)-1]
+				if a.times != nil {
+					if err := setLocal(dir, a.mode, *a.times); err != nil {
+						return err
+					}
+				}
 			}
 			if _, err := stdin.Write([]byte{0}); err != nil {
 				return fmt.Errorf("E ack: %w", err)
@@ -395,7 +550,7 @@ func DownloadRecursive(client *ssh.Client, remotePath, localPath string) error {
 		return fmt.Errorf("scp session: %w", err)
 	}
 
-	fmt.Println("done")
+	p.printf("done: %s\n", p.summary())
 	return nil
 }
 
@@ -409,13 +564,15 @@ func resolveDownloadTarget(stack []string, localPath string, localIsDir bool, na
 	return localPath
 }
 
-func receiveFile(stdin io.Writer, stdout io.Reader, dst string, mode os.FileMode, size int64) error {
-	fmt.Printf("  %s (%s)\n", dst, formatSize(size))
+func receiveFile(stdin io.Writer, stdout io.Reader, dst string, mode os.FileMode, size int64, p *progress) error {
 	f, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
 	if err != nil {
 		return fmt.Errorf("creating %s: %w", dst, err)
 	}
-	if _, err := io.CopyN(f, stdout, size); err != nil {
+	p.startFile(dst, size, 0)
+	_, err = io.CopyN(p.writer(f), stdout, size)
+	p.endFile()
+	if err != nil {
 		f.Close()
 		return fmt.Errorf("receiving %s: %w", dst, err)
 	}
@@ -429,6 +586,7 @@ func receiveFile(stdin io.Writer, stdout io.Reader, dst string, mode os.FileMode
 	if _, err := stdin.Write([]byte{0}); err != nil {
 		return fmt.Errorf("final ack: %w", err)
 	}
+	p.printf("  %s (%s)\n", dst, formatSize(size))
 	return nil
 }
 
@@ -481,17 +639,16 @@ func readLine(r io.Reader) (string, error) {
 	}
 }
 
-// parseHeader parses an SCP file header like "C0644 12345 file.txt".
-func parseHeader(header string) (size int64, filename string, err error) {
-	parts := strings.SplitN(header, " ", 3)
-	if len(parts) != 3 {
-		return 0, "", fmt.Errorf("invalid scp header: %q", header)
+// sendTimes sends the T record that has scp -p set the times of the file
+// or directory sent next.
+func sendTimes(stdin io.Writer, stdout io.Reader, path string, info os.FileInfo) error {
+	if _, err := io.WriteString(stdin, localTimes(path, info).record()); err != nil {
+		return fmt.Errorf("sending times for %s: %w", path, err)
 	}
-	n, err := strconv.ParseInt(parts[1], 10, 64)
-	if err != nil {
-		return 0, "", fmt.Errorf("invalid size in header: %w", err)
+	if err := readAck(stdout); err != nil {
+		return fmt.Errorf("times ack for %s: %w", path, err)
 	}
-	return n, parts[2], nil
+	return nil
 }
 
 // formatSize returns a human-readable file size.
@@ -1,25 +1,189 @@
 package ssh
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"strings"
 	"time"
 
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 )
 
-// Dial creates an SSH client connection with shared config (timeout, auth, host key).
-func Dial(host string, port int, user, password string) (*ssh.Client, error) {
+// Target describes a server to dial and the credentials to authenticate with.
+type Target struct {
+	Name     string
+	Host     string
+	Port     int
+	User     string
+	Password string
+	// PrivateKey is a PEM private key stored for this server, tried before
+	// any agent or default keys. Passphrase decrypts it if protected.
+	PrivateKey []byte
+	Passphrase string
+	// AgentKeys is one of the AgentKeys* modes.
+	AgentKeys string
+	// AuthMethods is the order in which auth methods are tried; empty
+	// means publickey, keyboard-interactive, password.
+	AuthMethods []string
+	// IdentityFiles are extra private key files to offer, after PrivateKey.
+	IdentityFiles []string
+	// IdentitiesOnly offers only PrivateKey, IdentityFiles and agent keys
+	// matching them — never the default ~/.ssh keys or other agent keys.
+	IdentitiesOnly bool
+
+	// KnownHosts verifies the server's host key on first contact.
+	KnownHosts *KnownHosts
+	// HostKeyAlgorithm and HostKeyFingerprint pin the host key from storage.
+	// When set, they take precedence over KnownHosts.
+	HostKeyAlgorithm   string
+	HostKeyFingerprint string
+	// PinHostKey is called after the first successful Dial of a target with
+	// no pinned fingerprint, so the caller can persist it.
+	PinHostKey func(algorithm, fingerprint string)
+	// HostKey is set by the first successful Dial. Later dials with the same
+	// Target only accept this exact key.
+	HostKey ssh.PublicKey
+
+	// Jump lists the hosts to tunnel through, in order. Each hop connects
+	// with its own credentials and host key checks.
+	Jump []*Target
+
+	// Forwards are port forwards that Connect runs alongside the shell.
+	Forwards []Forward
+}
+
+// Addr returns the "host:port" address of the target.
+func (t *Target) Addr() string {
+	return fmt.Sprintf("%s:%d", t.Host, t.Port)
+}
+
+const dialTimeout = 10 * time.Second
+
+// Dial creates an SSH client connection with shared config (timeout, auth,
+// host key), tunnelling through t.Jump if set. Closing the returned client
+// also closes every jump host connection.
+func Dial(t *Target) (*ssh.Client, error) {
+	var hops []*ssh.Client
+	closeHops := func() {
+		for i := len(hops) - 1; i >= 0; i-- {
+			hops[i].Close()
+		}
+	}
+
+	var via *ssh.Client
+	for _, hop := range t.Jump {
+		c, err := dialOne(via, hop)
+		if err != nil {
+			closeHops()
+			return nil, fmt.Errorf("jump host %s: %w", hop.Name, err)
+		}
+		hops = append(hops, c)
+		via = c
+	}
+
+	client, err := dialOne(via, t)
+	if err != nil {
+		closeHops()
+		return nil, err
+	}
+	if len(hops) > 0 {
+		go func() {
+			client.Wait()
+			closeHops()
+		}()
+	}
+	return client, nil
+}
+
+// isTransientDialError reports whether a failed Dial is worth retrying: the
+// network or a hop was unreachable, or the connection dropped mid-handshake.
+// Authentication failures, host key problems and local errors such as an
+// unreadable key are not.
+func isTransientDialError(err error) bool {
+	if err == nil || isHostKeyError(err) || isAuthError(err) {
+		return false
+	}
+	var netErr net.Error
+	var chanErr *ssh.OpenChannelError
+	return errors.As(err, &netErr) || errors.As(err, &chanErr) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// isAuthError reports whether err means the server rejected every offered
+// credential, or there was none to offer. The ssh package reports this
+// client-side as a plain error, so match its message.
+func isAuthError(err error) bool {
+	var authErr *ssh.ServerAuthError
+	return errors.As(err, &authErr) || strings.Contains(err.Error(), "ssh: unable to authenticate")
+}
+
+// dialOne connects to t directly, or through via when it is non-nil.
+func dialOne(via *ssh.Client, t *Target) (*ssh.Client, error) {
+	addr := t.Addr()
+	hostKeyCallback, hostKeyAlgos, err := t.hostKeyConfig(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// The agent connection must outlive authentication: agent signers only
+	// sign when the server accepts a key, through this connection.
+	var agentClient agent.ExtendedAgent
+	if t.AgentKeys != AgentKeysOff {
+		if conn := dialAgent(); conn != nil {
+			defer conn.Close()
+			agentClient = agent.NewClient(conn)
+		}
+	}
+
+	auth, err := authMethods(t, agentClient)
+	if err != nil {
+		return nil, err
+	}
+
 	config := &ssh.ClientConfig{
-		User:            user,
-		Auth:            authMethods(password),
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Timeout:         10 * time.Second,
+		User:              t.User,
+		Auth:              auth,
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: hostKeyAlgos,
+		Timeout:           dialTimeout,
 	}
 
-	addr := fmt.Sprintf("%s:%d", host, port)
-	client, err := ssh.Dial("tcp", addr, config)
+	client, err := dialClient(via, addr, config)
 	if err != nil {
 		return nil, fmt.Errorf("connecting to %s: %w", addr, err)
 	}
+	if t.HostKeyFingerprint == "" && t.HostKey != nil {
+		t.HostKeyAlgorithm = t.HostKey.Type()
+		t.HostKeyFingerprint = ssh.FingerprintSHA256(t.HostKey)
+		if t.PinHostKey != nil {
+			t.PinHostKey(t.HostKeyAlgorithm, t.HostKeyFingerprint)
+		}
+	}
 	return client, nil
 }
+
+// dialClient performs the SSH handshake with addr, over a direct TCP
+// connection or a channel tunnelled through via.
+func dialClient(via *ssh.Client, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	if via == nil {
+		return ssh.Dial("tcp", addr, config)
+	}
+
+	conn, err := via.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	// Tunnelled connections don't support deadlines, so enforce the
+	// handshake timeout by closing the channel.
+	timer := time.AfterFunc(config.Timeout, func() { conn.Close() })
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	timer.Stop()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
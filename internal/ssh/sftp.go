@@ -0,0 +1,474 @@
+package ssh
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+
+	"essh/internal/sftp"
+)
+
+// sftpTransfer copies files over an SFTP session.
+type sftpTransfer struct {
+	sc *sftp.Client
+	// client runs commands next to the session, such as hashing a partial
+	// file before resuming it.
+	client *ssh.Client
+	opts   TransferOptions
+	p      *progress
+}
+
+// remoteDir returns remotePath, or "." (the login directory) when it is
+// empty, as in "name:".
+func remoteDir(remotePath string) string {
+	if remotePath == "" {
+		return "."
+	}
+	return remotePath
+}
+
+// homePath returns p with a leading "~" or "~/" replaced by home.
+func homePath(home, p string) string {
+	if p == "~" {
+		return home
+	}
+	if strings.HasPrefix(p, "~/") {
+		return strings.TrimSuffix(home, "/") + p[1:]
+	}
+	return p
+}
+
+// sftpPath resolves a remote path from the command line for SFTP calls:
+// empty means the login directory, and a leading "~" or "~/" is expanded
+// against it, as the shell does for scp but SFTP servers do not.
+func sftpPath(sc *sftp.Client, remotePath string) (string, error) {
+	if remotePath != "~" && !strings.HasPrefix(remotePath, "~/") {
+		return remoteDir(remotePath), nil
+	}
+	home, err := sc.RealPath(".")
+	if err != nil {
+		return "", fmt.Errorf("resolving ~: %w", err)
+	}
+	return homePath(home, remotePath), nil
+}
+
+// remoteTarget returns where a transfer named name should land: inside
+// remotePath if that is an existing directory, remotePath itself otherwise.
+func remoteTarget(sc *sftp.Client, remotePath, name string) string {
+	remotePath = remoteDir(remotePath)
+	if fi, err := sc.Stat(remotePath); err == nil && fi.IsDir() {
+		return path.Join(remotePath, name)
+	}
+	return remotePath
+}
+
+// remoteBase returns the last element of remotePath, resolving paths such
+// as "." or "/srv/.." to a real name.
+func remoteBase(sc *sftp.Client, remotePath string) string {
+	base := path.Base(remotePath)
+	if base == "." || base == ".." || base == "/" {
+		if real, err := sc.RealPath(remotePath); err == nil && path.Base(real) != "/" {
+			return path.Base(real)
+		}
+	}
+	return base
+}
+
+// upload sends a local file to a remote path.
+func (x *sftpTransfer) upload(localPath, remotePath string) error {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return fmt.Errorf("stat local file: %w", err)
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory (use -r to upload recursively)", localPath)
+	}
+
+	remotePath, err = sftpPath(x.sc, remotePath)
+	if err != nil {
+		return err
+	}
+
+	x.p.printf("Uploading %s (%s)...", filepath.Base(localPath), formatSize(info.Size()))
+	dst := remoteTarget(x.sc, remotePath, filepath.Base(localPath))
+	offset, err := x.putFile(localPath, filepath.Base(localPath), dst, info.Size(), info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if err := x.keepRemote(localPath, dst, info); err != nil {
+		return err
+	}
+	x.p.printf("%s\n", resumeNote(offset, info.Size()))
+	return nil
+}
+
+// putFile copies localPath to the remote file dst, creating it with perm
+// and reporting progress under label. When resuming, a partial dst whose
+// content matches is continued instead; the offset the copy started at is
+// returned.
+func (x *sftpTransfer) putFile(localPath, label, dst string, size int64, perm fs.FileMode) (int64, error) {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return 0, fmt.Errorf("opening %s: %w", localPath, err)
+	}
+	defer f.Close()
+
+	var offset int64
+	if x.opts.Resume {
+		if fi, err := x.sc.Stat(dst); err == nil && fi.Mode().IsRegular() {
+			offset, err = resumeOffset(fi.Size(), size, func() (bool, error) {
+				return x.samePrefix(localPath, dst, fi.Size())
+			})
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	x.p.startFile(label, size, offset)
+	defer x.p.endFile()
+	if offset > 0 && offset == size {
+		return offset, nil
+	}
+
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if offset > 0 {
+		flag = os.O_WRONLY
+	}
+	rf, err := x.sc.OpenFile(dst, flag, perm)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		rf.Close()
+		return 0, err
+	}
+	if _, err := rf.Seek(offset, io.SeekStart); err != nil {
+		rf.Close()
+		return 0, err
+	}
+	if _, err := io.Copy(rf, x.p.reader(f)); err != nil {
+		rf.Close()
+		return 0, fmt.Errorf("sending file: %w", err)
+	}
+	if err := rf.Close(); err != nil {
+		return 0, err
+	}
+	return offset, nil
+}
+
+// uploadRecursive sends a local file or directory tree to a remote path.
+// Like scp, a directory is created inside remotePath if that is an
+// existing directory, or as remotePath otherwise.
+func (x *sftpTransfer) uploadRecursive(localPath, remotePath string) error {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return fmt.Errorf("stat local path: %w", err)
+	}
+	remotePath, err = sftpPath(x.sc, remotePath)
+	if err != nil {
+		return err
+	}
+	dst := remoteTarget(x.sc, remotePath, filepath.Base(localPath))
+
+	fl := x.opts.Filter.root(localReader(localPath))
+	x.p.beginTree(localTreeSize(localPath, fl))
+	if info.IsDir() {
+		x.p.printf("Uploading directory %s...\n", localPath)
+		if err := x.putDir(localPath, dst, info, fl); err != nil {
+			return err
+		}
+	} else {
+		x.p.printf("Uploading %s (%s)...\n", filepath.Base(localPath), formatSize(info.Size()))
+		if err := x.putTreeFile(localPath, dst, info); err != nil {
+			return err
+		}
+	}
+
+	x.p.printf("done: %s\n", x.p.summary())
+	return nil
+}
+
+func (x *sftpTransfer) putTreeFile(localPath, dst string, info fs.FileInfo) error {
+	offset, err := x.putFile(localPath, localPath, dst, info.Size(), info.Mode().Perm())
+	if err != nil {
+		return fmt.Errorf("sending %s: %w", localPath, err)
+	}
+	if err := x.keepRemote(localPath, dst, info); err != nil {
+		return err
+	}
+	x.p.printf("  %s (%s%s)\n", localPath, formatSize(info.Size()), treeNote(offset, info.Size()))
+	return nil
+}
+
+func (x *sftpTransfer) putDir(localPath, dst string, info fs.FileInfo, fl *dirFilter) error {
+	if err := x.sc.Mkdir(dst, info.Mode().Perm()); err != nil {
+		if fi, serr := x.sc.Stat(dst); serr != nil || !fi.IsDir() {
+			return fmt.Errorf("creating dir %s: %w", dst, err)
+		}
+	}
+
+	entries, err := os.ReadDir(localPath)
+	if err != nil {
+		return fmt.Errorf("reading dir %s: %w", localPath, err)
+	}
+
+	for _, e := range entries {
+		full := filepath.Join(localPath, e.Name())
+		target := path.Join(dst, e.Name())
+		if fl.excluded(e.Name(), e.IsDir()) {
+			continue
+		}
+		if e.Type()&fs.ModeSymlink != 0 && x.opts.Links {
+			if err := x.putLink(full, target); err != nil {
+				return err
+			}
+			continue
+		}
+		if !e.IsDir() && !e.Type().IsRegular() {
+			x.p.printf("  skipping non-regular: %s\n", full)
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			return fmt.Errorf("stat %s: %w", full, err)
+		}
+		if e.IsDir() {
+			err = x.putDir(full, target, fi, fl.enter(e.Name(), localReader(full)))
+		} else {
+			err = x.putTreeFile(full, target, fi)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// Set the directory's times last, as filling it changes them.
+	return x.keepRemote(localPath, dst, info)
+}
+
+// putLink recreates the local symlink localPath as dst.
+func (x *sftpTransfer) putLink(localPath, dst string) error {
+	target, err := os.Readlink(localPath)
+	if err != nil {
+		return fmt.Errorf("reading symlink %s: %w", localPath, err)
+	}
+	if err := replaceLink(x.sc, target, dst); err != nil {
+		return err
+	}
+	x.p.printf("  %s -> %s\n", localPath, target)
+	return nil
+}
+
+// keepRemote gives dst the permissions and times of localPath with -p.
+func (x *sftpTransfer) keepRemote(localPath, dst string, info fs.FileInfo) error {
+	if !x.opts.Preserve {
+		return nil
+	}
+	return setRemote(x.sc, dst, info.Mode().Perm(), localTimes(localPath, info))
+}
+
+// keepLocal gives dst the permissions and times of a remote file with -p.
+func (x *sftpTransfer) keepLocal(dst string, info fs.FileInfo) error {
+	if !x.opts.Preserve {
+		return nil
+	}
+	return setLocal(dst, info.Mode().Perm(), remoteTimes(info))
+}
+
+// download retrieves a remote file to a local path.
+func (x *sftpTransfer) download(remotePath, localPath string) error {
+	remotePath, err := sftpPath(x.sc, remotePath)
+	if err != nil {
+		return err
+	}
+	info, err := x.sc.Stat(remotePath)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory (use -r to download recursively)", remotePath)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", remotePath)
+	}
+
+	name := remoteBase(x.sc, remotePath)
+	if fi, err := os.Stat(localPath); err == nil && fi.IsDir() {
+		localPath = filepath.Join(localPath, name)
+	}
+
+	x.p.printf("Downloading %s (%s)...", name, formatSize(info.Size()))
+	offset, err := x.getFile(remotePath, name, localPath, info.Size(), info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if err := x.keepLocal(localPath, info); err != nil {
+		return err
+	}
+	x.p.printf("%s\n", resumeNote(offset, info.Size()))
+	return nil
+}
+
+// getFile copies the remote file remotePath to dst, creating it with perm
+// and reporting progress under label. When resuming, a partial dst whose
+// content matches is continued instead; the offset the copy started at is
+// returned.
+func (x *sftpTransfer) getFile(remotePath, label, dst string, size int64, perm fs.FileMode) (int64, error) {
+	var offset int64
+	if x.opts.Resume {
+		if fi, err := os.Stat(dst); err == nil && fi.Mode().IsRegular() {
+			offset, err = resumeOffset(fi.Size(), size, func() (bool, error) {
+				return x.samePrefix(dst, remotePath, fi.Size())
+			})
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	x.p.startFile(label, size, offset)
+	defer x.p.endFile()
+	if offset > 0 && offset == size {
+		return offset, nil
+	}
+
+	rf, err := x.sc.Open(remotePath)
+	if err != nil {
+		return 0, err
+	}
+	defer rf.Close()
+
+	flag := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if offset > 0 {
+		flag = os.O_WRONLY
+	}
+	f, err := os.OpenFile(dst, flag, perm)
+	if err != nil {
+		return 0, fmt.Errorf("creating %s: %w", dst, err)
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if _, err := rf.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if _, err := io.Copy(x.p.writer(f), rf); err != nil {
+		f.Close()
+		return 0, fmt.Errorf("receiving %s: %w", dst, err)
+	}
+	if err := f.Close(); err != nil {
+		return 0, fmt.Errorf("closing %s: %w", dst, err)
+	}
+	return offset, nil
+}
+
+// downloadRecursive retrieves a remote file or directory tree to a local
+// path, following symlinks like scp does unless they are recreated with
+// Links.
+func (x *sftpTransfer) downloadRecursive(remotePath, localPath string) error {
+	remotePath, err := sftpPath(x.sc, remotePath)
+	if err != nil {
+		return err
+	}
+	info, err := x.sc.Stat(remotePath)
+	if err != nil {
+		return err
+	}
+
+	dst := localPath
+	if fi, err := os.Stat(localPath); err == nil && fi.IsDir() {
+		dst = filepath.Join(localPath, remoteBase(x.sc, remotePath))
+	}
+
+	fl := x.opts.Filter.root(remoteReader(x.sc, remotePath))
+	x.p.beginTree(remoteTreeSize(x.sc, remotePath, info, x.opts.Links, fl))
+	switch {
+	case info.IsDir():
+		err = x.getDir(remotePath, dst, info, fl)
+	case info.Mode().IsRegular():
+		err = x.getTreeFile(remotePath, dst, info)
+	default:
+		err = fmt.Errorf("%s is not a regular file or directory", remotePath)
+	}
+	if err != nil {
+		return err
+	}
+
+	x.p.printf("done: %s\n", x.p.summary())
+	return nil
+}
+
+func (x *sftpTransfer) getTreeFile(remotePath, dst string, info fs.FileInfo) error {
+	offset, err := x.getFile(remotePath, dst, dst, info.Size(), info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if err := x.keepLocal(dst, info); err != nil {
+		return err
+	}
+	x.p.printf("  %s (%s%s)\n", dst, formatSize(info.Size()), treeNote(offset, info.Size()))
+	return nil
+}
+
+func (x *sftpTransfer) getDir(remotePath, dst string, info fs.FileInfo, fl *dirFilter) error {
+	if err := os.MkdirAll(dst, info.Mode().Perm()); err != nil {
+		return fmt.Errorf("creating dir %s: %w", dst, err)
+	}
+
+	entries, err := x.sc.ReadDir(remotePath)
+	if err != nil {
+		return err
+	}
+
+	for _, fi := range entries {
+		name := fi.Name()
+		full := path.Join(remotePath, name)
+		target := filepath.Join(dst, name)
+		if fl.excluded(name, fi.IsDir()) {
+			continue
+		}
+		if fi.Mode()&fs.ModeSymlink != 0 && x.opts.Links {
+			if err := x.getLink(full, target); err != nil {
+				return err
+			}
+			continue
+		}
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			if fi, err = x.sc.Stat(full); err != nil {
+				x.p.printf("  skipping broken symlink: %s\n", full)
+				continue
+			}
+		}
+		switch {
+		case fi.IsDir():
+			err = x.getDir(full, target, fi, fl.enter(name, remoteReader(x.sc, full)))
+		case fi.Mode().IsRegular():
+			err = x.getTreeFile(full, target, fi)
+		default:
+			x.p.printf("  skipping non-regular: %s\n", full)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return x.keepLocal(dst, info)
+}
+
+// getLink recreates the remote symlink remotePath as dst.
+func (x *sftpTransfer) getLink(remotePath, dst string) error {
+	target, err := x.sc.ReadLink(remotePath)
+	if err != nil {
+		return err
+	}
+	if err := replaceLocalLink(target, dst); err != nil {
+		return err
+	}
+	x.p.printf("  %s -> %s\n", dst, target)
+	return nil
+}
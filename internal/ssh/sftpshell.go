@@ -0,0 +1,757 @@
+package ssh
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+
+	"essh/internal/sftp"
+)
+
+// sftpShell is the state of an interactive SFTP session.
+type sftpShell struct {
+	sc     *sftp.Client
+	client *ssh.Client
+	name   string
+	home   string
+	cwd    string
+	term   *term.Terminal
+}
+
+// sftpCommand is one shell command. args excludes the command name.
+type sftpCommand struct {
+	name  string
+	usage string
+	help  string
+	run   func(s *sftpShell, args []string) error
+}
+
+var sftpCommands []sftpCommand
+
+func init() {
+	// Assigned in init because help refers back to the table.
+	sftpCommands = []sftpCommand{
+		{"ls", "ls [-l] [path]", "List a remote directory", (*sftpShell).ls},
+		{"cd", "cd [path]", "Change the remote directory (default: home)", (*sftpShell).cd},
+		{"pwd", "pwd", "Print the remote directory", (*sftpShell).pwd},
+		{"lcd", "lcd [path]", "Change the local directory (default: home)", (*sftpShell).lcd},
+		{"lpwd", "lpwd", "Print the local directory", (*sftpShell).lpwd},
+		{"get", "get [-r] <remote> [local]", "Download a file (-r: a directory)", (*sftpShell).get},
+		{"put", "put [-r] <local> [remote]", "Upload a file (-r: a directory)", (*sftpShell).put},
+		{"mkdir", "mkdir [-p] <path>...", "Create a remote directory (-p: with parents)", (*sftpShell).mkdir},
+		{"rm", "rm [-r] <path>...", "Remove remote files (-r: directories too)", (*sftpShell).rm},
+		{"chmod", "chmod <mode> <path>...", "Change permissions, e.g. chmod 644 file", (*sftpShell).chmod},
+		{"rename", "rename <old> <new>", "Rename or move a remote file", (*sftpShell).rename},
+		{"df", "df [path]", "Show disk usage of the remote file system", (*sftpShell).df},
+		{"help", "help", "Show this help", (*sftpShell).help},
+		{"exit", "exit", "Leave the shell (also quit, Ctrl+D)", nil},
+	}
+}
+
+// SFTPShell runs an interactive file-management shell on t over SFTP. When
+// stdin is not a terminal, commands are read one per line and the first
+// failing command ends the session with its error.
+func SFTPShell(t *Target) error {
+	client, err := Dial(t)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	sc, err := NewSFTP(client)
+	if err != nil {
+		return err
+	}
+	defer sc.Close()
+
+	home, err := sc.RealPath(".")
+	if err != nil {
+		return err
+	}
+	s := &sftpShell{
+		sc:     sc,
+		client: client,
+		name:   t.Name,
+		home:   home,
+		cwd:    home,
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return s.batch(os.Stdin)
+	}
+
+	fmt.Printf("Connected to %s. Type 'help' for commands.\n", t.Name)
+	s.term = term.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{ctrlCReader{os.Stdin}, os.Stdout}, "")
+	s.term.AutoCompleteCallback = s.autoComplete
+
+	for {
+		if w, h, err := term.GetSize(int(os.Stdout.Fd())); err == nil && w > 0 {
+			s.term.SetSize(w, h)
+		}
+		s.term.SetPrompt(s.prompt())
+
+		oldState, err := term.MakeRaw(fd)
+		if err != nil {
+			return fmt.Errorf("setting raw mode: %w", err)
+		}
+		line, err := s.term.ReadLine()
+		term.Restore(fd, oldState)
+		if err == io.EOF {
+			fmt.Println()
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		args, err := splitShellArgs(line)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			continue
+		}
+		if len(args) > 0 && (args[0] == "exit" || args[0] == "quit" || args[0] == "bye") {
+			return nil
+		}
+		if err := s.exec(args); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		}
+	}
+}
+
+// batch runs commands read from r until EOF or the first error.
+func (s *sftpShell) batch(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		args, err := splitShellArgs(line)
+		if err == nil && (args[0] == "exit" || args[0] == "quit" || args[0] == "bye") {
+			return nil
+		}
+		if err == nil {
+			err = s.exec(args)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// ctrlCReader turns Ctrl+C into Ctrl+U, so it clears the line being
+// edited instead of ending the session.
+type ctrlCReader struct {
+	r io.Reader
+}
+
+func (c ctrlCReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	for i := range p[:n] {
+		if p[i] == 0x03 {
+			p[i] = 0x15
+		}
+	}
+	return n, err
+}
+
+func (s *sftpShell) prompt() string {
+	dir := s.cwd
+	if dir == s.home {
+		dir = "~"
+	} else if strings.HasPrefix(dir, s.home+"/") && s.home != "/" {
+		dir = "~" + strings.TrimPrefix(dir, s.home)
+	}
+	return fmt.Sprintf("sftp %s:%s> ", s.name, dir)
+}
+
+func (s *sftpShell) exec(args []string) error {
+	if len(args) == 0 {
+		return nil
+	}
+	for _, c := range sftpCommands {
+		if c.name == args[0] && c.run != nil {
+			return c.run(s, args[1:])
+		}
+	}
+	return fmt.Errorf("unknown command %q — type 'help' for a list", args[0])
+}
+
+// remote resolves p against the remote working directory.
+func (s *sftpShell) remote(p string) string {
+	switch {
+	case p == "~" || strings.HasPrefix(p, "~/"):
+		return path.Clean(homePath(s.home, p))
+	case path.IsAbs(p):
+		return path.Clean(p)
+	}
+	return path.Join(s.cwd, p)
+}
+
+// flags splits leading single-letter options from args, rejecting any not
+// in allowed.
+func flags(args []string, allowed string) (map[byte]bool, []string, error) {
+	set := map[byte]bool{}
+	for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' {
+		for _, f := range []byte(args[0][1:]) {
+			if !strings.ContainsRune(allowed, rune(f)) {
+				return nil, nil, fmt.Errorf("unknown option -%c", f)
+			}
+			set[f] = true
+		}
+		args = args[1:]
+	}
+	return set, args, nil
+}
+
+func usageError(usage string) error {
+	return fmt.Errorf("usage: %s", usage)
+}
+
+func (s *sftpShell) ls(args []string) error {
+	opts, args, err := flags(args, "l")
+	if err != nil {
+		return err
+	}
+	if len(args) > 1 {
+		return usageError("ls [-l] [path]")
+	}
+	dir := s.cwd
+	if len(args) == 1 {
+		dir = s.remote(args[0])
+	}
+
+	fi, err := s.sc.Stat(dir)
+	if err != nil {
+		return err
+	}
+	entries := []fs.FileInfo{fi}
+	if fi.IsDir() {
+		if entries, err = s.sc.ReadDir(dir); err != nil {
+			return err
+		}
+	}
+
+	if opts['l'] {
+		sizeWidth := 1
+		for _, e := range entries {
+			sizeWidth = max(sizeWidth, len(strconv.FormatInt(e.Size(), 10)))
+		}
+		for _, e := range entries {
+			name := e.Name()
+			if e.Mode()&fs.ModeSymlink != 0 {
+				if target, err := s.sc.ReadLink(path.Join(dir, name)); err == nil {
+					name += " -> " + target
+				}
+			}
+			fmt.Printf("%s  %*d  %s  %s\n", e.Mode(), sizeWidth, e.Size(), formatModTime(e.ModTime()), name)
+		}
+		return nil
+	}
+
+	names := make([]string, len(entries))
+	for i, e := range entries {
+		names[i] = e.Name()
+		if e.IsDir() {
+			names[i] += "/"
+		}
+	}
+	fmt.Print(columns(names, s.width()))
+	return nil
+}
+
+// formatModTime formats t like ls -l: the time for recent files, the year
+// for older ones.
+func formatModTime(t time.Time) string {
+	if time.Since(t) > 180*24*time.Hour || time.Until(t) > time.Hour {
+		return t.Format("Jan _2  2006")
+	}
+	return t.Format("Jan _2 15:04")
+}
+
+// width returns the terminal width, or 80.
+func (s *sftpShell) width() int {
+	if w, _, err := term.GetSize(int(os.Stdout.Fd())); err == nil && w > 0 {
+		return w
+	}
+	return 80
+}
+
+// columns lays names out in columns, filling each column top to bottom.
+func columns(names []string, width int) string {
+	if len(names) == 0 {
+		return ""
+	}
+	colWidth := 0
+	for _, n := range names {
+		colWidth = max(colWidth, len(n)+2)
+	}
+	cols := max(width/colWidth, 1)
+	rows := (len(names) + cols - 1) / cols
+
+	var b strings.Builder
+	for r := 0; r < rows; r++ {
+		for c := 0; c < cols; c++ {
+			i := c*rows + r
+			if i >= len(names) {
+				break
+			}
+			if c == cols-1 || i+rows >= len(names) {
+				b.WriteString(names[i])
+			} else {
+				fmt.Fprintf(&b, "%-*s", colWidth, names[i])
+			}
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func (s *sftpShell) cd(args []string) error {
+	if len(args) > 1 {
+		return usageError("cd [path]")
+	}
+	dir := s.home
+	if len(args) == 1 {
+		dir = s.remote(args[0])
+	}
+	fi, err := s.sc.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	if real, err := s.sc.RealPath(dir); err == nil {
+		dir = real
+	}
+	s.cwd = dir
+	return nil
+}
+
+func (s *sftpShell) pwd(args []string) error {
+	fmt.Println(s.cwd)
+	return nil
+}
+
+func (s *sftpShell) lcd(args []string) error {
+	if len(args) > 1 {
+		return usageError("lcd [path]")
+	}
+	dir, err := os.UserHomeDir()
+	if len(args) == 1 {
+		dir, err = args[0], nil
+	}
+	if err != nil {
+		return err
+	}
+	return os.Chdir(dir)
+}
+
+func (s *sftpShell) lpwd(args []string) error {
+	dir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	fmt.Println(dir)
+	return nil
+}
+
+// transfer returns a transfer for a get or put command.
+func (s *sftpShell) transfer() *sftpTransfer {
+	var opts TransferOptions
+	return &sftpTransfer{sc: s.sc, client: s.client, opts: opts, p: newProgress(opts)}
+}
+
+func (s *sftpShell) get(args []string) error {
+	opts, args, err := flags(args, "r")
+	if err != nil {
+		return err
+	}
+	if len(args) < 1 || len(args) > 2 {
+		return usageError("get [-r] <remote> [local]")
+	}
+	local := "."
+	if len(args) == 2 {
+		local = args[1]
+	}
+	x := s.transfer()
+	defer x.p.close()
+	if opts['r'] {
+		return x.downloadRecursive(s.remote(args[0]), local)
+	}
+	return x.download(s.remote(args[0]), local)
+}
+
+func (s *sftpShell) put(args []string) error {
+	opts, args, err := flags(args, "r")
+	if err != nil {
+		return err
+	}
+	if len(args) < 1 || len(args) > 2 {
+		return usageError("put [-r] <local> [remote]")
+	}
+	remote := s.cwd
+	if len(args) == 2 {
+		remote = s.remote(args[1])
+	}
+	x := s.transfer()
+	defer x.p.close()
+	if opts['r'] {
+		return x.uploadRecursive(args[0], remote)
+	}
+	return x.upload(args[0], remote)
+}
+
+func (s *sftpShell) mkdir(args []string) error {
+	opts, args, err := flags(args, "p")
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return usageError("mkdir [-p] <path>...")
+	}
+	for _, a := range args {
+		if opts['p'] {
+			err = s.sc.MkdirAll(s.remote(a), 0755)
+		} else {
+			err = s.sc.Mkdir(s.remote(a), 0755)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sftpShell) rm(args []string) error {
+	opts, args, err := flags(args, "r")
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return usageError("rm [-r] <path>...")
+	}
+	for _, a := range args {
+		p := s.remote(a)
+		fi, err := s.sc.Lstat(p)
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			err = s.sc.Remove(p)
+		} else if opts['r'] {
+			err = s.sc.RemoveAll(p)
+		} else {
+			err = fmt.Errorf("%s is a directory (use rm -r)", p)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sftpShell) chmod(args []string) error {
+	if len(args) < 2 {
+		return usageError("chmod <mode> <path>...")
+	}
+	mode, err := strconv.ParseUint(args[0], 8, 32)
+	if err != nil || mode > 07777 {
+		return fmt.Errorf("invalid mode %q (use octal, e.g. 644)", args[0])
+	}
+	perm := fs.FileMode(mode & 0777)
+	if mode&04000 != 0 {
+		perm |= fs.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		perm |= fs.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		perm |= fs.ModeSticky
+	}
+	for _, a := range args[1:] {
+		if err := s.sc.Chmod(s.remote(a), perm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sftpShell) rename(args []string) error {
+	if len(args) != 2 {
+		return usageError("rename <old> <new>")
+	}
+	oldpath, newpath := s.remote(args[0]), s.remote(args[1])
+	// Like mv, renaming onto a directory moves into it.
+	if fi, err := s.sc.Stat(newpath); err == nil && fi.IsDir() {
+		newpath = path.Join(newpath, path.Base(oldpath))
+	}
+	return s.sc.Rename(oldpath, newpath)
+}
+
+func (s *sftpShell) df(args []string) error {
+	if len(args) > 1 {
+		return usageError("df [path]")
+	}
+	p := s.cwd
+	if len(args) == 1 {
+		p = s.remote(args[0])
+	}
+	st, err := s.sc.StatVFS(p)
+	if err != nil {
+		return err
+	}
+	used := st.Total() - st.Free()
+	pct := 0.0
+	// Like df, the percentage is of the space usable without privileges.
+	if used+st.Avail() > 0 {
+		pct = float64(used) * 100 / float64(used+st.Avail())
+	}
+	fmt.Printf("%10s  %10s  %10s  %4s  %10s  %10s\n", "Size", "Used", "Avail", "Use%", "Inodes", "IFree")
+	fmt.Printf("%10s  %10s  %10s  %3.0f%%  %10d  %10d\n",
+		formatSize(int64(st.Total())), formatSize(int64(used)), formatSize(int64(st.Avail())), pct, st.Files, st.FilesFree)
+	return nil
+}
+
+func (s *sftpShell) help(args []string) error {
+	for _, c := range sftpCommands {
+		fmt.Printf("  %-28s %s\n", c.usage, c.help)
+	}
+	return nil
+}
+
+// splitShellArgs splits a command line into words. Single and double
+// quotes group words, and a backslash escapes the next character.
+func splitShellArgs(line string) ([]string, error) {
+	var args []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, r := range line {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, inWord = true, true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inWord = r, true
+		case r == ' ' || r == '\t':
+			if inWord {
+				args = append(args, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, errors.New("unterminated quote")
+	}
+	if escaped {
+		return nil, errors.New("trailing backslash")
+	}
+	if inWord {
+		args = append(args, word.String())
+	}
+	return args, nil
+}
+
+// escapeShellArg escapes the characters splitShellArgs treats specially.
+func escapeShellArg(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(" \t\\'\"", r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// autoComplete is the terminal's completion callback: Tab completes the
+// command name or a local or remote path, and lists the candidates when the
+// completion is ambiguous.
+func (s *sftpShell) autoComplete(line string, pos int, key rune) (string, int, bool) {
+	if key != '\t' {
+		return "", 0, false
+	}
+
+	// The word being completed starts after the last unescaped space.
+	prefix := line[:pos]
+	start := 0
+	for i := 0; i < len(prefix); i++ {
+		switch prefix[i] {
+		case '\\':
+			i++
+		case ' ':
+			start = i + 1
+		}
+	}
+	words, err := splitShellArgs(prefix[:start])
+	if err != nil {
+		return "", 0, false
+	}
+	partial, err := splitShellArgs(prefix[start:])
+	if err != nil {
+		return "", 0, false
+	}
+	word := ""
+	if len(partial) > 0 {
+		word = partial[0]
+	}
+
+	var candidates []string
+	var dirPart string
+	if len(words) == 0 {
+		for _, c := range sftpCommands {
+			if strings.HasPrefix(c.name, word) {
+				candidates = append(candidates, c.name+" ")
+			}
+		}
+	} else {
+		dirPart, candidates = s.completePath(word, s.completesLocal(words), words[0] == "cd" || words[0] == "lcd")
+	}
+	if len(candidates) == 0 {
+		return "", 0, false
+	}
+
+	common := candidates[0]
+	for _, c := range candidates[1:] {
+		for !strings.HasPrefix(c, common) {
+			common = common[:len(common)-1]
+		}
+	}
+	base := strings.TrimPrefix(word, dirPart)
+	if len(candidates) > 1 && len(common) <= len(base) {
+		names := make([]string, len(candidates))
+		for i, c := range candidates {
+			names[i] = strings.TrimSuffix(c, " ")
+		}
+		s.term.Write([]byte(columns(names, s.width())))
+		return "", 0, false
+	}
+
+	replacement := escapeShellArg(dirPart + strings.TrimSuffix(common, " "))
+	if strings.HasSuffix(common, " ") {
+		replacement += " "
+	}
+	newLine := line[:start] + replacement + line[pos:]
+	return newLine, start + len(replacement), true
+}
+
+// completesLocal reports whether the next argument after words is a local
+// path: lcd's argument, put's source and get's destination.
+func (s *sftpShell) completesLocal(words []string) bool {
+	var args []string
+	for _, w := range words[1:] {
+		if !strings.HasPrefix(w, "-") {
+			args = append(args, w)
+		}
+	}
+	switch words[0] {
+	case "lcd":
+		return true
+	case "put":
+		return len(args) == 0
+	case "get":
+		return len(args) == 1
+	}
+	return false
+}
+
+// completePath returns the directory part of word and the entries of that
+// directory starting with the rest of word. Directories end in "/", other
+// entries in " ".
+func (s *sftpShell) completePath(word string, local, dirsOnly bool) (string, []string) {
+	dirPart := ""
+	if i := strings.LastIndex(word, "/"); i >= 0 {
+		dirPart = word[:i+1]
+	}
+	base := word[len(dirPart):]
+
+	type entry struct {
+		name  string
+		isDir bool
+	}
+	var entries []entry
+	if local {
+		dir := dirPart
+		if dir == "" {
+			dir = "."
+		}
+		des, err := os.ReadDir(filepath.FromSlash(dir))
+		if err != nil {
+			return dirPart, nil
+		}
+		for _, de := range des {
+			isDir := de.IsDir()
+			if de.Type()&fs.ModeSymlink != 0 {
+				if fi, err := os.Stat(filepath.Join(dir, de.Name())); err == nil {
+					isDir = fi.IsDir()
+				}
+			}
+			entries = append(entries, entry{de.Name(), isDir})
+		}
+	} else {
+		dir := s.cwd
+		if dirPart != "" {
+			dir = s.remote(dirPart)
+		}
+		fis, err := s.sc.ReadDir(dir)
+		if err != nil {
+			return dirPart, nil
+		}
+		for _, fi := range fis {
+			isDir := fi.IsDir()
+			if fi.Mode()&fs.ModeSymlink != 0 && strings.HasPrefix(fi.Name(), base) {
+				if st, err := s.sc.Stat(path.Join(dir, fi.Name())); err == nil {
+					isDir = st.IsDir()
+				}
+			}
+			entries = append(entries, entry{fi.Name(), isDir})
+		}
+	}
+
+	var candidates []string
+	for _, e := range entries {
+		if !strings.HasPrefix(e.name, base) || (strings.HasPrefix(e.name, ".") && !strings.HasPrefix(base, ".")) {
+			continue
+		}
+		switch {
+		case e.isDir:
+			candidates = append(candidates, e.name+"/")
+		case !dirsOnly:
+			candidates = append(candidates, e.name+" ")
+		}
+	}
+	sort.Strings(candidates)
+	return dirPart, candidates
+}
@@ -0,0 +1,277 @@
+package ssh
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// SOCKS protocol constants (RFC 1928 and the SOCKS4/4a conventions).
+const (
+	socks4Version = 4
+	socks5Version = 5
+
+	socksCmdConnect = 1
+
+	socks5AuthNone         = 0
+	socks5AuthNoAcceptable = 0xff
+
+	socks5AddrIPv4   = 1
+	socks5AddrDomain = 3
+	socks5AddrIPv6   = 4
+
+	socks5Succeeded           = 0
+	socks5GeneralFailure      = 1
+	socks5HostUnreachable     = 4
+	socks5CmdNotSupported     = 7
+	socks5AddrTypeUnsupported = 8
+
+	socks4Granted  = 0x5a
+	socks4Rejected = 0x5b
+)
+
+// socksHandshakeTimeout bounds how long a client may take to send its request.
+const socksHandshakeTimeout = 30 * time.Second
+
+// ParseDynamicForward parses "[bind:]port" for a SOCKS proxy. The bind
+// address defaults to 127.0.0.1.
+func ParseDynamicForward(spec string) (Forward, error) {
+	parts, err := splitForwardSpec(spec)
+	if err != nil {
+		return Forward{}, err
+	}
+	f := Forward{Dynamic: true, BindAddr: "127.0.0.1"}
+	switch len(parts) {
+	case 1:
+	case 2:
+		f.BindAddr = parts[0]
+		parts = parts[1:]
+	default:
+		return Forward{}, fmt.Errorf("invalid SOCKS address %q — expected [bind:]port", spec)
+	}
+	if f.BindPort, err = parsePort(parts[0], false); err != nil {
+		return Forward{}, fmt.Errorf("invalid SOCKS address %q: %w", spec, err)
+	}
+	return f, nil
+}
+
+// serveSocks accepts SOCKS4/4a/5 clients on ln and dials each requested
+// destination through the current client.
+func (fw *forwarder) serveSocks(ln net.Listener, f Forward) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			if err := fw.handleSocks(conn); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\r\n", f, err)
+			}
+		}()
+	}
+}
+
+// handleSocks runs one SOCKS session: it reads the request, dials the
+// destination through the SSH connection, replies, and then relays data.
+func (fw *forwarder) handleSocks(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+
+	var version [1]byte
+	if _, err := io.ReadFull(conn, version[:]); err != nil {
+		return err
+	}
+
+	var dest string
+	var err error
+	switch version[0] {
+	case socks5Version:
+		dest, err = socks5Request(conn)
+	case socks4Version:
+		dest, err = socks4Request(conn)
+	default:
+		return fmt.Errorf("unsupported SOCKS version %d", version[0])
+	}
+	if err != nil {
+		return err
+	}
+
+	remote, err := fw.dial(dest)
+	if err != nil {
+		socksReply(conn, version[0], err)
+		return fmt.Errorf("%s: %w", dest, err)
+	}
+	defer remote.Close()
+	if err := socksReply(conn, version[0], nil); err != nil {
+		return err
+	}
+
+	conn.SetDeadline(time.Time{})
+	pipe(conn, remote)
+	return nil
+}
+
+// errNotConnected is returned when no connection came back in time to
+// serve a forwarded connection.
+var errNotConnected = errors.New("not connected")
+
+// dial connects to addr through the current client.
+func (fw *forwarder) dial(addr string) (net.Conn, error) {
+	client := fw.get(dialTimeout)
+	if client == nil {
+		return nil, errNotConnected
+	}
+	return client.Dial("tcp", addr)
+}
+
+// socks5Request negotiates authentication (none only) and reads a CONNECT
+// request, returning its destination. Unsupported requests are answered
+// with the matching error reply.
+func socks5Request(conn net.Conn) (string, error) {
+	var n [1]byte
+	if _, err := io.ReadFull(conn, n[:]); err != nil {
+		return "", err
+	}
+	methods := make([]byte, n[0])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	method := byte(socks5AuthNoAcceptable)
+	for _, m := range methods {
+		if m == socks5AuthNone {
+			method = socks5AuthNone
+		}
+	}
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return "", err
+	}
+	if method != socks5AuthNone {
+		return "", errors.New("client offered no supported auth method")
+	}
+
+	var hdr [4]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return "", err
+	}
+	if hdr[0] != socks5Version {
+		return "", fmt.Errorf("unexpected SOCKS version %d in request", hdr[0])
+	}
+
+	var host string
+	switch hdr[3] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		size := net.IPv4len
+		if hdr[3] == socks5AddrIPv6 {
+			size = net.IPv6len
+		}
+		ip := make(net.IP, size)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socks5AddrDomain:
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return "", err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		conn.Write(socks5Reply(socks5AddrTypeUnsupported))
+		return "", fmt.Errorf("unsupported address type %d", hdr[3])
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(conn, port[:]); err != nil {
+		return "", err
+	}
+	if hdr[1] != socksCmdConnect {
+		conn.Write(socks5Reply(socks5CmdNotSupported))
+		return "", fmt.Errorf("unsupported command %d", hdr[1])
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// socks4Request reads a SOCKS4 or SOCKS4a CONNECT request (after the version
+// byte) and returns its destination.
+func socks4Request(conn net.Conn) (string, error) {
+	var hdr [7]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return "", err
+	}
+	// The user ID is ignored: access is already limited by the bind address.
+	if _, err := readNullTerminated(conn); err != nil {
+		return "", err
+	}
+	if hdr[0] != socksCmdConnect {
+		conn.Write(socks4Reply(socks4Rejected))
+		return "", fmt.Errorf("unsupported command %d", hdr[0])
+	}
+
+	port := strconv.Itoa(int(binary.BigEndian.Uint16(hdr[1:3])))
+	ip := net.IP(hdr[3:7])
+	// SOCKS4a: an address of 0.0.0.x (x != 0) means a hostname follows.
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		host, err := readNullTerminated(conn)
+		if err != nil {
+			return "", err
+		}
+		return net.JoinHostPort(host, port), nil
+	}
+	return net.JoinHostPort(ip.String(), port), nil
+}
+
+// readNullTerminated reads a NUL-terminated string of at most 255 bytes.
+func readNullTerminated(r io.Reader) (string, error) {
+	var buf []byte
+	var b [1]byte
+	for {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return "", err
+		}
+		if b[0] == 0 {
+			return string(buf), nil
+		}
+		if len(buf) == 255 {
+			return "", errors.New("SOCKS4 field too long")
+		}
+		buf = append(buf, b[0])
+	}
+}
+
+// socksReply tells the client whether its CONNECT succeeded.
+func socksReply(conn net.Conn, version byte, dialErr error) error {
+	var reply []byte
+	if version == socks4Version {
+		reply = socks4Reply(socks4Granted)
+		if dialErr != nil {
+			reply = socks4Reply(socks4Rejected)
+		}
+	} else {
+		reply = socks5Reply(socks5Succeeded)
+		if errors.Is(dialErr, errNotConnected) {
+			reply = socks5Reply(socks5GeneralFailure)
+		} else if dialErr != nil {
+			reply = socks5Reply(socks5HostUnreachable)
+		}
+	}
+	_, err := conn.Write(reply)
+	return err
+}
+
+// socks5Reply builds a reply with an unspecified IPv4 bound address; the
+// address the server used is not known on this side of the tunnel.
+func socks5Reply(code byte) []byte {
+	return []byte{socks5Version, code, 0, socks5AddrIPv4, 0, 0, 0, 0, 0, 0}
+}
+
+func socks4Reply(code byte) []byte {
+	return []byte{0, code, 0, 0, 0, 0, 0, 0}
+}
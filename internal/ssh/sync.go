@@ -0,0 +1,789 @@
+package ssh
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"essh/internal/sftp"
+)
+
+const (
+	// deltaBlockSize is the block size for delta transfers. Each block
+	// costs a sha256sum process on the server, so it is kept large.
+	deltaBlockSize = 1 << 20
+	// deltaMinSize is the smallest changed file sent as a delta; below it
+	// hashing costs more than it saves.
+	deltaMinSize = 4 * deltaBlockSize
+	// maxHashCommand caps the length of a batched remote hash command.
+	maxHashCommand = 64 * 1024
+)
+
+// SyncOptions control SyncUpload and SyncDownload.
+type SyncOptions struct {
+	// Checksum compares files of equal size by content instead of by
+	// modification time.
+	Checksum bool
+	// Delete removes destination files that are not in the source.
+	Delete bool
+	// DryRun prints what would change without changing anything.
+	DryRun bool
+	// Quiet suppresses progress and per-file messages.
+	Quiet bool
+}
+
+// SyncUpload makes the remote directory remotePath a copy of the local
+// directory localPath, sending only files that differ.
+func SyncUpload(client *ssh.Client, localPath, remotePath string, opts SyncOptions) error {
+	sc, err := NewSFTP(client)
+	if err != nil {
+		return fmt.Errorf("sync needs SFTP: %w", err)
+	}
+	defer sc.Close()
+	root, home, err := remoteSyncRoot(sc, remotePath)
+	if err != nil {
+		return err
+	}
+	if opts.Delete {
+		if err := checkRemoteDeleteRoot(root, home); err != nil {
+			return err
+		}
+	}
+	s := &syncer{
+		src:    &localTree{root: localPath},
+		dst:    &remoteTree{sc: sc, client: client, root: root},
+		upload: true,
+		opts:   opts,
+	}
+	return s.run()
+}
+
+// SyncDownload makes the local directory localPath a copy of the remote
+// directory remotePath, receiving only files that differ.
+func SyncDownload(client *ssh.Client, remotePath, localPath string, opts SyncOptions) error {
+	sc, err := NewSFTP(client)
+	if err != nil {
+		return fmt.Errorf("sync needs SFTP: %w", err)
+	}
+	defer sc.Close()
+	root, _, err := remoteSyncRoot(sc, remotePath)
+	if err != nil {
+		return err
+	}
+	if opts.Delete {
+		if err := checkLocalDeleteRoot(localPath); err != nil {
+			return err
+		}
+	}
+	s := &syncer{
+		src:  &remoteTree{sc: sc, client: client, root: root},
+		dst:  &localTree{root: localPath},
+		opts: opts,
+	}
+	return s.run()
+}
+
+// errDeleteRoot refuses Delete for a destination that is a home or root
+// directory, where everything not in the source would be removed.
+func errDeleteRoot(dir, what string) error {
+	return fmt.Errorf("refusing to sync with --delete into %s (%s): name a dedicated directory instead", dir, what)
+}
+
+// remoteSyncRoot resolves remotePath, after expanding "~", to the absolute
+// directory a sync works in, so that SFTP, the hashing commands run in it
+// and the --delete check all mean the same directory. It also returns the
+// login directory. A root that does not exist yet is made absolute without
+// resolving symlinks.
+func remoteSyncRoot(sc *sftp.Client, remotePath string) (root, home string, err error) {
+	home, err = sc.RealPath(".")
+	if err != nil {
+		return "", "", fmt.Errorf("resolving the home directory: %w", err)
+	}
+	root = homePath(home, remoteDir(remotePath))
+	if !path.IsAbs(root) {
+		root = path.Join(home, root)
+	}
+	root = path.Clean(root)
+	if real, err := sc.RealPath(root); err == nil {
+		root = real
+	}
+	return root, home, nil
+}
+
+// checkRemoteDeleteRoot returns an error if the resolved sync root is the
+// login directory or /.
+func checkRemoteDeleteRoot(root, home string) error {
+	switch root {
+	case "/":
+		return errDeleteRoot(root, "the root directory")
+	case home:
+		return errDeleteRoot(root, "the home directory")
+	}
+	return nil
+}
+
+// checkLocalDeleteRoot is checkRemoteDeleteRoot for a local destination.
+func checkLocalDeleteRoot(localPath string) error {
+	abs, err := filepath.Abs(localPath)
+	if err != nil {
+		return err
+	}
+	if real, err := filepath.EvalSymlinks(abs); err == nil {
+		abs = real
+	}
+	if abs == filepath.VolumeName(abs)+string(filepath.Separator) {
+		return errDeleteRoot(localPath, "the root directory")
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		if real, err := filepath.EvalSymlinks(home); err == nil {
+			home = real
+		}
+		if abs == home {
+			return errDeleteRoot(localPath, "the home directory")
+		}
+	}
+	return nil
+}
+
+// syncEntry is a file or directory in a synced tree.
+type syncEntry struct {
+	mode  fs.FileMode
+	size  int64
+	mtime time.Time
+}
+
+func entryOf(fi fs.FileInfo) syncEntry {
+	return syncEntry{mode: fi.Mode(), size: fi.Size(), mtime: fi.ModTime()}
+}
+
+// syncFile is an open file on either side of a sync.
+type syncFile interface {
+	io.ReadWriteCloser
+	io.ReaderAt
+	io.WriterAt
+	Truncate(size int64) error
+}
+
+// syncTree is one side of a sync. Paths are relative to the root and
+// slash-separated.
+type syncTree interface {
+	// String describes the root for messages.
+	String() string
+	// list returns every entry below the root, or nil if the root does
+	// not exist.
+	list() (map[string]syncEntry, error)
+	open(rel string) (syncFile, error)
+	// create opens rel for writing, truncating it unless keep is set.
+	create(rel string, perm fs.FileMode, keep bool) (syncFile, error)
+	mkdir(rel string, perm fs.FileMode) error
+	remove(rel string, e syncEntry) error
+	// finish gives a copied file the permissions and modification time
+	// of its source.
+	finish(rel string, e syncEntry) error
+	// hashes returns the SHA-256 of each file, "" for files that cannot
+	// be read.
+	hashes(rels []string) ([]string, error)
+	// blockHashes returns the SHA-256 of each deltaBlockSize block of rel.
+	blockHashes(rel string) ([]string, error)
+}
+
+// localTree is a local directory.
+type localTree struct {
+	root string
+}
+
+func (t *localTree) String() string { return t.root }
+
+func (t *localTree) path(rel string) string {
+	if rel == "" {
+		return t.root
+	}
+	return filepath.Join(t.root, filepath.FromSlash(rel))
+}
+
+func (t *localTree) list() (map[string]syncEntry, error) {
+	fi, err := os.Stat(t.root)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", t.root)
+	}
+	entries := map[string]syncEntry{}
+	err = filepath.WalkDir(t.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == t.root {
+			return nil
+		}
+		rel, err := filepath.Rel(t.root, p)
+		if err != nil {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		entries[filepath.ToSlash(rel)] = entryOf(fi)
+		return nil
+	})
+	return entries, err
+}
+
+func (t *localTree) open(rel string) (syncFile, error) {
+	return os.Open(t.path(rel))
+}
+
+func (t *localTree) create(rel string, perm fs.FileMode, keep bool) (syncFile, error) {
+	flag := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	if keep {
+		flag = os.O_RDWR
+	}
+	return os.OpenFile(t.path(rel), flag, perm)
+}
+
+func (t *localTree) mkdir(rel string, perm fs.FileMode) error {
+	return os.MkdirAll(t.path(rel), perm)
+}
+
+func (t *localTree) remove(rel string, e syncEntry) error {
+	if e.mode.IsDir() {
+		return os.RemoveAll(t.path(rel))
+	}
+	return os.Remove(t.path(rel))
+}
+
+func (t *localTree) finish(rel string, e syncEntry) error {
+	if err := os.Chmod(t.path(rel), e.mode.Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(t.path(rel), e.mtime, e.mtime)
+}
+
+func (t *localTree) hashes(rels []string) ([]string, error) {
+	sums := make([]string, len(rels))
+	for i, rel := range rels {
+		if fi, err := os.Stat(t.path(rel)); err == nil {
+			sums[i], _ = localPrefixHash(t.path(rel), fi.Size())
+		}
+	}
+	return sums, nil
+}
+
+func (t *localTree) blockHashes(rel string) ([]string, error) {
+	f, err := os.Open(t.path(rel))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var sums []string
+	buf := make([]byte, deltaBlockSize)
+	for {
+		n, err := io.ReadFull(f, buf)
+		if n > 0 {
+			sum := sha256.Sum256(buf[:n])
+			sums = append(sums, hex.EncodeToString(sum[:]))
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return sums, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// remoteTree is a directory on the server, read and written over SFTP and
+// hashed with commands run next to the session.
+type remoteTree struct {
+	sc     *sftp.Client
+	client *ssh.Client
+	root   string
+}
+
+func (t *remoteTree) String() string { return t.root }
+
+func (t *remoteTree) path(rel string) string {
+	return path.Join(t.root, rel)
+}
+
+func (t *remoteTree) list() (map[string]syncEntry, error) {
+	fi, err := t.sc.Stat(t.root)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", t.root)
+	}
+	entries := map[string]syncEntry{}
+	var walk func(rel string) error
+	walk = func(rel string) error {
+		list, err := t.sc.ReadDir(t.path(rel))
+		if err != nil {
+			return err
+		}
+		for _, fi := range list {
+			r := path.Join(rel, fi.Name())
+			entries[r] = entryOf(fi)
+			if fi.IsDir() {
+				if err := walk(r); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return entries, walk("")
+}
+
+func (t *remoteTree) open(rel string) (syncFile, error) {
+	return t.sc.Open(t.path(rel))
+}
+
+func (t *remoteTree) create(rel string, perm fs.FileMode, keep bool) (syncFile, error) {
+	flag := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	if keep {
+		flag = os.O_RDWR
+	}
+	return t.sc.OpenFile(t.path(rel), flag, perm)
+}
+
+func (t *remoteTree) mkdir(rel string, perm fs.FileMode) error {
+	return t.sc.MkdirAll(t.path(rel), perm)
+}
+
+func (t *remoteTree) remove(rel string, e syncEntry) error {
+	if e.mode.IsDir() {
+		return t.sc.RemoveAll(t.path(rel))
+	}
+	return t.sc.Remove(t.path(rel))
+}
+
+func (t *remoteTree) finish(rel string, e syncEntry) error {
+	if err := t.sc.Chmod(t.path(rel), e.mode.Perm()); err != nil {
+		return err
+	}
+	return t.sc.Chtimes(t.path(rel), e.mtime, e.mtime)
+}
+
+func (t *remoteTree) hashes(rels []string) ([]string, error) {
+	sums := make([]string, 0, len(rels))
+	for len(rels) > 0 {
+		var cmd strings.Builder
+		fmt.Fprintf(&cmd, "cd %s && for f in", shellQuote(t.root))
+		n := 0
+		for n < len(rels) && (n == 0 || cmd.Len() < maxHashCommand) {
+			cmd.WriteString(" " + shellQuote(rels[n]))
+			n++
+		}
+		cmd.WriteString(`; do { sha256sum < "$f" || shasum -a 256 < "$f"; } 2>/dev/null || echo -; done`)
+		out, err := runOutput(t.client, cmd.String())
+		if err != nil {
+			return nil, fmt.Errorf("hashing files on the server: %w", err)
+		}
+		lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+		if len(lines) != n {
+			return nil, fmt.Errorf("hashing files on the server: got %d results for %d files", len(lines), n)
+		}
+		for _, line := range lines {
+			sums = append(sums, hashField(line))
+		}
+		rels = rels[n:]
+	}
+	return sums, nil
+}
+
+func (t *remoteTree) blockHashes(rel string) ([]string, error) {
+	out, err := runOutput(t.client, fmt.Sprintf("split -b %d --filter=sha256sum < %s", deltaBlockSize, shellQuote(t.path(rel))))
+	if err != nil {
+		return nil, fmt.Errorf("hashing %s on the server: %w", rel, err)
+	}
+	var sums []string
+	sc := bufio.NewScanner(strings.NewReader(out))
+	for sc.Scan() {
+		sum := hashField(sc.Text())
+		if sum == "" {
+			return nil, fmt.Errorf("hashing %s on the server: unexpected output %q", rel, sc.Text())
+		}
+		sums = append(sums, sum)
+	}
+	return sums, nil
+}
+
+// hashField returns the hex digest at the start of a sha256sum output
+// line, or "" if there is none.
+func hashField(line string) string {
+	fields := strings.Fields(line)
+	if len(fields) == 0 || len(fields[0]) != sha256.Size*2 {
+		return ""
+	}
+	return fields[0]
+}
+
+// syncAction is one change to the destination. op is '+' for a new file
+// or directory, '~' for a changed file and '-' for a deletion.
+type syncAction struct {
+	op  byte
+	rel string
+	// e is the source entry, or the destination entry for deletions.
+	e syncEntry
+	// replace is the destination entry of another type that has to be
+	// removed first.
+	replace *syncEntry
+}
+
+// syncer compares two trees and copies the differences.
+type syncer struct {
+	src, dst syncTree
+	upload   bool
+	opts     SyncOptions
+	p        *progress
+}
+
+func (s *syncer) run() error {
+	s.p = newProgress(TransferOptions{Quiet: s.opts.Quiet})
+	defer s.p.close()
+
+	src, err := s.src.list()
+	if err != nil {
+		return err
+	}
+	if src == nil {
+		return fmt.Errorf("%s: no such directory", s.src)
+	}
+	dst, err := s.dst.list()
+	if err != nil {
+		return err
+	}
+
+	actions, unchanged, err := s.plan(src, dst)
+	if err != nil {
+		return err
+	}
+
+	var files int
+	var bytes int64
+	var deletes int
+	for _, a := range actions {
+		switch {
+		case a.op == '-':
+			deletes++
+		case a.e.mode.IsRegular():
+			files++
+			bytes += a.e.size
+		}
+	}
+
+	if s.opts.DryRun {
+		for _, a := range actions {
+			s.p.printf("%s\n", a)
+		}
+		s.p.printf("Dry run: would copy %d (%s), delete %d; %d unchanged\n", files, formatSize(bytes), deletes, unchanged)
+		return nil
+	}
+
+	if dst == nil {
+		if err := s.dst.mkdir("", 0755); err != nil {
+			return fmt.Errorf("creating %s: %w", s.dst, err)
+		}
+	}
+	s.p.beginTree(files, bytes)
+	for _, a := range actions {
+		if err := s.apply(a); err != nil {
+			return err
+		}
+	}
+	s.p.printf("Synced: copied %d, deleted %d, %d unchanged; %s %s in %s\n",
+		files, deletes, unchanged, formatSize(s.p.moved), s.verb(), time.Since(s.p.start).Round(100*time.Millisecond))
+	return nil
+}
+
+// verb describes the direction of the data.
+func (s *syncer) verb() string {
+	if s.upload {
+		return "sent"
+	}
+	return "received"
+}
+
+func (a syncAction) String() string {
+	switch {
+	case a.op == '-' && a.e.mode.IsDir():
+		return fmt.Sprintf("  - %s/", a.rel)
+	case a.op == '-':
+		return fmt.Sprintf("  - %s", a.rel)
+	case a.e.mode.IsDir():
+		return fmt.Sprintf("  + %s/", a.rel)
+	}
+	return fmt.Sprintf("  %c %s (%s)", a.op, a.rel, formatSize(a.e.size))
+}
+
+// plan lists the changes that make dst match src, parents before their
+// children, and counts the files that are already the same.
+func (s *syncer) plan(src, dst map[string]syncEntry) ([]syncAction, int, error) {
+	rels := make([]string, 0, len(src))
+	for rel := range src {
+		rels = append(rels, rel)
+	}
+	sort.Strings(rels)
+
+	// Files whose size and time differ are copied without looking
+	// further; with Checksum, files of equal size are hashed.
+	same := map[string]bool{}
+	var candidates []string
+	for _, rel := range rels {
+		e, d := src[rel], dst[rel]
+		if !e.mode.IsRegular() || !d.mode.IsRegular() || e.size != d.size {
+			continue
+		}
+		if !s.opts.Checksum {
+			same[rel] = e.mtime.Unix() == d.mtime.Unix()
+			continue
+		}
+		candidates = append(candidates, rel)
+	}
+	if len(candidates) > 0 {
+		srcSums, err := s.src.hashes(candidates)
+		if err != nil {
+			return nil, 0, err
+		}
+		dstSums, err := s.dst.hashes(candidates)
+		if err != nil {
+			return nil, 0, err
+		}
+		for i, rel := range candidates {
+			same[rel] = srcSums[i] != "" && srcSums[i] == dstSums[i]
+		}
+	}
+
+	var actions []syncAction
+	unchanged := 0
+	// skipped holds source paths that are not copied, so that their
+	// counterparts are not deleted either.
+	skipped := map[string]bool{}
+	for _, rel := range rels {
+		e := src[rel]
+		if !e.mode.IsDir() && !e.mode.IsRegular() {
+			s.p.printf("  skipping %s: %s\n", describeType(e.mode), rel)
+			skipped[rel] = true
+			continue
+		}
+		d, exists := dst[rel]
+		a := syncAction{op: '+', rel: rel, e: e}
+		switch {
+		case !exists:
+		case e.mode.IsDir() && d.mode.IsDir():
+			continue
+		case e.mode.IsRegular() && d.mode.IsRegular():
+			if same[rel] {
+				unchanged++
+				continue
+			}
+			a.op = '~'
+		default:
+			a.replace = &d
+		}
+		actions = append(actions, a)
+	}
+
+	if s.opts.Delete {
+		var extra []string
+		for rel := range dst {
+			if _, ok := src[rel]; !ok && !skipped[rel] {
+				extra = append(extra, rel)
+			}
+		}
+		sort.Strings(extra)
+		gone := map[string]bool{}
+		for _, rel := range extra {
+			if removedWith(rel, gone) {
+				continue
+			}
+			gone[rel] = true
+			actions = append(actions, syncAction{op: '-', rel: rel, e: dst[rel]})
+		}
+	}
+	return actions, unchanged, nil
+}
+
+// removedWith reports whether a parent directory of rel is in gone.
+func removedWith(rel string, gone map[string]bool) bool {
+	for dir := path.Dir(rel); dir != "."; dir = path.Dir(dir) {
+		if gone[dir] {
+			return true
+		}
+	}
+	return false
+}
+
+// describeType names the kind of file a mode describes.
+func describeType(mode fs.FileMode) string {
+	switch {
+	case mode&fs.ModeSymlink != 0:
+		return "symlink"
+	case mode&fs.ModeNamedPipe != 0:
+		return "named pipe"
+	case mode&fs.ModeSocket != 0:
+		return "socket"
+	case mode&fs.ModeDevice != 0:
+		return "device"
+	}
+	return "non-regular file"
+}
+
+// apply carries out an action on the destination.
+func (s *syncer) apply(a syncAction) error {
+	if a.op == '-' {
+		if err := s.dst.remove(a.rel, a.e); err != nil {
+			return fmt.Errorf("removing %s: %w", a.rel, err)
+		}
+		s.p.printf("%s\n", a)
+		return nil
+	}
+	if a.replace != nil {
+		if err := s.dst.remove(a.rel, *a.replace); err != nil {
+			return fmt.Errorf("removing %s: %w", a.rel, err)
+		}
+	}
+	if a.e.mode.IsDir() {
+		if err := s.dst.mkdir(a.rel, a.e.mode.Perm()); err != nil {
+			return fmt.Errorf("creating %s: %w", a.rel, err)
+		}
+		s.p.printf("%s\n", a)
+		return nil
+	}
+
+	note := ""
+	done := false
+	if a.op == '~' && a.e.size >= deltaMinSize {
+		sent, ok, err := s.delta(a)
+		if err != nil {
+			return err
+		}
+		if ok {
+			done = true
+			note = fmt.Sprintf(", delta: %s %s", formatSize(sent), s.verb())
+		}
+	}
+	if !done {
+		if err := s.copyFile(a); err != nil {
+			return err
+		}
+	}
+	if err := s.dst.finish(a.rel, a.e); err != nil {
+		return fmt.Errorf("setting attributes of %s: %w", a.rel, err)
+	}
+	s.p.printf("  %c %s (%s%s)\n", a.op, a.rel, formatSize(a.e.size), note)
+	return nil
+}
+
+// copyFile copies a whole file.
+func (s *syncer) copyFile(a syncAction) error {
+	in, err := s.src.open(a.rel)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := s.dst.create(a.rel, a.e.mode.Perm(), false)
+	if err != nil {
+		return err
+	}
+
+	s.p.startFile(a.rel, a.e.size, 0)
+	// Wrap the local side so io.Copy still uses the SFTP file's
+	// pipelined ReadFrom or WriteTo.
+	if s.upload {
+		_, err = io.Copy(out, s.p.reader(in))
+	} else {
+		_, err = io.Copy(s.p.writer(out), in)
+	}
+	s.p.endFile()
+	if err != nil {
+		out.Close()
+		return fmt.Errorf("copying %s: %w", a.rel, err)
+	}
+	return out.Close()
+}
+
+// delta updates a changed file in place by copying only the blocks whose
+// hashes differ, then checks the whole file. It reports false, having
+// possibly left the file half updated, when the server cannot hash blocks
+// or the result does not match; the caller then copies the whole file.
+func (s *syncer) delta(a syncAction) (sent int64, ok bool, err error) {
+	have, err := s.dst.blockHashes(a.rel)
+	if err != nil {
+		return 0, false, nil
+	}
+	want, err := s.src.blockHashes(a.rel)
+	if err != nil {
+		return 0, false, nil
+	}
+
+	in, err := s.src.open(a.rel)
+	if err != nil {
+		return 0, false, err
+	}
+	defer in.Close()
+	out, err := s.dst.create(a.rel, a.e.mode.Perm(), true)
+	if err != nil {
+		return 0, false, err
+	}
+
+	s.p.startFile(a.rel, a.e.size, 0)
+	buf := make([]byte, deltaBlockSize)
+	for i, sum := range want {
+		off := int64(i) * deltaBlockSize
+		n := min(deltaBlockSize, a.e.size-off)
+		if i < len(have) && have[i] == sum {
+			s.p.skip(n)
+			continue
+		}
+		if _, err = in.ReadAt(buf[:n], off); err != nil && err != io.EOF {
+			break
+		}
+		if _, err = out.WriteAt(buf[:n], off); err != nil {
+			break
+		}
+		s.p.add(int(n))
+		sent += n
+	}
+	if err == nil {
+		err = out.Truncate(a.e.size)
+	}
+	s.p.endFile()
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("updating %s: %w", a.rel, err)
+	}
+
+	srcSum, err := s.src.hashes([]string{a.rel})
+	if err != nil {
+		return 0, false, nil
+	}
+	dstSum, err := s.dst.hashes([]string{a.rel})
+	if err != nil || srcSum[0] == "" || srcSum[0] != dstSum[0] {
+		return 0, false, nil
+	}
+	return sent, true, nil
+}
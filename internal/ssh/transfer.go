@@ -0,0 +1,193 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/ssh"
+
+	"essh/internal/sftp"
+)
+
+// Protocol selects how files are transferred.
+type Protocol int
+
+const (
+	// ProtocolAuto uses SFTP when the server offers the subsystem and
+	// falls back to SCP otherwise.
+	ProtocolAuto Protocol = iota
+	// ProtocolSFTP requires the SFTP subsystem. It works on SFTP-only
+	// servers, such as chrooted SFTP accounts, where SCP cannot run.
+	ProtocolSFTP
+	// ProtocolSCP runs the legacy "scp -t"/"scp -f" on the server.
+	ProtocolSCP
+)
+
+// TransferOptions control Upload, Download and their recursive variants.
+type TransferOptions struct {
+	Protocol Protocol
+	// Resume continues partial destination files whose content matches
+	// the start of the source instead of copying them again. Without
+	// SFTP, only single files can be resumed.
+	Resume bool
+	// Quiet suppresses progress and per-file messages.
+	Quiet bool
+	// Preserve keeps modification and access times and permission bits,
+	// like scp -p.
+	Preserve bool
+	// Links recreates symlinks met in recursive transfers instead of
+	// following or skipping them.
+	Links bool
+	// Filter selects what recursive transfers copy; nil copies everything.
+	Filter *Filter
+	// ForwardAgent lets DirectCopy forward the local SSH agent to the
+	// source server when the destination has no stored key or identity
+	// files. Every key in the agent is then usable from that server.
+	ForwardAgent bool
+}
+
+// errLinksNeedSFTP is returned for downloads with Links without SFTP, as
+// scp follows symlinks instead of sending them.
+var errLinksNeedSFTP = errors.New("--links needs SFTP to download symlinks")
+
+// errFiltersNeedSFTP is returned for downloads with a Filter without SFTP,
+// as scp would still send every excluded file over the network.
+var errFiltersNeedSFTP = errors.New("filters need SFTP to download")
+
+// errNoSFTP is returned by NewSFTP when the server refuses the subsystem.
+var errNoSFTP = errors.New("server does not support SFTP")
+
+// NewSFTP starts an SFTP session on client. Closing the returned client
+// ends the session.
+func NewSFTP(client *ssh.Client) (*sftp.Client, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("creating session: %w", err)
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, fmt.Errorf("getting stdin pipe: %w", err)
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, fmt.Errorf("getting stdout pipe: %w", err)
+	}
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		session.Close()
+		return nil, fmt.Errorf("%w (%v)", errNoSFTP, err)
+	}
+	sc, err := sftp.NewClient(stdout, sessionWriter{stdin, session})
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	return sc, nil
+}
+
+// sessionWriter is the write side of an SFTP session; closing it ends the
+// session.
+type sessionWriter struct {
+	io.WriteCloser
+	session *ssh.Session
+}
+
+func (w sessionWriter) Close() error {
+	w.WriteCloser.Close()
+	return w.session.Close()
+}
+
+// sftpClient opens the SFTP session for a transfer, or returns nil when
+// the transfer should use SCP.
+func (o TransferOptions) sftpClient(client *ssh.Client) (*sftp.Client, error) {
+	if o.Protocol == ProtocolSCP {
+		return nil, nil
+	}
+	sc, err := NewSFTP(client)
+	if err != nil && o.Protocol == ProtocolAuto && errors.Is(err, errNoSFTP) {
+		return nil, nil
+	}
+	return sc, err
+}
+
+// Upload sends a local file to a remote path. If the remote path is a
+// directory, the file is created inside it.
+func Upload(client *ssh.Client, localPath, remotePath string, opts TransferOptions) error {
+	sc, err := opts.sftpClient(client)
+	if err != nil {
+		return err
+	}
+	p := newProgress(opts)
+	defer p.close()
+	if sc == nil {
+		if opts.Resume {
+			return execResumeUpload(client, localPath, remotePath, opts, p)
+		}
+		return scpUpload(client, localPath, remotePath, opts, p)
+	}
+	defer sc.Close()
+	return (&sftpTransfer{sc: sc, client: client, opts: opts, p: p}).upload(localPath, remotePath)
+}
+
+// UploadRecursive sends a local file or directory tree to a remote path.
+func UploadRecursive(client *ssh.Client, localPath, remotePath string, opts TransferOptions) error {
+	sc, err := opts.sftpClient(client)
+	if err != nil {
+		return err
+	}
+	p := newProgress(opts)
+	defer p.close()
+	if sc == nil {
+		if opts.Resume {
+			return errResumeNeedsSFTP
+		}
+		return scpUploadRecursive(client, localPath, remotePath, opts, p)
+	}
+	defer sc.Close()
+	return (&sftpTransfer{sc: sc, client: client, opts: opts, p: p}).uploadRecursive(localPath, remotePath)
+}
+
+// Download retrieves a remote file to a local path. If the local path is a
+// directory, the file is created inside it.
+func Download(client *ssh.Client, remotePath, localPath string, opts TransferOptions) error {
+	sc, err := opts.sftpClient(client)
+	if err != nil {
+		return err
+	}
+	p := newProgress(opts)
+	defer p.close()
+	if sc == nil {
+		if opts.Resume {
+			return execResumeDownload(client, remotePath, localPath, opts, p)
+		}
+		return scpDownload(client, remotePath, localPath, opts, p)
+	}
+	defer sc.Close()
+	return (&sftpTransfer{sc: sc, client: client, opts: opts, p: p}).download(remotePath, localPath)
+}
+
+// DownloadRecursive retrieves a remote file or directory tree to a local path.
+func DownloadRecursive(client *ssh.Client, remotePath, localPath string, opts TransferOptions) error {
+	sc, err := opts.sftpClient(client)
+	if err != nil {
+		return err
+	}
+	p := newProgress(opts)
+	defer p.close()
+	if sc == nil {
+		if opts.Resume {
+			return errResumeNeedsSFTP
+		}
+		if opts.Links {
+			return errLinksNeedSFTP
+		}
+		if opts.Filter != nil {
+			return errFiltersNeedSFTP
+		}
+		return scpDownloadRecursive(client, remotePath, localPath, opts, p)
+	}
+	defer sc.Close()
+	return (&sftpTransfer{sc: sc, client: client, opts: opts, p: p}).downloadRecursive(remotePath, localPath)
+}
@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Selector picks servers by name and tag. It is a comma-separated list of
+// terms: names and glob patterns ("web1", "prod-*") add matching servers,
+// while tag terms ("tag:web", "env:prod") keep only servers carrying every
+// tag listed. A selector of only tag terms starts from all servers.
+//
+// "tag:X" matches the tag X, or, when X has no colon, any "key:X" tag, so
+// "tag:web" matches both "web" and "role:web". Tag values may be globs too.
+type Selector struct {
+	names []string
+	tags  []string
+}
+
+// ParseSelector parses a selector expression.
+func ParseSelector(s string) (*Selector, error) {
+	sel := &Selector{}
+	for _, term := range strings.Split(s, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			return nil, fmt.Errorf("invalid selector %q: empty term", s)
+		}
+		pattern, isTag := term, false
+		if strings.HasPrefix(term, "tag:") {
+			pattern, isTag = strings.TrimPrefix(term, "tag:"), true
+		} else if strings.Contains(term, ":") {
+			isTag = true
+		}
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			return nil, fmt.Errorf("invalid selector term %q", term)
+		}
+		if isTag {
+			sel.tags = append(sel.tags, pattern)
+		} else {
+			sel.names = append(sel.names, pattern)
+		}
+	}
+	return sel, nil
+}
+
+// IsSelector reports whether s uses selector syntax (globs, tags or lists)
+// rather than naming a single server.
+func IsSelector(s string) bool {
+	return strings.ContainsAny(s, "*?[,:")
+}
+
+// Match reports whether srv is selected.
+func (sel *Selector) Match(srv *Server) bool {
+	for _, t := range sel.tags {
+		if !srv.HasTag(t) {
+			return false
+		}
+	}
+	if len(sel.names) == 0 {
+		return true
+	}
+	for _, n := range sel.names {
+		if ok, _ := path.Match(n, srv.Name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// HasTag reports whether srv carries a tag matching pattern, with the
+// "tag:X" rules described on Selector.
+func (srv *Server) HasTag(pattern string) bool {
+	for _, tag := range srv.Tags {
+		if ok, _ := path.Match(pattern, tag); ok {
+			return true
+		}
+		if !strings.Contains(pattern, ":") {
+			if _, value, found := strings.Cut(tag, ":"); found {
+				if ok, _ := path.Match(pattern, value); ok {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Select returns the servers matching selector, in storage order.
+func (s *Store) Select(selector string) ([]*Server, error) {
+	sel, err := ParseSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	var matches []*Server
+	for i := range s.Servers {
+		if sel.Match(&s.Servers[i]) {
+			matches = append(matches, &s.Servers[i])
+		}
+	}
+	return matches, nil
+}
+
+// ValidateTag checks that tag can be stored and used in selectors.
+func ValidateTag(tag string) error {
+	if tag == "" || strings.ContainsAny(tag, ", \t*?[") || strings.HasPrefix(tag, "tag:") {
+		return fmt.Errorf("invalid tag %q — tags look like \"web\" or \"env:prod\"", tag)
+	}
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"strings"
 
 	"essh/internal/crypto"
 )
@@ -16,6 +17,51 @@ type Server struct {
 	Host              string `json:"host"`
 	Port              int    `json:"port"`
 	EncryptedPassword string `json:"encrypted_password"`
+	// EncryptedPrivateKey holds an optional PEM private key for this server,
+	// and EncryptedPassphrase the passphrase protecting it, if any.
+	EncryptedPrivateKey string `json:"encrypted_private_key,omitempty"`
+	EncryptedPassphrase string `json:"encrypted_passphrase,omitempty"`
+	// AgentKeys controls use of SSH agent keys: "" (default), "prefer",
+	// "only" or "off".
+	AgentKeys string `json:"agent_keys,omitempty"`
+	// AuthMethods is the order in which auth methods are tried
+	// ("publickey", "keyboard-interactive", "password"); empty means all.
+	AuthMethods []string `json:"auth_methods,omitempty"`
+	// IdentityFiles are local private key paths to offer for this server.
+	IdentityFiles []string `json:"identity_files,omitempty"`
+	// IdentitiesOnly restricts public keys to the stored key and
+	// IdentityFiles (plus agent keys matching them).
+	IdentitiesOnly bool `json:"identities_only,omitempty"`
+	// Tags group servers for selectors, e.g. "web" or "env:prod".
+	Tags []string `json:"tags,omitempty"`
+	// Jump lists saved server names to tunnel through, in order.
+	Jump []string `json:"jump,omitempty"`
+	// Tunnels are named port forward presets for this server.
+	Tunnels []Tunnel `json:"tunnels,omitempty"`
+	// HostKeyAlgorithm and HostKeyFingerprint pin the server's host key.
+	// They are recorded on first connect and enforced on every device.
+	HostKeyAlgorithm   string `json:"host_key_algorithm,omitempty"`
+	HostKeyFingerprint string `json:"host_key_fingerprint,omitempty"`
+}
+
+// Tunnel is a named set of port forwards, started with
+// "essh tunnel <server> <name>".
+type Tunnel struct {
+	Name string `json:"name"`
+	// Local and Remote hold "[bind:]port:host:hostport" forward specs
+	// (-L and -R respectively).
+	Local  []string `json:"local,omitempty"`
+	Remote []string `json:"remote,omitempty"`
+}
+
+// FindTunnel returns the tunnel preset with the given name, or nil.
+func (s *Server) FindTunnel(name string) *Tunnel {
+	for i := range s.Tunnels {
+		if s.Tunnels[i].Name == name {
+			return &s.Tunnels[i]
+		}
+	}
+	return nil
 }
 
 // Store represents the essh-storage.json file.
@@ -93,6 +139,16 @@ func (s *Store) VerifyPassword(encPassword string, keyfile []byte) ([]byte, erro
 	return key, nil
 }
 
+// VerifyKey checks if a previously derived key (e.g. from the unlock agent)
+// still decrypts this store.
+func (s *Store) VerifyKey(key []byte) error {
+	plaintext, err := crypto.Decrypt(key, s.Verification)
+	if err != nil || plaintext != crypto.VerifyStr {
+		return fmt.Errorf("wrong encryption key")
+	}
+	return nil
+}
+
 // FindServer returns a server by name, or nil if not found.
 func (s *Store) FindServer(name string) *Server {
 	for i := range s.Servers {
@@ -112,18 +168,59 @@ func (s *Store) AddServer(srv Server) error {
 	return nil
 }
 
-// RemoveServer removes a server by name.
-func (s *Store) RemoveServer(name string) error {
+// RemoveServers removes the named servers. It refuses, without removing
+// anything, if a server that stays behind uses one of them as a jump host.
+func (s *Store) RemoveServers(names []string) error {
+	if err := s.CheckRemovable(names); err != nil {
+		return err
+	}
+	for _, name := range names {
+		i := s.indexOf(name)
+		s.Servers = append(s.Servers[:i], s.Servers[i+1:]...)
+	}
+	return nil
+}
+
+// CheckRemovable reports whether the named servers exist and can be removed
+// together, i.e. no other server still lists one of them in its Jump chain.
+func (s *Store) CheckRemovable(names []string) error {
+	removing := make(map[string]bool, len(names))
+	for _, name := range names {
+		if s.indexOf(name) < 0 {
+			return fmt.Errorf("server %q not found", name)
+		}
+		removing[name] = true
+	}
+	for _, name := range names {
+		var users []string
+		for _, srv := range s.Servers {
+			if removing[srv.Name] {
+				continue
+			}
+			for _, hop := range srv.Jump {
+				if hop == name {
+					users = append(users, srv.Name)
+					break
+				}
+			}
+		}
+		if len(users) > 0 {
+			return fmt.Errorf("server %q is a jump host for %s; change or remove their jump settings first", name, strings.Join(users, ", "))
+		}
+	}
+	return nil
+}
+
+func (s *Store) indexOf(name string) int {
 	for i := range s.Servers {
 		if s.Servers[i].Name == name {
-			s.Servers = append(s.Servers[:i], s.Servers[i+1:]...)
-			return nil
+			return i
 		}
 	}
-	return fmt.Errorf("server %q not found", name)
+	return -1
 }
 
-// RenameServer renames a server.
+// RenameServer renames a server and updates jump host references to it.
 func (s *Store) RenameServer(oldName, newName string) error {
 	if s.FindServer(newName) != nil {
 		return fmt.Errorf("server %q already exists", newName)
@@ -133,22 +230,35 @@ func (s *Store) RenameServer(oldName, newName string) error {
 		return fmt.Errorf("server %q not found", oldName)
 	}
 	srv.Name = newName
+	for i := range s.Servers {
+		for j, hop := range s.Servers[i].Jump {
+			if hop == oldName {
+				s.Servers[i].Jump[j] = newName
+			}
+		}
+	}
 	return nil
 }
 
-// ReEncryptAll decrypts all passwords with oldKey and re-encrypts with newKey.
+// ReEncryptAll decrypts all secrets with oldKey and re-encrypts with newKey.
 // Also updates the salt and verification string.
 func (s *Store) ReEncryptAll(oldKey, newKey, newSalt []byte, newVerification string) error {
 	for i := range s.Servers {
-		plaintext, err := crypto.Decrypt(oldKey, s.Servers[i].EncryptedPassword)
-		if err != nil {
-			return fmt.Errorf("decrypting %q: %w", s.Servers[i].Name, err)
-		}
-		encrypted, err := crypto.Encrypt(newKey, plaintext)
-		if err != nil {
-			return fmt.Errorf("re-encrypting %q: %w", s.Servers[i].Name, err)
+		srv := &s.Servers[i]
+		for _, field := range []*string{&srv.EncryptedPassword, &srv.EncryptedPrivateKey, &srv.EncryptedPassphrase} {
+			if *field == "" {
+				continue
+			}
+			plaintext, err := crypto.Decrypt(oldKey, *field)
+			if err != nil {
+				return fmt.Errorf("decrypting %q: %w", srv.Name, err)
+			}
+			encrypted, err := crypto.Encrypt(newKey, plaintext)
+			if err != nil {
+				return fmt.Errorf("re-encrypting %q: %w", srv.Name, err)
+			}
+			*field = encrypted
 		}
-		s.Servers[i].EncryptedPassword = encrypted
 	}
 	s.Salt = hex.EncodeToString(newSalt)
 	s.Verification = newVerification
@@ -1,15 +1,26 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+
+	"essh/internal/agent"
 	"essh/internal/config"
 	"essh/internal/crypto"
+	"essh/internal/diff"
 	"essh/internal/prompt"
 	"essh/internal/ssh"
 	"essh/internal/storage"
@@ -21,13 +32,18 @@ var (
 	buildTime = "unknown"
 )
 
+// jumpOverride holds the jump hosts given with "essh -J <hosts> ...". When
+// set, it replaces the saved jump hosts of the server being connected to.
+var jumpOverride []string
+
 func main() {
+	if len(os.Args) >= 3 && os.Args[1] == "-J" {
+		jumpOverride = splitList(os.Args[2])
+		os.Args = append(os.Args[:1], os.Args[3:]...)
+	}
+
 	if len(os.Args) < 2 {
-		if err := cmdSelectConnect(); err != nil {
-			fmt.Fprintf(os.Stderr, "error: %v\n", err)
-			os.Exit(1)
-		}
-		return
+		exitRemote(cmdSelectConnect())
 	}
 
 	var err error
@@ -46,25 +62,54 @@ func main() {
 		err = cmdEdit()
 	case "passwd":
 		err = cmdPasswd()
+	case "keygen":
+		err = cmdKeygen()
+	case "hostkey":
+		err = cmdHostKey()
+	case "agent":
+		err = cmdAgent()
+	case "unlock":
+		err = cmdUnlock()
+	case "lock":
+		err = cmdLock()
 	case "version":
 		err = cmdVersion()
 	case "scp":
 		err = cmdScp()
+	case "sftp":
+		err = cmdSftp()
+	case "sync":
+		err = cmdSync()
+	case "forward":
+		err = cmdForward()
+	case "tunnel":
+		err = cmdTunnel()
+	case "socks":
+		err = cmdSocks()
+	case "exec":
+		exitRemote(cmdExec())
+	case "run":
+		err = cmdRun()
+	case "gather":
+		err = cmdGather()
+	case "rollout":
+		err = cmdRollout()
 	case "completion":
 		err = cmdCompletion()
 	case "--names":
 		err = cmdNames()
+	case "--tags":
+		err = cmdTags()
 	case "help", "--help", "-h":
 		printUsage()
 	case "-":
 		name := loadLast()
 		if name == "" {
-			err = fmt.Errorf("no previous connection")
-		} else {
-			err = cmdConnect(name)
+			exitRemote(fmt.Errorf("no previous connection"))
 		}
+		exitRemote(cmdConnect(name))
 	default:
-		err = cmdConnect(os.Args[1])
+		exitRemote(cmdConnect(os.Args[1]))
 	}
 
 	if err != nil {
@@ -78,19 +123,65 @@ func printUsage() {
 
 Usage:
   essh                         Select a server interactively
-  essh <name>                  Connect to a saved server (prefix match supported)
+  essh <name|selector>         Connect to a saved server (prefix match supported)
+  essh <name> -L/-R <spec>     Connect with local/remote port forwards (see forward)
   essh -                       Reconnect to last server
+  essh -J <names> <name>       Connect through saved servers as jump hosts
   essh init                    Initialize storage with encryption password
-  essh add <name> <user@host[:port]>  Add a server
-  essh list                    List saved servers
+  essh add [options] <name> <user@host[:port]>
+                               Add a server (run without arguments to list options)
+  essh list [selector] [--tag <tag>]
+                               List saved servers, optionally filtered
   essh remove <name>           Remove a saved server
   essh rename <old> <new>      Rename a saved server
   essh edit <name>             Edit a saved server
   essh passwd                  Change encryption password
+  essh keygen <name>           Generate and store a new key pair for a server
+  essh hostkey show <name>     Show the pinned host key fingerprint
+  essh hostkey reset <name>    Forget the pinned host key (re-pinned on next connect)
+  essh unlock                  Unlock and keep the key in the background agent
+  essh lock                    Wipe the key from the agent
+  essh agent                   Run the unlock agent in the foreground
   essh version                 Show version info
-  essh scp [-r] <src> <dst>    Copy files or directories (use <name>:/path for remote; -r for recursive)
+  essh scp [-r] [-p] [--links] [--exclude <pattern>]... [-q] [--sftp|--scp] [--resume] [--direct [-A]] <src>... <dst>
+                               Copy files or directories (use <name>:/path for remote; -r for recursive).
+                               -p keeps times and permissions; --links recreates symlinks.
+                               --exclude/--include/--exclude-from take gitignore-style patterns;
+                               --ignore-files honours .gitignore and .esshignore in the source tree.
+                               Uses SFTP when the server supports it, SCP otherwise.
+                               --resume continues partial files and retries dropped connections;
+                               -q hides the progress display. Both sides may be remote; --direct
+                               then copies from the source server straight to the destination
+                               (-A forwards your SSH agent when the destination has no stored key)
+  essh sftp <name>             Interactive file shell (ls, cd, get, put, rm, chmod, df, ...)
+  essh sync [-n] [--delete] [-c] [-q] <src> <dst>
+                               Make the destination directory a copy of the source, sending only
+                               changed files (-n: show the plan, -c: compare contents)
+  essh forward <name> -L|-R [bind:]port:host:hostport [--save <tunnel>]
+                               Forward ports through a server (repeat -L/-R;
+                               -L listens locally, -R on the server)
+  essh tunnel <name> [<tunnel>] Start a saved tunnel, or list a server's tunnels
+  essh tunnel -d <name> <tunnel> Delete a saved tunnel
+  essh socks <name> [bind:]port Run a local SOCKS5/4a proxy through a server
+  essh exec [-t] <name> -- <command...>
+                               Run a command and exit with its status (-t forces a PTY)
+  essh run [-j N] [--timeout D] <selector>... -- <command...>
+                               Run a command on many servers in parallel
+  essh gather [-j N] [--timeout D] [--json] <selector>... -- <command...>
+                               Run a command on many servers and group identical
+                               output, diffing outliers against the majority
+  essh rollout [--batch N|N%] [--pause D] [--max-failures K] [--check <command>]
+               [--timeout D] <selector>... -- <command...>
+                               Run a command on servers in batches, stopping
+                               once more than K servers fail (default 0)
   essh completion              Output shell completion script (bash/zsh)
 
+Selectors:
+  Commands that take a server name also accept a selector: a glob such as
+  'web-*', tags such as 'tag:web' or 'env:prod,role:db' (all must match),
+  or both ('web-*,env:prod'). Connecting to a selector that matches several
+  servers opens the interactive selector; remove removes every match.
+
 Environment:
   ESSH_PASSWORD                Skip encryption password prompt
 
@@ -100,10 +191,16 @@ Keyfile:
   AND the keyfile are required to decrypt stored passwords.
   Enter "none" at the keyfile prompt to use password-only mode.
 
-Session:
-  The encryption password is cached for 30 minutes after a successful
-  connect or add, so you don't need to re-enter it each time.
-  Delete and passwd always require the password.`)
+Host keys:
+  Server host keys are checked against ~/.essh/known_hosts. Unknown hosts
+  prompt for trust on first use; changed keys are refused. The accepted
+  fingerprint is pinned in the storage file, so it syncs across devices.
+
+Unlock agent:
+  After a successful password prompt the derived key is kept in memory by a
+  background agent (~/.essh/agent.sock) and wiped after 30 minutes idle or
+  8 hours total (agent_idle_ttl / agent_max_ttl in config.json).
+  Remove and passwd always require the password.`)
 }
 
 // loadKeyfile loads the keyfile from the path in config, if configured.
@@ -115,39 +212,214 @@ func loadKeyfile(cfg *config.Config) ([]byte, error) {
 	return crypto.LoadKeyfile(cfg.KeyfilePath)
 }
 
-const sessionTTL = 30 * time.Minute
+// newTarget decrypts a saved server's credentials and builds its dial target,
+// including its chain of jump hosts.
+func newTarget(cfg *config.Config, store *storage.Store, key []byte, srv *storage.Server) (*ssh.Target, error) {
+	t, err := serverTarget(cfg, store, key, srv)
+	if err != nil {
+		return nil, err
+	}
+	jumps := srv.Jump
+	if len(jumpOverride) > 0 {
+		jumps = jumpOverride
+	}
+	t.Jump, err = resolveJumps(cfg, store, key, jumps, map[string]bool{srv.Name: true})
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// resolveJumps builds the dial targets for a list of jump host names. A hop's
+// own jump hosts are dialed before it, so chains can be nested.
+func resolveJumps(cfg *config.Config, store *storage.Store, key []byte, names []string, seen map[string]bool) ([]*ssh.Target, error) {
+	var hops []*ssh.Target
+	for _, name := range names {
+		hop := store.FindServer(name)
+		if hop == nil {
+			return nil, fmt.Errorf("jump host %q not found", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("jump host %q appears more than once in the chain", name)
+		}
+		seen[name] = true
 
-func sessionPath() string {
-	dir, err := config.Dir()
+		sub, err := resolveJumps(cfg, store, key, hop.Jump, seen)
+		if err != nil {
+			return nil, err
+		}
+		hops = append(hops, sub...)
+
+		t, err := serverTarget(cfg, store, key, hop)
+		if err != nil {
+			return nil, fmt.Errorf("jump host %q: %w", name, err)
+		}
+		hops = append(hops, t)
+	}
+	return hops, nil
+}
+
+// serverTarget decrypts a saved server's credentials and builds the dial
+// target for that server alone. A host key seen for the first time is pinned
+// on srv and saved so it syncs with the store.
+func serverTarget(cfg *config.Config, store *storage.Store, key []byte, srv *storage.Server) (*ssh.Target, error) {
+	password, err := crypto.Decrypt(key, srv.EncryptedPassword)
 	if err != nil {
-		return ""
+		return nil, fmt.Errorf("decrypting password: %w", err)
+	}
+
+	var privateKey, passphrase string
+	if srv.EncryptedPrivateKey != "" {
+		if privateKey, err = crypto.Decrypt(key, srv.EncryptedPrivateKey); err != nil {
+			return nil, fmt.Errorf("decrypting private key: %w", err)
+		}
 	}
-	return filepath.Join(dir, ".session")
+	if srv.EncryptedPassphrase != "" {
+		if passphrase, err = crypto.Decrypt(key, srv.EncryptedPassphrase); err != nil {
+			return nil, fmt.Errorf("decrypting key passphrase: %w", err)
+		}
+	}
+
+	return &ssh.Target{
+		Name:               srv.Name,
+		Host:               srv.Host,
+		Port:               srv.Port,
+		User:               srv.User,
+		Password:           password,
+		PrivateKey:         []byte(privateKey),
+		Passphrase:         passphrase,
+		AgentKeys:          srv.AgentKeys,
+		AuthMethods:        srv.AuthMethods,
+		IdentityFiles:      expandPaths(srv.IdentityFiles),
+		IdentitiesOnly:     srv.IdentitiesOnly,
+		KnownHosts:         knownHosts(cfg),
+		HostKeyAlgorithm:   srv.HostKeyAlgorithm,
+		HostKeyFingerprint: srv.HostKeyFingerprint,
+		PinHostKey: func(algorithm, fingerprint string) {
+			storeMu.Lock()
+			defer storeMu.Unlock()
+			srv.HostKeyAlgorithm = algorithm
+			srv.HostKeyFingerprint = fingerprint
+			if err := storage.Save(cfg.StoragePath, store); err != nil {
+				fmt.Fprintf(os.Stderr, "warning: saving pinned host key: %v\n", err)
+			}
+		},
+	}, nil
 }
 
-func loadSession() string {
-	p := sessionPath()
-	if p == "" {
-		return ""
+// storeMu serializes host key pins, which concurrent connections (essh run)
+// may save at the same time.
+var storeMu sync.Mutex
+
+// splitList splits a comma-separated list, dropping empty entries.
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
 	}
-	info, err := os.Stat(p)
+	return out
+}
+
+// expandPaths expands a leading ~ in each path.
+func expandPaths(paths []string) []string {
+	out := make([]string, len(paths))
+	for i, p := range paths {
+		out[i] = config.ExpandPath(p)
+	}
+	return out
+}
+
+// readPrivateKey reads a private key file, prompting for its passphrase if
+// the key is protected. It returns the encrypted key and passphrase ready to
+// be stored on a server entry.
+func readPrivateKey(key []byte, path string) (encKey, encPassphrase string, err error) {
+	data, err := os.ReadFile(config.ExpandPath(path))
 	if err != nil {
-		return ""
+		return "", "", fmt.Errorf("reading private key: %w", err)
 	}
-	if time.Since(info.ModTime()) > sessionTTL {
-		os.Remove(p)
-		return ""
+
+	var passphrase string
+	_, err = ssh.ParsePrivateKey(data, "")
+	if ssh.IsPassphraseMissing(err) {
+		passphrase, err = prompt.ReadSecret("Passphrase for " + path + ": ")
+		if err != nil {
+			return "", "", err
+		}
+		_, err = ssh.ParsePrivateKey(data, passphrase)
 	}
-	data, err := os.ReadFile(p)
 	if err != nil {
-		return ""
+		return "", "", fmt.Errorf("parsing private key %s: %w", path, err)
+	}
+
+	if encKey, err = crypto.Encrypt(key, string(data)); err != nil {
+		return "", "", err
+	}
+	if passphrase != "" {
+		if encPassphrase, err = crypto.Encrypt(key, passphrase); err != nil {
+			return "", "", err
+		}
+	}
+	return encKey, encPassphrase, nil
+}
+
+// knownHosts returns the host key store shared by every connection:
+// ~/.essh/known_hosts, plus ~/.ssh/known_hosts if enabled in config.
+func knownHosts(cfg *config.Config) *ssh.KnownHosts {
+	kh := &ssh.KnownHosts{}
+	if p, err := config.KnownHostsPath(); err == nil {
+		kh.Path = p
+	}
+	if cfg.SystemKnownHosts {
+		if home, err := os.UserHomeDir(); err == nil {
+			kh.Extra = append(kh.Extra, filepath.Join(home, ".ssh", "known_hosts"))
+		}
+	}
+	return kh
+}
+
+const (
+	defaultAgentIdleTTL = 30 * time.Minute
+	defaultAgentMaxTTL  = 8 * time.Hour
+)
+
+// agentTTLs returns the unlock agent's idle and absolute TTLs from config,
+// falling back to the defaults for missing or invalid values.
+func agentTTLs(cfg *config.Config) (idle, max time.Duration) {
+	idle, max = defaultAgentIdleTTL, defaultAgentMaxTTL
+	if d, err := time.ParseDuration(cfg.AgentIdleTTL); err == nil && d > 0 {
+		idle = d
+	}
+	if d, err := time.ParseDuration(cfg.AgentMaxTTL); err == nil && d > 0 {
+		max = d
+	}
+	return idle, max
+}
+
+// cacheKey hands the derived key to the unlock agent, starting the agent if
+// it isn't running. Failures are not fatal — the user is just prompted again
+// next time.
+func cacheKey(cfg *config.Config, key []byte) error {
+	sock, err := config.AgentSocketPath()
+	if err != nil {
+		return err
 	}
-	return string(data)
+	idle, max := agentTTLs(cfg)
+	if err := agent.Put(sock, key, idle, max); err == nil {
+		return nil
+	}
+	if err := agent.Start(sock); err != nil {
+		return err
+	}
+	return agent.Put(sock, key, idle, max)
 }
 
-func saveSession(password string) {
-	if p := sessionPath(); p != "" {
-		os.WriteFile(p, []byte(password), 0600)
+// removeLegacySession deletes the plaintext password cache written by older
+// versions of essh.
+func removeLegacySession() {
+	if dir, err := config.Dir(); err == nil {
+		os.Remove(filepath.Join(dir, ".session"))
 	}
 }
 
@@ -177,11 +449,12 @@ func saveLast(name string) {
 	}
 }
 
-// verifyWithCache tries the cached session password first, then prompts.
-// On success, caches the password for future use.
-func verifyWithCache(store *storage.Store, keyfile []byte) ([]byte, error) {
-	if cached := loadSession(); cached != "" {
-		if key, err := store.VerifyPassword(cached, keyfile); err == nil {
+// verifyWithCache asks the unlock agent for the key first, then prompts.
+// On success, hands the key to the agent for future use.
+func verifyWithCache(cfg *config.Config, store *storage.Store, keyfile []byte) ([]byte, error) {
+	removeLegacySession()
+	if sock, err := config.AgentSocketPath(); err == nil {
+		if key, err := agent.Get(sock); err == nil && store.VerifyKey(key) == nil {
 			return key, nil
 		}
 	}
@@ -193,7 +466,7 @@ func verifyWithCache(store *storage.Store, keyfile []byte) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	saveSession(encPassword)
+	cacheKey(cfg, key)
 	return key, nil
 }
 
@@ -213,50 +486,35 @@ func cmdSelectConnect() error {
 		return nil
 	}
 
-	items := make([]prompt.SelectItem, len(store.Servers))
-	for i, s := range store.Servers {
-		items[i] = prompt.SelectItem{
-			Label: s.Name,
-			Desc:  fmt.Sprintf("%s@%s:%d", s.User, s.Host, s.Port),
-		}
+	servers := make([]*storage.Server, len(store.Servers))
+	for i := range store.Servers {
+		servers[i] = &store.Servers[i]
 	}
 
 	// Pre-select last connected server
-	defaultIdx := 0
-	if last := loadLast(); last != "" {
-		for i, s := range store.Servers {
-			if s.Name == last {
-				defaultIdx = i
-				break
-			}
-		}
-	}
-
-	idx, err := prompt.Select("Select a server:", items, defaultIdx)
+	srv, err := chooseServer("Select a server:", servers, loadLast())
 	if err != nil {
 		return err
 	}
 
-	srv := &store.Servers[idx]
-
 	keyfile, err := loadKeyfile(cfg)
 	if err != nil {
 		return err
 	}
 
-	key, err := verifyWithCache(store, keyfile)
+	key, err := verifyWithCache(cfg, store, keyfile)
 	if err != nil {
 		return err
 	}
 
-	sshPassword, err := crypto.Decrypt(key, srv.EncryptedPassword)
+	target, err := newTarget(cfg, store, key, srv)
 	if err != nil {
-		return fmt.Errorf("decrypting password: %w", err)
+		return err
 	}
 
 	saveLast(srv.Name)
 	fmt.Printf("Connecting to %s@%s:%d...\n", srv.User, srv.Host, srv.Port)
-	return ssh.Connect(srv.Host, srv.Port, srv.User, sshPassword)
+	return ssh.Connect(target)
 }
 
 func cmdInit() error {
@@ -329,7 +587,7 @@ func cmdInit() error {
 	// Create .gitignore to exclude keyfile from version control
 	gitignorePath := filepath.Join(dir, ".gitignore")
 	if _, err := os.Stat(gitignorePath); os.IsNotExist(err) {
-		os.WriteFile(gitignorePath, []byte("*.key\n.session\n.last\n"), 0600)
+		os.WriteFile(gitignorePath, []byte("*.key\nagent.sock\n.last\n"), 0600)
 	}
 
 	if err := storage.Init(storagePath, encPassword, keyfile); err != nil {
@@ -348,12 +606,77 @@ func cmdInit() error {
 	return nil
 }
 
+// nextArg returns the value following the flag at args[*i] and advances *i.
+func nextArg(args []string, i *int) (string, error) {
+	if *i+1 >= len(args) {
+		return "", fmt.Errorf("%s requires an argument", args[*i])
+	}
+	*i++
+	return args[*i], nil
+}
+
 func cmdAdd() error {
-	if len(os.Args) < 4 {
-		return fmt.Errorf("usage: essh add <name> <user@host[:port]>")
+	var keyPath string
+	var opts storage.Server
+	positional := make([]string, 0, 2)
+	args := os.Args[2:]
+	for i := 0; i < len(args); i++ {
+		var err error
+		switch a := args[i]; a {
+		case "--key", "-i":
+			keyPath, err = nextArg(args, &i)
+		case "--agent-keys":
+			var mode string
+			if mode, err = nextArg(args, &i); err == nil {
+				opts.AgentKeys, err = ssh.ParseAgentKeys(mode)
+			}
+		case "--auth":
+			var methods string
+			if methods, err = nextArg(args, &i); err == nil {
+				opts.AuthMethods, err = ssh.ParseAuthMethods(methods)
+			}
+		case "--identity":
+			var path string
+			if path, err = nextArg(args, &i); err == nil {
+				opts.IdentityFiles = append(opts.IdentityFiles, path)
+			}
+		case "--identities-only":
+			opts.IdentitiesOnly = true
+		case "--jump", "-J":
+			var hosts string
+			if hosts, err = nextArg(args, &i); err == nil {
+				opts.Jump = splitList(hosts)
+			}
+		case "--tag", "-t":
+			var tags []string
+			var list string
+			if list, err = nextArg(args, &i); err == nil {
+				tags, err = parseTags(list)
+				opts.Tags = append(opts.Tags, tags...)
+			}
+		default:
+			positional = append(positional, a)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(positional) < 2 {
+		return fmt.Errorf("usage: essh add [options] <name> <user@host[:port]>\n" +
+			"  --key <file>           Store a private key in the vault\n" +
+			"  --identity <file>      Offer a local identity file (repeatable)\n" +
+			"  --identities-only      Offer only the stored key and identity files\n" +
+			"  --auth <methods>       Auth order, e.g. publickey,password\n" +
+			"  --agent-keys <mode>    SSH agent keys: default, prefer, only or off\n" +
+			"  --jump <names>         Saved servers to tunnel through, comma-separated\n" +
+			"  --tag <tags>           Tags such as web or env:prod, comma-separated (repeatable)")
+	}
+	name := positional[0]
+	target := positional[1]
+	if err := validateName(name); err != nil {
+		return err
 	}
-	name := os.Args[2]
-	target := os.Args[3]
 
 	user, host, port, err := parseTarget(target)
 	if err != nil {
@@ -375,27 +698,40 @@ func cmdAdd() error {
 		return err
 	}
 
-	key, err := verifyWithCache(store, keyfile)
+	key, err := verifyWithCache(cfg, store, keyfile)
 	if err != nil {
 		return err
 	}
 
-	sshPassword, err := prompt.ReadSecret("SSH password for " + user + "@" + host + ": ")
-	if err != nil {
-		return err
+	for _, hop := range opts.Jump {
+		if store.FindServer(hop) == nil {
+			return fmt.Errorf("jump host %q not found", hop)
+		}
+	}
+
+	srv := opts
+	srv.Name = name
+	srv.User = user
+	srv.Host = host
+	srv.Port = port
+
+	passwordPrompt := "SSH password for " + user + "@" + host + ": "
+	if keyPath != "" {
+		srv.EncryptedPrivateKey, srv.EncryptedPassphrase, err = readPrivateKey(key, keyPath)
+		if err != nil {
+			return err
+		}
+		passwordPrompt = "SSH password for " + user + "@" + host + " (leave empty for key-only): "
 	}
 
-	encrypted, err := crypto.Encrypt(key, sshPassword)
+	sshPassword, err := prompt.ReadSecret(passwordPrompt)
 	if err != nil {
 		return err
 	}
 
-	srv := storage.Server{
-		Name:              name,
-		User:              user,
-		Host:              host,
-		Port:              port,
-		EncryptedPassword: encrypted,
+	srv.EncryptedPassword, err = crypto.Encrypt(key, sshPassword)
+	if err != nil {
+		return err
 	}
 
 	if err := store.AddServer(srv); err != nil {
@@ -426,10 +762,42 @@ func cmdList() error {
 		return nil
 	}
 
+	var selectors []string
+	args := os.Args[2:]
+	for i := 0; i < len(args); i++ {
+		switch a := args[i]; a {
+		case "--tag", "-t":
+			tag, err := nextArg(args, &i)
+			if err != nil {
+				return err
+			}
+			selectors = append(selectors, "tag:"+tag)
+		default:
+			selectors = append(selectors, a)
+		}
+	}
+
+	servers := make([]*storage.Server, len(store.Servers))
+	for i := range store.Servers {
+		servers[i] = &store.Servers[i]
+	}
+	if len(selectors) > 0 {
+		// --tag filters combine with any selector given, like a comma.
+		var err error
+		if servers, err = store.Select(strings.Join(selectors, ",")); err != nil {
+			return err
+		}
+		if len(servers) == 0 {
+			fmt.Printf("No servers match %q.\n", strings.Join(selectors, ","))
+			return nil
+		}
+	}
+
 	// Calculate column widths
 	nameW := 4
 	addrW := 7
-	for _, s := range store.Servers {
+	tagsW := 0
+	for _, s := range servers {
 		if len(s.Name) > nameW {
 			nameW = len(s.Name)
 		}
@@ -437,11 +805,28 @@ func cmdList() error {
 		if len(addr) > addrW {
 			addrW = len(addr)
 		}
+		if tags := strings.Join(s.Tags, ","); len(tags) > tagsW {
+			tagsW = len(tags)
+		}
+	}
+	if tagsW > 0 && tagsW < 4 {
+		tagsW = 4
 	}
 
-	fmt.Printf("%-*s  %s\n", nameW, "NAME", "ADDRESS")
-	for _, s := range store.Servers {
-		fmt.Printf("%-*s  %s@%s:%d\n", nameW, s.Name, s.User, s.Host, s.Port)
+	header := fmt.Sprintf("%-*s  %-*s", nameW, "NAME", addrW, "ADDRESS")
+	if tagsW > 0 {
+		header += "  TAGS"
+	}
+	fmt.Println(strings.TrimRight(header, " "))
+	for _, s := range servers {
+		line := fmt.Sprintf("%-*s  %-*s", nameW, s.Name, addrW, fmt.Sprintf("%s@%s:%d", s.User, s.Host, s.Port))
+		if tagsW > 0 {
+			line += fmt.Sprintf("  %-*s", tagsW, strings.Join(s.Tags, ","))
+		}
+		if len(s.Jump) > 0 {
+			line += "  via " + strings.Join(s.Jump, ",")
+		}
+		fmt.Println(strings.TrimRight(line, " "))
 	}
 	return nil
 }
@@ -462,8 +847,16 @@ func cmdRemove() error {
 		return err
 	}
 
-	if store.FindServer(name) == nil {
-		return fmt.Errorf("server %q not found", name)
+	servers, err := selectServers(store, name)
+	if err != nil {
+		return err
+	}
+	if len(servers) == 0 {
+		return notFound(name)
+	}
+	names := serverNames(servers)
+	if err := store.CheckRemovable(names); err != nil {
+		return err
 	}
 
 	keyfile, err := loadKeyfile(cfg)
@@ -480,7 +873,11 @@ func cmdRemove() error {
 		return err
 	}
 
-	ok, err := prompt.Confirm(fmt.Sprintf("Remove server %q? [y/N] ", name))
+	question := fmt.Sprintf("Remove server %q? [y/N] ", names[0])
+	if len(names) > 1 {
+		question = fmt.Sprintf("Remove %d servers (%s)? [y/N] ", len(names), strings.Join(names, ", "))
+	}
+	ok, err := prompt.Confirm(question)
 	if err != nil {
 		return err
 	}
@@ -489,7 +886,7 @@ func cmdRemove() error {
 		return nil
 	}
 
-	if err := store.RemoveServer(name); err != nil {
+	if err := store.RemoveServers(names); err != nil {
 		return err
 	}
 
@@ -497,7 +894,9 @@ func cmdRemove() error {
 		return err
 	}
 
-	fmt.Printf("Removed server %q\n", name)
+	for _, n := range names {
+		fmt.Printf("Removed server %q\n", n)
+	}
 	return nil
 }
 
@@ -507,6 +906,9 @@ func cmdRename() error {
 	}
 	oldName := os.Args[2]
 	newName := os.Args[3]
+	if err := validateName(newName); err != nil {
+		return err
+	}
 
 	cfg, err := config.Load()
 	if err != nil {
@@ -518,6 +920,12 @@ func cmdRename() error {
 		return err
 	}
 
+	srv, err := findServer(store, oldName)
+	if err != nil {
+		return err
+	}
+	oldName = srv.Name
+
 	if err := store.RenameServer(oldName, newName); err != nil {
 		return err
 	}
@@ -546,17 +954,18 @@ func cmdEdit() error {
 		return err
 	}
 
-	srv := store.FindServer(name)
-	if srv == nil {
-		return fmt.Errorf("server %q not found", name)
+	srv, err := findServer(store, name)
+	if err != nil {
+		return err
 	}
+	name = srv.Name
 
 	keyfile, err := loadKeyfile(cfg)
 	if err != nil {
 		return err
 	}
 
-	key, err := verifyWithCache(store, keyfile)
+	key, err := verifyWithCache(cfg, store, keyfile)
 	if err != nil {
 		return err
 	}
@@ -603,92 +1012,444 @@ func cmdEdit() error {
 		srv.EncryptedPassword = encrypted
 	}
 
-	if err := storage.Save(cfg.StoragePath, store); err != nil {
+	currentKey := "none"
+	if srv.EncryptedPrivateKey != "" {
+		currentKey = "stored"
+	}
+	newKeyPath, err := prompt.ReadLine(fmt.Sprintf("Private key file (\"none\" to remove) [%s]: ", currentKey))
+	if err != nil {
 		return err
 	}
+	switch newKeyPath {
+	case "":
+	case "none":
+		srv.EncryptedPrivateKey = ""
+		srv.EncryptedPassphrase = ""
+	default:
+		srv.EncryptedPrivateKey, srv.EncryptedPassphrase, err = readPrivateKey(key, newKeyPath)
+		if err != nil {
+			return err
+		}
+	}
 
-	fmt.Printf("Updated server %q\n", name)
-	return nil
-}
+	currentAgentKeys := srv.AgentKeys
+	if currentAgentKeys == "" {
+		currentAgentKeys = "default"
+	}
+	newAgentKeys, err := prompt.ReadLine(fmt.Sprintf("SSH agent keys (default/prefer/only/off) [%s]: ", currentAgentKeys))
+	if err != nil {
+		return err
+	}
+	if newAgentKeys != "" {
+		mode, err := ssh.ParseAgentKeys(newAgentKeys)
+		if err != nil {
+			return err
+		}
+		srv.AgentKeys = mode
+	}
 
-func cmdPasswd() error {
-	cfg, err := config.Load()
+	currentAuth := "default"
+	if len(srv.AuthMethods) > 0 {
+		currentAuth = strings.Join(srv.AuthMethods, ",")
+	}
+	newAuth, err := prompt.ReadLine(fmt.Sprintf("Auth methods, in order [%s]: ", currentAuth))
 	if err != nil {
-		return fmt.Errorf("not initialized — run 'essh init' first")
+		return err
+	}
+	if newAuth != "" {
+		methods, err := ssh.ParseAuthMethods(newAuth)
+		if err != nil {
+			return err
+		}
+		srv.AuthMethods = methods
 	}
 
-	store, err := storage.Load(cfg.StoragePath)
+	currentIdentities := "none"
+	if len(srv.IdentityFiles) > 0 {
+		currentIdentities = strings.Join(srv.IdentityFiles, ",")
+	}
+	newIdentities, err := prompt.ReadLine(fmt.Sprintf("Identity files, comma-separated (\"none\" to clear) [%s]: ", currentIdentities))
 	if err != nil {
 		return err
 	}
+	switch newIdentities {
+	case "":
+	case "none":
+		srv.IdentityFiles = nil
+	default:
+		srv.IdentityFiles = splitList(newIdentities)
+	}
 
-	keyfile, err := loadKeyfile(cfg)
+	currentOnly := "n"
+	if srv.IdentitiesOnly {
+		currentOnly = "y"
+	}
+	newOnly, err := prompt.ReadLine(fmt.Sprintf("Identities only (y/n) [%s]: ", currentOnly))
 	if err != nil {
 		return err
 	}
+	switch strings.ToLower(newOnly) {
+	case "":
+	case "y", "yes":
+		srv.IdentitiesOnly = true
+	case "n", "no":
+		srv.IdentitiesOnly = false
+	default:
+		return fmt.Errorf("invalid answer %q (use y or n)", newOnly)
+	}
 
-	oldPassword, err := prompt.ReadPassword("Current encryption password: ")
+	currentJump := "none"
+	if len(srv.Jump) > 0 {
+		currentJump = strings.Join(srv.Jump, ",")
+	}
+	newJump, err := prompt.ReadLine(fmt.Sprintf("Jump hosts, comma-separated (\"none\" to clear) [%s]: ", currentJump))
+	if err != nil {
+		return err
+	}
+	switch newJump {
+	case "":
+	case "none":
+		srv.Jump = nil
+	default:
+		hops := splitList(newJump)
+		for _, hop := range hops {
+			if hop == srv.Name {
+				return fmt.Errorf("server cannot be its own jump host")
+			}
+			if store.FindServer(hop) == nil {
+				return fmt.Errorf("jump host %q not found", hop)
+			}
+		}
+		srv.Jump = hops
+	}
+
+	currentTags := "none"
+	if len(srv.Tags) > 0 {
+		currentTags = strings.Join(srv.Tags, ",")
+	}
+	newTags, err := prompt.ReadLine(fmt.Sprintf("Tags, comma-separated (\"none\" to clear) [%s]: ", currentTags))
 	if err != nil {
 		return err
 	}
+	switch newTags {
+	case "":
+	case "none":
+		srv.Tags = nil
+	default:
+		if srv.Tags, err = parseTags(newTags); err != nil {
+			return err
+		}
+	}
+
+	if err := storage.Save(cfg.StoragePath, store); err != nil {
+		return err
+	}
 
-	oldKey, err := store.VerifyPassword(oldPassword, keyfile)
+	fmt.Printf("Updated server %q\n", name)
+	return nil
+}
+
+func cmdKeygen() error {
+	if len(os.Args) < 3 {
+		return fmt.Errorf("usage: essh keygen <name>")
+	}
+	name := os.Args[2]
+
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("not initialized — run 'essh init' first")
+	}
+
+	store, err := storage.Load(cfg.StoragePath)
 	if err != nil {
 		return err
 	}
 
-	newPassword, err := prompt.ReadPasswordConfirm("New encryption password: ", "Confirm new password: ")
+	srv, err := findServer(store, name)
 	if err != nil {
 		return err
 	}
-	if newPassword == "" {
-		return fmt.Errorf("password cannot be empty")
+	name = srv.Name
+
+	keyfile, err := loadKeyfile(cfg)
+	if err != nil {
+		return err
 	}
 
-	newSalt, err := crypto.GenerateSalt()
+	key, err := verifyWithCache(cfg, store, keyfile)
 	if err != nil {
 		return err
 	}
 
-	newKey := crypto.DeriveKey(newPassword, newSalt, keyfile)
+	if srv.EncryptedPrivateKey != "" {
+		ok, err := prompt.Confirm(fmt.Sprintf("Server %q already has a private key. Replace it? [y/N] ", name))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			fmt.Println("Cancelled.")
+			return nil
+		}
+	}
 
-	newVerification, err := crypto.Encrypt(newKey, crypto.VerifyStr)
+	privateKey, authorizedKey, err := ssh.GenerateKey("essh-" + name)
 	if err != nil {
 		return err
 	}
 
-	if err := store.ReEncryptAll(oldKey, newKey, newSalt, newVerification); err != nil {
+	encrypted, err := crypto.Encrypt(key, string(privateKey))
+	if err != nil {
 		return err
 	}
+	srv.EncryptedPrivateKey = encrypted
+	srv.EncryptedPassphrase = ""
 
 	if err := storage.Save(cfg.StoragePath, store); err != nil {
 		return err
 	}
 
-	fmt.Println("Encryption password changed successfully.")
-	return nil
-}
-
-func cmdVersion() error {
-	fmt.Printf("essh %s\ncommit: %s\nbuilt:  %s\n", version, commit, buildTime)
+	fmt.Printf("Generated ed25519 key for %q. Add this line to ~/.ssh/authorized_keys on %s:\n\n%s\n", name, srv.Host, authorizedKey)
 	return nil
 }
 
-func cmdNames() error {
+func cmdPasswd() error {
 	cfg, err := config.Load()
 	if err != nil {
-		return nil
+		return fmt.Errorf("not initialized — run 'essh init' first")
 	}
+
 	store, err := storage.Load(cfg.StoragePath)
 	if err != nil {
-		return nil
+		return err
 	}
-	for _, s := range store.Servers {
+
+	keyfile, err := loadKeyfile(cfg)
+	if err != nil {
+		return err
+	}
+
+	oldPassword, err := prompt.ReadPassword("Current encryption password: ")
+	if err != nil {
+		return err
+	}
+
+	oldKey, err := store.VerifyPassword(oldPassword, keyfile)
+	if err != nil {
+		return err
+	}
+
+	newPassword, err := prompt.ReadPasswordConfirm("New encryption password: ", "Confirm new password: ")
+	if err != nil {
+		return err
+	}
+	if newPassword == "" {
+		return fmt.Errorf("password cannot be empty")
+	}
+
+	newSalt, err := crypto.GenerateSalt()
+	if err != nil {
+		return err
+	}
+
+	newKey := crypto.DeriveKey(newPassword, newSalt, keyfile)
+
+	newVerification, err := crypto.Encrypt(newKey, crypto.VerifyStr)
+	if err != nil {
+		return err
+	}
+
+	if err := store.ReEncryptAll(oldKey, newKey, newSalt, newVerification); err != nil {
+		return err
+	}
+
+	if err := storage.Save(cfg.StoragePath, store); err != nil {
+		return err
+	}
+
+	// The agent still holds the old key, which no longer decrypts anything.
+	if sock, err := config.AgentSocketPath(); err == nil {
+		agent.Lock(sock)
+	}
+
+	fmt.Println("Encryption password changed successfully.")
+	return nil
+}
+
+func cmdHostKey() error {
+	if len(os.Args) < 4 {
+		return fmt.Errorf("usage: essh hostkey show|reset <name>")
+	}
+	action, name := os.Args[2], os.Args[3]
+
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("not initialized — run 'essh init' first")
+	}
+
+	store, err := storage.Load(cfg.StoragePath)
+	if err != nil {
+		return err
+	}
+
+	srv, err := findServer(store, name)
+	if err != nil {
+		return err
+	}
+	name = srv.Name
+
+	switch action {
+	case "show":
+		if srv.HostKeyFingerprint == "" {
+			fmt.Printf("No host key pinned for %q (it will be pinned on next connect)\n", name)
+			return nil
+		}
+		fmt.Printf("%s  %s@%s:%d\n%s %s\n", srv.Name, srv.User, srv.Host, srv.Port, srv.HostKeyAlgorithm, srv.HostKeyFingerprint)
+		return nil
+	case "reset":
+	default:
+		return fmt.Errorf("unknown hostkey action %q (use show or reset)", action)
+	}
+
+	keyfile, err := loadKeyfile(cfg)
+	if err != nil {
+		return err
+	}
+
+	if _, err := verifyWithCache(cfg, store, keyfile); err != nil {
+		return err
+	}
+
+	if srv.HostKeyFingerprint != "" {
+		fmt.Printf("Current pin: %s %s\n", srv.HostKeyAlgorithm, srv.HostKeyFingerprint)
+	}
+	ok, err := prompt.Confirm(fmt.Sprintf("Forget the host key for %q? [y/N] ", name))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		fmt.Println("Cancelled.")
+		return nil
+	}
+
+	srv.HostKeyAlgorithm = ""
+	srv.HostKeyFingerprint = ""
+	if err := storage.Save(cfg.StoragePath, store); err != nil {
+		return err
+	}
+
+	addr := fmt.Sprintf("%s:%d", srv.Host, srv.Port)
+	if _, err := knownHosts(cfg).Remove(addr); err != nil {
+		return err
+	}
+
+	fmt.Printf("Host key for %q reset — you will be asked to trust the new key on next connect\n", name)
+	return nil
+}
+
+func cmdAgent() error {
+	sock, err := config.AgentSocketPath()
+	if err != nil {
+		return err
+	}
+	return agent.Serve(sock)
+}
+
+func cmdUnlock() error {
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("not initialized — run 'essh init' first")
+	}
+
+	store, err := storage.Load(cfg.StoragePath)
+	if err != nil {
+		return err
+	}
+
+	keyfile, err := loadKeyfile(cfg)
+	if err != nil {
+		return err
+	}
+
+	encPassword, err := prompt.ReadPassword("Encryption password: ")
+	if err != nil {
+		return err
+	}
+
+	key, err := store.VerifyPassword(encPassword, keyfile)
+	if err != nil {
+		return err
+	}
+
+	if err := cacheKey(cfg, key); err != nil {
+		return err
+	}
+	removeLegacySession()
+
+	idle, max := agentTTLs(cfg)
+	fmt.Printf("Unlocked for up to %s (locks after %s idle)\n", max, idle)
+	return nil
+}
+
+func cmdLock() error {
+	removeLegacySession()
+	sock, err := config.AgentSocketPath()
+	if err != nil {
+		return err
+	}
+	if err := agent.Lock(sock); err != nil {
+		fmt.Println("Agent not running — already locked.")
+		return nil
+	}
+	fmt.Println("Locked.")
+	return nil
+}
+
+func cmdVersion() error {
+	fmt.Printf("essh %s\ncommit: %s\nbuilt:  %s\n", version, commit, buildTime)
+	return nil
+}
+
+func cmdNames() error {
+	cfg, err := config.Load()
+	if err != nil {
+		return nil
+	}
+	store, err := storage.Load(cfg.StoragePath)
+	if err != nil {
+		return nil
+	}
+	for _, s := range store.Servers {
 		fmt.Println(s.Name)
 	}
 	return nil
 }
 
+// cmdTags prints a selector for every tag in use, for shell completion.
+func cmdTags() error {
+	cfg, err := config.Load()
+	if err != nil {
+		return nil
+	}
+	store, err := storage.Load(cfg.StoragePath)
+	if err != nil {
+		return nil
+	}
+	seen := map[string]bool{}
+	for _, s := range store.Servers {
+		for _, t := range s.Tags {
+			sel := t
+			if !strings.Contains(t, ":") {
+				sel = "tag:" + t
+			}
+			if !seen[sel] {
+				seen[sel] = true
+				fmt.Println(sel)
+			}
+		}
+	}
+	return nil
+}
+
 func cmdCompletion() error {
 	shell := "zsh"
 	if len(os.Args) >= 3 {
@@ -706,22 +1467,30 @@ func cmdCompletion() error {
 }
 
 const bashCompletion = `_essh() {
-    local cur commands
-    cur="${COMP_WORDS[COMP_CWORD]}"
-    commands="init add list remove rename edit passwd version scp completion help"
+    local cur cword commands
+    local -a words
+    if declare -F _get_comp_words_by_ref >/dev/null; then
+        # Keep selectors such as env:prod together as one word
+        _get_comp_words_by_ref -n : cur words cword
+    else
+        cur="${COMP_WORDS[COMP_CWORD]}"
+        words=("${COMP_WORDS[@]}")
+        cword=$COMP_CWORD
+    fi
+    commands="init add list remove rename edit passwd keygen hostkey unlock lock agent version scp sftp sync exec run gather rollout forward tunnel socks completion help"
 
-    if [ "$COMP_CWORD" -eq 1 ]; then
+    if [ "$cword" -eq 1 ]; then
         local names
-        names=$(essh --names 2>/dev/null)
+        names="$(essh --names 2>/dev/null) $(essh --tags 2>/dev/null)"
         COMPREPLY=($(compgen -W "$commands $names" -- "$cur"))
-    elif [ "$COMP_CWORD" -eq 2 ]; then
-        case "${COMP_WORDS[1]}" in
-            remove|edit|rename)
+    elif [ "$cword" -eq 2 ]; then
+        case "${words[1]}" in
+            list|remove|edit|rename|keygen|exec|sftp|run|gather|rollout|forward|tunnel|socks)
                 local names
-                names=$(essh --names 2>/dev/null)
+                names="$(essh --names 2>/dev/null) $(essh --tags 2>/dev/null)"
                 COMPREPLY=($(compgen -W "$names" -- "$cur"))
                 ;;
-            scp)
+            scp|sync)
                 local names
                 names=$(essh --names 2>/dev/null)
                 local colon_names=""
@@ -729,7 +1498,17 @@ const bashCompletion = `_essh() {
                 COMPREPLY=($(compgen -W "$colon_names" -- "$cur"))
                 compopt -o nospace
                 ;;
+            hostkey)
+                COMPREPLY=($(compgen -W "show reset" -- "$cur"))
+                ;;
         esac
+    elif [ "$cword" -eq 3 ] && [ "${words[1]}" = "hostkey" ]; then
+        local names
+        names="$(essh --names 2>/dev/null) $(essh --tags 2>/dev/null)"
+        COMPREPLY=($(compgen -W "$names" -- "$cur"))
+    fi
+    if declare -F __ltrim_colon_completions >/dev/null; then
+        __ltrim_colon_completions "$cur"
     fi
 }
 complete -F _essh essh
@@ -738,7 +1517,7 @@ complete -F _essh essh
 const zshCompletion = `#compdef essh
 
 _essh() {
-    local -a commands names
+    local -a commands names tags
     commands=(
         'init:Initialize storage with encryption password'
         'add:Add a server'
@@ -747,27 +1526,47 @@ _essh() {
         'rename:Rename a saved server'
         'edit:Edit a saved server'
         'passwd:Change encryption password'
+        'keygen:Generate and store a key pair for a server'
+        'hostkey:Show or reset a pinned host key'
+        'unlock:Unlock and keep the key in the background agent'
+        'lock:Wipe the key from the agent'
+        'agent:Run the unlock agent in the foreground'
         'version:Show version info'
         'scp:Copy files to/from a server'
+        'sftp:Interactive file shell on a server'
+        'sync:Copy only changed files between a directory and a server'
+        'exec:Run a command on a server'
+        'run:Run a command on many servers in parallel'
+        'gather:Run a command on many servers and group identical output'
+        'rollout:Run a command on servers in batches'
+        'forward:Forward local ports through a server'
+        'tunnel:Start or list saved tunnels'
+        'socks:Run a SOCKS proxy through a server'
         'completion:Output shell completion script'
         'help:Show help'
     )
     names=(${(f)"$(essh --names 2>/dev/null)"})
+    tags=(${(f)"$(essh --tags 2>/dev/null)"})
 
     if (( CURRENT == 2 )); then
         _describe 'command' commands
-        compadd -a names
+        compadd -a names tags
     elif (( CURRENT == 3 )); then
         case "${words[2]}" in
-            remove|edit|rename)
-                compadd -a names
+            list|remove|edit|rename|keygen|exec|sftp|run|gather|rollout|forward|tunnel|socks)
+                compadd -a names tags
                 ;;
-            scp)
+            scp|sync)
                 local -a colon_names
                 for n in $names; do colon_names+=("$n:"); done
                 compadd -S '' -a colon_names
                 ;;
+            hostkey)
+                compadd show reset
+                ;;
         esac
+    elif (( CURRENT == 4 )) && [[ "${words[2]}" == hostkey ]]; then
+        compadd -a names tags
     fi
 }
 
@@ -775,38 +1574,109 @@ _essh "$@"
 `
 
 func cmdScp() error {
-	recursive := false
+	recursive, direct := false, false
+	var opts ssh.TransferOptions
+	var filter ssh.Filter
+	filtered := false
 	positional := make([]string, 0, 2)
-	for _, a := range os.Args[2:] {
-		switch a {
+	args := os.Args[2:]
+	for i := 0; i < len(args); i++ {
+		switch a := args[i]; a {
 		case "-r", "-R":
 			recursive = true
+		case "--exclude", "--include", "--exclude-from":
+			v, err := nextArg(args, &i)
+			if err != nil {
+				return err
+			}
+			switch a {
+			case "--exclude":
+				err = filter.Exclude(v)
+			case "--include":
+				err = filter.Include(v)
+			default:
+				err = filter.ExcludeFrom(v)
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %w", a, err)
+			}
+			filtered = true
+		case "--ignore-files":
+			filter.IgnoreFiles = true
+			filtered = true
+		case "-p":
+			opts.Preserve = true
+		case "--links":
+			opts.Links = true
+		case "--resume":
+			opts.Resume = true
+		case "-q", "--quiet":
+			opts.Quiet = true
+		case "--direct":
+			direct = true
+		case "-A", "--forward-agent":
+			opts.ForwardAgent = true
+		case "--sftp", "--scp":
+			protocol := ssh.ProtocolSFTP
+			if a == "--scp" {
+				protocol = ssh.ProtocolSCP
+			}
+			if opts.Protocol != ssh.ProtocolAuto && opts.Protocol != protocol {
+				return fmt.Errorf("--sftp and --scp cannot be used together")
+			}
+			opts.Protocol = protocol
 		default:
 			positional = append(positional, a)
 		}
 	}
 
-	if len(positional) < 2 {
-		return fmt.Errorf("usage: essh scp [-r] <src> <dst>\n  Use <name>:/path for remote, e.g.:\n    essh scp prod-web:/etc/hostname ./hostname.txt\n    essh scp ./file.txt prod-web:/tmp/file.txt\n    essh scp -r ./mydir prod-web:/tmp/\n    essh scp -r prod-web:/var/log ./logs")
+	if filtered {
+		opts.Filter = &filter
 	}
-	src := positional[0]
-	dst := positional[1]
 
-	// Determine direction: whichever arg contains "<name>:" is the remote side
-	srcName, srcPath := splitScpArg(src)
+	if len(positional) < 2 {
+		return fmt.Errorf("usage: essh scp [-r] [-p] [--links] [--exclude <pattern>] [--include <pattern>] [--exclude-from <file>] [--ignore-files] [-q] [--sftp|--scp] [--resume] [--direct [-A]] <src>... <dst>\n  Use <name>:/path for remote, e.g.:\n    essh scp prod-web:/etc/hostname ./hostname.txt\n    essh scp ./file.txt prod-web:/tmp/file.txt\n    essh scp a.log b.log prod-web:/tmp/\n    essh scp 'prod-web:/var/log/*.gz' .\n    essh scp -r ./mydir prod-web:/tmp/\n    essh scp -r -p --links ./site prod-web:/srv/\n    essh scp -r --ignore-files --exclude '*.log' ./project prod-web:/srv/\n    essh scp -r prod-web:/var/log ./logs\n    essh scp prod-db:/backups/dump.gz staging-db:/tmp/")
+	}
+	// The last argument is the destination; like scp, every other one is
+	// a source.
+	dst := positional[len(positional)-1]
 	dstName, dstPath := splitScpArg(dst)
 
+	// All sources must be local or on one server, so a single connection
+	// serves the whole copy.
+	sources := positional[:len(positional)-1]
+	srcName, _ := splitScpArg(sources[0])
+	srcPaths := make([]string, len(sources))
+	for i, src := range sources {
+		name, p := splitScpArg(src)
+		if name != srcName {
+			return fmt.Errorf("all sources must be local or on the same server")
+		}
+		srcPaths[i] = p
+	}
+
 	var serverName, remotePath, localPath string
 	var upload bool
 
+	if srcName != "" && dstName != "" {
+		if opts.ForwardAgent && !direct {
+			return fmt.Errorf("-A is only used with --direct")
+		}
+		return scpBetween(srcName, srcPaths, dstName, dstPath, recursive, direct, opts)
+	}
+	if direct {
+		return fmt.Errorf("--direct is for copies between two servers")
+	}
+	if opts.ForwardAgent {
+		return fmt.Errorf("-A is only used with --direct")
+	}
+
 	switch {
-	case srcName != "" && dstName != "":
-		return fmt.Errorf("both arguments cannot be remote — copy between two remote servers is not supported")
 	case srcName != "":
-		serverName, remotePath, localPath = srcName, srcPath, dst
+		serverName, localPath = srcName, dst
 		upload = false
 	case dstName != "":
-		serverName, remotePath, localPath = dstName, dstPath, src
+		serverName, remotePath = dstName, dstPath
 		upload = true
 	default:
 		return fmt.Errorf("one argument must be remote (e.g. prod-web:/path)")
@@ -822,9 +1692,9 @@ func cmdScp() error {
 		return err
 	}
 
-	srv := store.FindServer(serverName)
-	if srv == nil {
-		return fmt.Errorf("server %q not found — use 'essh list' to see saved servers", serverName)
+	srv, err := findServer(store, serverName)
+	if err != nil {
+		return err
 	}
 
 	keyfile, err := loadKeyfile(cfg)
@@ -832,49 +1702,111 @@ func cmdScp() error {
 		return err
 	}
 
-	key, err := verifyWithCache(store, keyfile)
+	key, err := verifyWithCache(cfg, store, keyfile)
 	if err != nil {
 		return err
 	}
 
-	sshPassword, err := crypto.Decrypt(key, srv.EncryptedPassword)
+	target, err := newTarget(cfg, store, key, srv)
 	if err != nil {
-		return fmt.Errorf("decrypting password: %w", err)
+		return err
+	}
+
+	transfer := func(client *gossh.Client) error {
+		if upload {
+			if len(srcPaths) > 1 {
+				if err := requireRemoteDir(client, remotePath, opts); err != nil {
+					return err
+				}
+			}
+			for _, p := range srcPaths {
+				var err error
+				if recursive {
+					err = ssh.UploadRecursive(client, p, remotePath, opts)
+				} else {
+					err = ssh.Upload(client, p, remotePath, opts)
+				}
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		paths, err := expandRemote(client, srcPaths, opts)
+		if err != nil {
+			return err
+		}
+		if len(paths) > 1 {
+			if fi, err := os.Stat(localPath); err != nil || !fi.IsDir() {
+				return fmt.Errorf("%s: not a directory (copying several sources)", localPath)
+			}
+		}
+		for _, p := range paths {
+			if recursive {
+				err = ssh.DownloadRecursive(client, p, localPath, opts)
+			} else {
+				err = ssh.Download(client, p, localPath, opts)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
 	}
 
-	client, err := ssh.Dial(srv.Host, srv.Port, srv.User, sshPassword)
+	// A resumable transfer can pick up where it left off, so ride out
+	// dropped connections instead of failing.
+	if opts.Resume {
+		return ssh.RetryTransfer(target, transfer)
+	}
+	client, err := ssh.Dial(target)
 	if err != nil {
 		return err
 	}
 	defer client.Close()
+	return transfer(client)
+}
 
-	if upload {
-		if recursive {
-			return ssh.UploadRecursive(client, localPath, remotePath)
+func cmdSync() error {
+	var opts ssh.SyncOptions
+	positional := make([]string, 0, 2)
+	for _, a := range os.Args[2:] {
+		switch a {
+		case "-n", "--dry-run":
+			opts.DryRun = true
+		case "--delete":
+			opts.Delete = true
+		case "-c", "--checksum":
+			opts.Checksum = true
+		case "-q", "--quiet":
+			opts.Quiet = true
+		default:
+			if strings.HasPrefix(a, "-") {
+				return fmt.Errorf("unknown option %s", a)
+			}
+			positional = append(positional, a)
 		}
-		return ssh.Upload(client, localPath, remotePath)
 	}
-	if recursive {
-		return ssh.DownloadRecursive(client, remotePath, localPath)
-	}
-	return ssh.Download(client, remotePath, localPath)
-}
 
-// splitScpArg splits "name:/path" into ("name", "/path").
-// Returns ("", arg) if there is no colon prefix matching a server name pattern.
-func splitScpArg(arg string) (name, path string) {
-	// A colon preceded by path separators or starting with . or / is a local path
-	if strings.HasPrefix(arg, "/") || strings.HasPrefix(arg, "./") || strings.HasPrefix(arg, "../") {
-		return "", arg
+	if len(positional) != 2 {
+		return fmt.Errorf("usage: essh sync [-n] [--delete] [-c] [-q] <src> <dst>\n  One side is <name>:/path; the destination directory becomes a copy of the source, e.g.:\n    essh sync ./build staging:/srv/app\n    essh sync prod-web:/etc/nginx ./nginx-backup")
 	}
-	idx := strings.Index(arg, ":")
-	if idx < 1 {
-		return "", arg
+	srcName, srcPath := splitScpArg(positional[0])
+	dstName, dstPath := splitScpArg(positional[1])
+
+	var serverName, remotePath, localPath string
+	switch {
+	case srcName != "" && dstName != "":
+		return fmt.Errorf("both arguments cannot be remote")
+	case srcName != "":
+		serverName, remotePath, localPath = srcName, srcPath, positional[1]
+	case dstName != "":
+		serverName, remotePath, localPath = dstName, dstPath, positional[0]
+	default:
+		return fmt.Errorf("one argument must be remote (e.g. prod-web:/path)")
 	}
-	return arg[:idx], arg[idx+1:]
-}
 
-func cmdConnect(name string) error {
 	cfg, err := config.Load()
 	if err != nil {
 		return fmt.Errorf("not initialized — run 'essh init' first")
@@ -885,26 +1817,1181 @@ func cmdConnect(name string) error {
 		return err
 	}
 
-	// Try exact match first, then prefix match
-	srv := store.FindServer(name)
-	if srv == nil {
-		var matches []*storage.Server
-		for i := range store.Servers {
-			if strings.HasPrefix(store.Servers[i].Name, name) {
-				matches = append(matches, &store.Servers[i])
-			}
-		}
-		switch len(matches) {
-		case 0:
-			return fmt.Errorf("server %q not found — use 'essh list' to see saved servers", name)
-		case 1:
-			srv = matches[0]
-		default:
-			fmt.Fprintf(os.Stderr, "Multiple servers match %q:\n", name)
-			for _, m := range matches {
-				fmt.Fprintf(os.Stderr, "  %s  %s@%s:%d\n", m.Name, m.User, m.Host, m.Port)
+	srv, err := findServer(store, serverName)
+	if err != nil {
+		return err
+	}
+
+	target, err := unlockTarget(cfg, store, srv)
+	if err != nil {
+		return err
+	}
+
+	client, err := ssh.Dial(target)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if dstName != "" {
+		return ssh.SyncUpload(client, localPath, remotePath, opts)
+	}
+	return ssh.SyncDownload(client, remotePath, localPath, opts)
+}
+
+// scpBetween copies between two servers: through this machine, or with
+// direct from the source server to the destination.
+func scpBetween(srcName string, srcPaths []string, dstName, dstPath string, recursive, direct bool, opts ssh.TransferOptions) error {
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("not initialized — run 'essh init' first")
+	}
+
+	store, err := storage.Load(cfg.StoragePath)
+	if err != nil {
+		return err
+	}
+
+	srcSrv, err := findServer(store, srcName)
+	if err != nil {
+		return err
+	}
+	dstSrv, err := findServer(store, dstName)
+	if err != nil {
+		return err
+	}
+
+	keyfile, err := loadKeyfile(cfg)
+	if err != nil {
+		return err
+	}
+
+	key, err := verifyWithCache(cfg, store, keyfile)
+	if err != nil {
+		return err
+	}
+
+	srcTarget, err := newTarget(cfg, store, key, srcSrv)
+	if err != nil {
+		return err
+	}
+	dstTarget, err := newTarget(cfg, store, key, dstSrv)
+	if err != nil {
+		return err
+	}
+
+	src, err := ssh.Dial(srcTarget)
+	if err != nil {
+		return fmt.Errorf("%s: %w", srcName, err)
+	}
+	defer src.Close()
+
+	paths, err := expandRemote(src, srcPaths, opts)
+	if err != nil {
+		return fmt.Errorf("%s: %w", srcName, err)
+	}
+
+	if direct {
+		return ssh.DirectCopy(src, paths, dstTarget, dstPath, recursive, opts)
+	}
+
+	dst, err := ssh.Dial(dstTarget)
+	if err != nil {
+		return fmt.Errorf("%s: %w", dstName, err)
+	}
+	defer dst.Close()
+
+	if len(paths) > 1 {
+		if err := requireRemoteDir(dst, dstPath, opts); err != nil {
+			return fmt.Errorf("%s: %w", dstName, err)
+		}
+	}
+	for _, p := range paths {
+		if recursive {
+			err = ssh.RelayRecursive(src, p, dst, dstPath, opts)
+		} else {
+			err = ssh.Relay(src, p, dst, dstPath, opts)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expandRemote expands the wildcards in remote source paths on the server.
+func expandRemote(client *gossh.Client, patterns []string, opts ssh.TransferOptions) ([]string, error) {
+	var paths []string
+	for _, pattern := range patterns {
+		matches, err := ssh.ExpandRemote(client, pattern, opts)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, matches...)
+	}
+	return paths, nil
+}
+
+// requireRemoteDir checks that the destination of a copy of several
+// sources is a directory, as they would otherwise overwrite each other.
+func requireRemoteDir(client *gossh.Client, remotePath string, opts ssh.TransferOptions) error {
+	isDir, err := ssh.IsRemoteDir(client, remotePath, opts)
+	if err != nil {
+		return err
+	}
+	if !isDir {
+		return fmt.Errorf("%s: not a directory (copying several sources)", remotePath)
+	}
+	return nil
+}
+
+// splitScpArg splits "name:/path" into ("name", "/path").
+// Returns ("", arg) if there is no colon prefix matching a server name pattern.
+func splitScpArg(arg string) (name, path string) {
+	// A colon preceded by path separators or starting with . or / is a local path
+	if strings.HasPrefix(arg, "/") || strings.HasPrefix(arg, "./") || strings.HasPrefix(arg, "../") {
+		return "", arg
+	}
+	idx := strings.Index(arg, ":")
+	if idx < 1 {
+		return "", arg
+	}
+	return arg[:idx], arg[idx+1:]
+}
+
+// selectServers returns the servers arg refers to: the server with that exact
+// name, or every server matching it as a selector (see storage.Selector).
+func selectServers(store *storage.Store, arg string) ([]*storage.Server, error) {
+	if srv := store.FindServer(arg); srv != nil {
+		return []*storage.Server{srv}, nil
+	}
+	if !storage.IsSelector(arg) {
+		return nil, nil
+	}
+	return store.Select(arg)
+}
+
+// findServer resolves arg to a single server, by exact name or by a
+// selector that matches exactly one server.
+func findServer(store *storage.Store, arg string) (*storage.Server, error) {
+	matches, err := selectServers(store, arg)
+	if err != nil {
+		return nil, err
+	}
+	switch len(matches) {
+	case 0:
+		return nil, notFound(arg)
+	case 1:
+		return matches[0], nil
+	}
+	return nil, fmt.Errorf("%q matches %d servers (%s) — be more specific", arg, len(matches), strings.Join(serverNames(matches), ", "))
+}
+
+func notFound(arg string) error {
+	if storage.IsSelector(arg) {
+		return fmt.Errorf("no servers match %q — use 'essh list' to see saved servers", arg)
+	}
+	return fmt.Errorf("server %q not found — use 'essh list' to see saved servers", arg)
+}
+
+func serverNames(servers []*storage.Server) []string {
+	names := make([]string, len(servers))
+	for i, s := range servers {
+		names[i] = s.Name
+	}
+	return names
+}
+
+// chooseServer asks the user to pick one of servers with the interactive
+// selector, which can filter by name, address, tag or selector. Without a
+// terminal it lists the servers and fails instead.
+func chooseServer(label string, servers []*storage.Server, defaultName string) (*storage.Server, error) {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		fmt.Fprintln(os.Stderr, label)
+		for _, s := range servers {
+			fmt.Fprintf(os.Stderr, "  %s  %s@%s:%d\n", s.Name, s.User, s.Host, s.Port)
+		}
+		return nil, fmt.Errorf("be more specific")
+	}
+
+	items := make([]prompt.SelectItem, len(servers))
+	defaultIdx := 0
+	for i, s := range servers {
+		desc := fmt.Sprintf("%s@%s:%d", s.User, s.Host, s.Port)
+		if len(s.Tags) > 0 {
+			desc += "  " + strings.Join(s.Tags, ",")
+		}
+		items[i] = prompt.SelectItem{Label: s.Name, Desc: desc}
+		if s.Name == defaultName {
+			defaultIdx = i
+		}
+	}
+
+	match := func(query string, i int) bool {
+		if storage.IsSelector(query) {
+			if sel, err := storage.ParseSelector(query); err == nil && sel.Match(servers[i]) {
+				return true
+			}
+		}
+		text := strings.ToLower(items[i].Label + " " + items[i].Desc)
+		return strings.Contains(text, strings.ToLower(query))
+	}
+
+	idx, err := prompt.SelectFilter(label, items, defaultIdx, match)
+	if err != nil {
+		return nil, err
+	}
+	return servers[idx], nil
+}
+
+// validateName rejects server names that would be read as selectors.
+func validateName(name string) error {
+	if storage.IsSelector(name) {
+		return fmt.Errorf("invalid server name %q — names cannot contain * ? [ , or :", name)
+	}
+	return nil
+}
+
+// parseTags parses a comma-separated tag list.
+func parseTags(s string) ([]string, error) {
+	tags := splitList(s)
+	for _, t := range tags {
+		if err := storage.ValidateTag(t); err != nil {
+			return nil, err
+		}
+	}
+	return tags, nil
+}
+
+// unlockTarget unlocks the store and builds the connection target for srv.
+func unlockTarget(cfg *config.Config, store *storage.Store, srv *storage.Server) (*ssh.Target, error) {
+	keyfile, err := loadKeyfile(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := verifyWithCache(cfg, store, keyfile)
+	if err != nil {
+		return nil, err
+	}
+
+	return newTarget(cfg, store, key, srv)
+}
+
+func cmdForward() error {
+	var name, save string
+	var local, remote []string
+	args := os.Args[2:]
+	for i := 0; i < len(args); i++ {
+		switch a := args[i]; a {
+		case "-L":
+			v, err := nextArg(args, &i)
+			if err != nil {
+				return err
+			}
+			local = append(local, v)
+		case "-R":
+			v, err := nextArg(args, &i)
+			if err != nil {
+				return err
+			}
+			remote = append(remote, v)
+		case "--save":
+			v, err := nextArg(args, &i)
+			if err != nil {
+				return err
+			}
+			save = v
+		default:
+			if strings.HasPrefix(a, "-") || name != "" {
+				return fmt.Errorf("unexpected argument %q", a)
+			}
+			name = a
+		}
+	}
+	if name == "" || len(local)+len(remote) == 0 {
+		return fmt.Errorf("usage: essh forward <name> [-L [bind:]port:host:hostport] [-R [bind:]port:host:hostport] [--save <tunnel>]\n  e.g. essh forward prod-db -L 5432:localhost:5432\n       essh forward demo -R 8080:localhost:3000")
+	}
+
+	forwards, err := parseForwards(local, remote)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("not initialized — run 'essh init' first")
+	}
+
+	store, err := storage.Load(cfg.StoragePath)
+	if err != nil {
+		return err
+	}
+
+	srv, err := findServer(store, name)
+	if err != nil {
+		return err
+	}
+	name = srv.Name
+
+	target, err := unlockTarget(cfg, store, srv)
+	if err != nil {
+		return err
+	}
+
+	if save != "" {
+		if t := srv.FindTunnel(save); t != nil {
+			t.Local, t.Remote = local, remote
+		} else {
+			srv.Tunnels = append(srv.Tunnels, storage.Tunnel{Name: save, Local: local, Remote: remote})
+		}
+		if err := storage.Save(cfg.StoragePath, store); err != nil {
+			return err
+		}
+		fmt.Printf("Saved tunnel %q on %q — start it with 'essh tunnel %s %s'\n", save, name, name, save)
+	}
+
+	return ssh.RunForwards(target, forwards)
+}
+
+func cmdTunnel() error {
+	del := false
+	var positional []string
+	for _, a := range os.Args[2:] {
+		switch a {
+		case "-d", "--delete":
+			del = true
+		default:
+			positional = append(positional, a)
+		}
+	}
+	if len(positional) == 0 || len(positional) > 2 || (del && len(positional) != 2) {
+		return fmt.Errorf("usage: essh tunnel <name> [<tunnel>]\n       essh tunnel -d <name> <tunnel>")
+	}
+	name := positional[0]
+
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("not initialized — run 'essh init' first")
+	}
+
+	store, err := storage.Load(cfg.StoragePath)
+	if err != nil {
+		return err
+	}
+
+	srv, err := findServer(store, name)
+	if err != nil {
+		return err
+	}
+	name = srv.Name
+
+	if len(positional) == 1 {
+		if len(srv.Tunnels) == 0 {
+			fmt.Printf("No tunnels saved for %q. Save one with 'essh forward %s -L ... --save <tunnel>'.\n", name, name)
+			return nil
+		}
+		for _, t := range srv.Tunnels {
+			fmt.Printf("%-16s %s\n", t.Name, tunnelArgs(t))
+		}
+		return nil
+	}
+
+	tunnel := srv.FindTunnel(positional[1])
+	if tunnel == nil {
+		return fmt.Errorf("tunnel %q not found on %q — use 'essh tunnel %s' to list them", positional[1], name, name)
+	}
+
+	if del {
+		keyfile, err := loadKeyfile(cfg)
+		if err != nil {
+			return err
+		}
+		if _, err := verifyWithCache(cfg, store, keyfile); err != nil {
+			return err
+		}
+		for i := range srv.Tunnels {
+			if srv.Tunnels[i].Name == tunnel.Name {
+				srv.Tunnels = append(srv.Tunnels[:i], srv.Tunnels[i+1:]...)
+				break
+			}
+		}
+		if err := storage.Save(cfg.StoragePath, store); err != nil {
+			return err
+		}
+		fmt.Printf("Tunnel %q removed from %q\n", positional[1], name)
+		return nil
+	}
+
+	forwards, err := parseForwards(tunnel.Local, tunnel.Remote)
+	if err != nil {
+		return err
+	}
+
+	target, err := unlockTarget(cfg, store, srv)
+	if err != nil {
+		return err
+	}
+	return ssh.RunForwards(target, forwards)
+}
+
+// exitRemote exits with the status of a remote command or shell, like
+// OpenSSH: 0 on success, the remote exit code on failure, or 255 if essh
+// itself failed.
+func exitRemote(err error) {
+	if status, signal, ok := ssh.ExitStatus(err); ok {
+		if signal != "" {
+			fmt.Fprintf(os.Stderr, "Remote command killed by signal %s\n", signal)
+		}
+		os.Exit(status)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(255)
+	}
+	os.Exit(0)
+}
+
+func cmdExec() error {
+	tty := false
+	var name string
+	var command []string
+	// Everything after "--" (or after the server name) is the command.
+	args := os.Args[2:]
+	for len(args) > 0 && command == nil {
+		a := args[0]
+		args = args[1:]
+		switch {
+		case a == "--":
+			command = args
+		case a == "-t":
+			tty = true
+		case strings.HasPrefix(a, "-"):
+			return fmt.Errorf("unknown option %q", a)
+		case name == "":
+			name = a
+		default:
+			command = append([]string{a}, args...)
+		}
+	}
+	if name == "" || len(command) == 0 {
+		return fmt.Errorf("usage: essh exec [-t] <name> -- <command...>\n  e.g. essh exec prod-web -- systemctl is-active nginx")
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("not initialized — run 'essh init' first")
+	}
+
+	store, err := storage.Load(cfg.StoragePath)
+	if err != nil {
+		return err
+	}
+
+	srv, err := findServer(store, name)
+	if err != nil {
+		return err
+	}
+	name = srv.Name
+
+	target, err := unlockTarget(cfg, store, srv)
+	if err != nil {
+		return err
+	}
+	return ssh.Exec(target, strings.Join(command, " "), tty)
+}
+
+func cmdSftp() error {
+	if len(os.Args) != 3 || strings.HasPrefix(os.Args[2], "-") {
+		return fmt.Errorf("usage: essh sftp <name>\n  Commands can also be piped in, e.g. echo 'get /etc/hostname' | essh sftp prod-web")
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("not initialized — run 'essh init' first")
+	}
+
+	store, err := storage.Load(cfg.StoragePath)
+	if err != nil {
+		return err
+	}
+
+	srv, err := findServer(store, os.Args[2])
+	if err != nil {
+		return err
+	}
+
+	target, err := unlockTarget(cfg, store, srv)
+	if err != nil {
+		return err
+	}
+	return ssh.SFTPShell(target)
+}
+
+const defaultFleetWorkers = 10
+
+// fleetArgs holds the arguments shared by run, gather and rollout:
+// "[options] <selector>... -- <command...>".
+type fleetArgs struct {
+	selectors []string
+	command   string
+	workers   int
+	timeout   time.Duration
+}
+
+// parseFleetArgs parses fleet command arguments. extra handles
+// command-specific options; it reports whether it consumed args[*i].
+func parseFleetArgs(args []string, extra func(args []string, i *int) (bool, error)) (*fleetArgs, error) {
+	fa := &fleetArgs{workers: defaultFleetWorkers}
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if a == "--" {
+			fa.command = strings.Join(args[i+1:], " ")
+			break
+		}
+		if extra != nil {
+			ok, err := extra(args, &i)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				continue
+			}
+		}
+		switch a {
+		case "-j", "--parallel":
+			v, err := nextArg(args, &i)
+			if err != nil {
+				return nil, err
+			}
+			if fa.workers, err = strconv.Atoi(v); err != nil || fa.workers < 1 {
+				return nil, fmt.Errorf("invalid %s value %q", a, v)
+			}
+		case "--timeout":
+			v, err := nextArg(args, &i)
+			if err != nil {
+				return nil, err
+			}
+			if fa.timeout, err = time.ParseDuration(v); err != nil || fa.timeout <= 0 {
+				return nil, fmt.Errorf("invalid --timeout value %q (e.g. 30s, 5m)", v)
+			}
+		default:
+			if strings.HasPrefix(a, "-") {
+				return nil, fmt.Errorf("unknown option %q", a)
+			}
+			fa.selectors = append(fa.selectors, a)
+		}
+	}
+	if len(fa.selectors) == 0 || fa.command == "" {
+		return nil, errors.New("expected <selector>... -- <command...>")
+	}
+	return fa, nil
+}
+
+// resolveServers returns the servers matched by any of selectors, in the
+// order they are first matched.
+func resolveServers(store *storage.Store, selectors []string) ([]*storage.Server, error) {
+	var servers []*storage.Server
+	seen := map[string]bool{}
+	for _, sel := range selectors {
+		matches, err := selectServers(store, sel)
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			return nil, notFound(sel)
+		}
+		for _, srv := range matches {
+			if !seen[srv.Name] {
+				seen[srv.Name] = true
+				servers = append(servers, srv)
+			}
+		}
+	}
+	return servers, nil
+}
+
+// fleetTargets unlocks the store once and builds a target for every server
+// the selectors match.
+func fleetTargets(selectors []string) ([]*ssh.Target, error) {
+	cfg, err := config.Load()
+	if err != nil {
+		return nil, fmt.Errorf("not initialized — run 'essh init' first")
+	}
+
+	store, err := storage.Load(cfg.StoragePath)
+	if err != nil {
+		return nil, err
+	}
+
+	servers, err := resolveServers(store, selectors)
+	if err != nil {
+		return nil, err
+	}
+
+	keyfile, err := loadKeyfile(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := verifyWithCache(cfg, store, keyfile)
+	if err != nil {
+		return nil, err
+	}
+
+	targets := make([]*ssh.Target, len(servers))
+	for i, srv := range servers {
+		if targets[i], err = newTarget(cfg, store, key, srv); err != nil {
+			return nil, fmt.Errorf("%s: %w", srv.Name, err)
+		}
+	}
+	return targets, nil
+}
+
+// nameWidth returns the width of the longest target name.
+func nameWidth(targets []*ssh.Target) int {
+	w := 0
+	for _, t := range targets {
+		if len(t.Name) > w {
+			w = len(t.Name)
+		}
+	}
+	return w
+}
+
+// describeResult formats a host result for summaries: "ok", "exit 3",
+// "killed by TERM" or the connection error.
+func describeResult(r ssh.HostResult) string {
+	switch {
+	case r.Err != nil:
+		return "error: " + r.Err.Error()
+	case r.Signal != "":
+		return fmt.Sprintf("killed by %s (exit %d)", r.Signal, r.Status)
+	case r.Status != 0:
+		return fmt.Sprintf("exit %d", r.Status)
+	}
+	return "ok"
+}
+
+// printFleetSummary prints one line per server and the totals to stderr, and
+// returns an error if any server failed.
+func printFleetSummary(targets []*ssh.Target, results []ssh.HostResult) error {
+	w := nameWidth(targets)
+	failed := 0
+	fmt.Fprintln(os.Stderr)
+	for _, r := range results {
+		if !r.OK() {
+			failed++
+		}
+		fmt.Fprintf(os.Stderr, "%-*s  %6.1fs  %s\n", w, r.Name, r.Duration.Seconds(), describeResult(r))
+	}
+	fmt.Fprintf(os.Stderr, "%d servers: %d ok, %d failed\n", len(results), len(results)-failed, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d of %d servers failed", failed, len(results))
+	}
+	return nil
+}
+
+func cmdRun() error {
+	fa, err := parseFleetArgs(os.Args[2:], nil)
+	if err != nil {
+		return fmt.Errorf("%v\nusage: essh run [-j N] [--timeout D] <selector>... -- <command...>\n  e.g. essh run -j 20 --timeout 30s env:prod -- uptime", err)
+	}
+
+	targets, err := fleetTargets(fa.selectors)
+	if err != nil {
+		return err
+	}
+
+	writers := prefixedWriters(targets)
+	results := ssh.RunFleet(targets, fa.command, ssh.FleetOptions{
+		Workers: fa.workers,
+		Timeout: fa.timeout,
+		Output: func(i int) (io.Writer, io.Writer) {
+			return writers[i][0], writers[i][1]
+		},
+		Done: func(i int, r ssh.HostResult) {
+			writers[i][0].Flush()
+			writers[i][1].Flush()
+		},
+	})
+	return printFleetSummary(targets, results)
+}
+
+// prefixedWriters returns a stdout and stderr LineWriter for each target,
+// prefixing lines with the target's name.
+func prefixedWriters(targets []*ssh.Target) [][2]*ssh.LineWriter {
+	// One lock for both streams: they usually share a terminal.
+	mu := new(sync.Mutex)
+	w := nameWidth(targets)
+	writers := make([][2]*ssh.LineWriter, len(targets))
+	for i, t := range targets {
+		prefix := fmt.Sprintf("%-*s | ", w, t.Name)
+		writers[i] = [2]*ssh.LineWriter{
+			ssh.NewLineWriter(os.Stdout, mu, prefix),
+			ssh.NewLineWriter(os.Stderr, mu, prefix),
+		}
+	}
+	return writers
+}
+
+// syncBuffer is a bytes.Buffer that a session's stdout and stderr copies
+// can write to concurrently.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// gatherGroup is a set of servers whose command produced identical output
+// and exit status.
+type gatherGroup struct {
+	indices []int
+	output  []byte
+	result  ssh.HostResult
+}
+
+// gatherHost is the JSON form of one server's result.
+type gatherHost struct {
+	Name       string `json:"name"`
+	Status     int    `json:"status"`
+	Signal     string `json:"signal,omitempty"`
+	Error      string `json:"error,omitempty"`
+	Stdout     string `json:"stdout"`
+	Stderr     string `json:"stderr"`
+	DurationMS int64  `json:"duration_ms"`
+	// Group numbers identical outputs, largest group first; failed
+	// connections have none.
+	Group int `json:"group,omitempty"`
+}
+
+func cmdGather() error {
+	asJSON := false
+	fa, err := parseFleetArgs(os.Args[2:], func(args []string, i *int) (bool, error) {
+		if args[*i] == "--json" {
+			asJSON = true
+			return true, nil
+		}
+		return false, nil
+	})
+	if err != nil {
+		return fmt.Errorf("%v\nusage: essh gather [-j N] [--timeout D] [--json] <selector>... -- <command...>\n  e.g. essh gather web1,web2,web3 -- cat /etc/os-release", err)
+	}
+
+	targets, err := fleetTargets(fa.selectors)
+	if err != nil {
+		return err
+	}
+
+	stdout := make([]bytes.Buffer, len(targets))
+	stderr := make([]bytes.Buffer, len(targets))
+	combined := make([]syncBuffer, len(targets))
+	results := ssh.RunFleet(targets, fa.command, ssh.FleetOptions{
+		Workers: fa.workers,
+		Timeout: fa.timeout,
+		Output: func(i int) (io.Writer, io.Writer) {
+			return io.MultiWriter(&stdout[i], &combined[i]), io.MultiWriter(&stderr[i], &combined[i])
+		},
+	})
+
+	// Group servers by byte-identical output and exit status, largest first.
+	var groups []*gatherGroup
+	byKey := map[string]*gatherGroup{}
+	var failed []int
+	for i, r := range results {
+		if r.Err != nil {
+			failed = append(failed, i)
+			continue
+		}
+		out := combined[i].buf.Bytes()
+		key := fmt.Sprintf("%d/%s/%s", r.Status, r.Signal, out)
+		g := byKey[key]
+		if g == nil {
+			g = &gatherGroup{output: out, result: r}
+			byKey[key] = g
+			groups = append(groups, g)
+		}
+		g.indices = append(g.indices, i)
+	}
+	sort.SliceStable(groups, func(a, b int) bool {
+		return len(groups[a].indices) > len(groups[b].indices)
+	})
+
+	groupNames := func(g *gatherGroup) string {
+		names := make([]string, len(g.indices))
+		for j, i := range g.indices {
+			names[j] = targets[i].Name
+		}
+		return strings.Join(names, ",")
+	}
+
+	if asJSON {
+		hosts := make([]gatherHost, len(results))
+		for i, r := range results {
+			hosts[i] = gatherHost{
+				Name:       r.Name,
+				Status:     r.Status,
+				Signal:     r.Signal,
+				Stdout:     stdout[i].String(),
+				Stderr:     stderr[i].String(),
+				DurationMS: r.Duration.Milliseconds(),
+			}
+			if r.Err != nil {
+				hosts[i].Error = r.Err.Error()
+			}
+		}
+		for n, g := range groups {
+			for _, i := range g.indices {
+				hosts[i].Group = n + 1
+			}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(hosts); err != nil {
+			return err
+		}
+	} else {
+		for _, g := range groups {
+			header := fmt.Sprintf("%s (%d)", groupNames(g), len(g.indices))
+			if g.result.Status != 0 {
+				header += " " + describeResult(g.result)
+			}
+			rule := strings.Repeat("-", min(len(header), 72))
+			fmt.Printf("%s\n%s\n%s\n", rule, header, rule)
+			if len(g.output) == 0 {
+				fmt.Println("(no output)")
+			} else {
+				os.Stdout.Write(g.output)
+				if !bytes.HasSuffix(g.output, []byte("\n")) {
+					fmt.Println()
+				}
+			}
+		}
+
+		if len(groups) > 1 {
+			majority := groups[0]
+			fmt.Printf("\nDifferences from the majority output:\n")
+			for _, g := range groups[1:] {
+				fmt.Println()
+				fmt.Print(diff.Unified(groupNames(majority), groupNames(g), majority.output, g.output))
+				if bytes.Equal(majority.output, g.output) {
+					fmt.Printf("%s: same output, %s\n", groupNames(g), describeResult(g.result))
+				}
+			}
+		}
+
+		if len(failed) > 0 {
+			fmt.Fprintln(os.Stderr)
+			for _, i := range failed {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", targets[i].Name, describeResult(results[i]))
+			}
+		}
+	}
+
+	failures := 0
+	for _, r := range results {
+		if !r.OK() {
+			failures++
+		}
+	}
+	if failures > 0 {
+		return fmt.Errorf("%d of %d servers failed", failures, len(results))
+	}
+	return nil
+}
+
+// parseBatchSize parses a rollout batch size, either a count ("5") or a
+// percentage of total ("20%", rounded up), into a number of servers.
+func parseBatchSize(s string, total int) (int, error) {
+	if pct, ok := strings.CutSuffix(s, "%"); ok {
+		p, err := strconv.Atoi(pct)
+		if err != nil || p < 1 || p > 100 {
+			return 0, fmt.Errorf("invalid --batch value %q (percentage must be 1-100)", s)
+		}
+		return max((total*p+99)/100, 1), nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid --batch value %q (e.g. 5 or 20%%)", s)
+	}
+	return n, nil
+}
+
+func cmdRollout() error {
+	batchSpec := "1"
+	var pause time.Duration
+	maxFailures := 0
+	check := ""
+	fa, err := parseFleetArgs(os.Args[2:], func(args []string, i *int) (bool, error) {
+		a := args[*i]
+		switch a {
+		case "-j", "--parallel":
+			return false, fmt.Errorf("%s does not apply to rollout — --batch sets how many servers run at once", a)
+		case "--batch", "--pause", "--max-failures", "--check":
+		default:
+			return false, nil
+		}
+		v, err := nextArg(args, i)
+		if err != nil {
+			return false, err
+		}
+		switch a {
+		case "--batch":
+			batchSpec = v
+		case "--pause":
+			if pause, err = time.ParseDuration(v); err != nil || pause < 0 {
+				return false, fmt.Errorf("invalid --pause value %q (e.g. 30s, 5m)", v)
+			}
+		case "--max-failures":
+			if maxFailures, err = strconv.Atoi(v); err != nil || maxFailures < 0 {
+				return false, fmt.Errorf("invalid --max-failures value %q", v)
+			}
+		case "--check":
+			check = v
+		}
+		return true, nil
+	})
+	if err != nil {
+		return fmt.Errorf("%v\nusage: essh rollout [--batch N|N%%] [--pause D] [--max-failures K] [--check <command>] [--timeout D] <selector>... -- <command...>\n  e.g. essh rollout --batch 25%% --pause 30s --check 'curl -fs localhost/health' role:web -- sudo systemctl restart app", err)
+	}
+
+	targets, err := fleetTargets(fa.selectors)
+	if err != nil {
+		return err
+	}
+	size, err := parseBatchSize(batchSpec, len(targets))
+	if err != nil {
+		return err
+	}
+
+	writers := prefixedWriters(targets)
+	// runOn runs command on targets[idx...], all at once.
+	runOn := func(idx []int, command string) []ssh.HostResult {
+		batch := make([]*ssh.Target, len(idx))
+		for j, i := range idx {
+			batch[j] = targets[i]
+		}
+		return ssh.RunFleet(batch, command, ssh.FleetOptions{
+			Timeout: fa.timeout,
+			Output: func(j int) (io.Writer, io.Writer) {
+				return writers[idx[j]][0], writers[idx[j]][1]
+			},
+			Done: func(j int, r ssh.HostResult) {
+				writers[idx[j]][0].Flush()
+				writers[idx[j]][1].Flush()
+			},
+		})
+	}
+
+	results := make([]ssh.HostResult, len(targets))
+	checks := make([]*ssh.HostResult, len(targets))
+	batches := (len(targets) + size - 1) / size
+	done, failed := 0, 0
+	var aborted error
+	for b := 0; b < batches; b++ {
+		if b > 0 && pause > 0 {
+			fmt.Fprintf(os.Stderr, "Pausing %s before the next batch...\n", pause)
+			time.Sleep(pause)
+		}
+
+		var idx []int
+		for i := b * size; i < min((b+1)*size, len(targets)); i++ {
+			idx = append(idx, i)
+		}
+		names := make([]string, len(idx))
+		for j, i := range idx {
+			names[j] = targets[i].Name
+		}
+		fmt.Fprintf(os.Stderr, "Batch %d/%d: %s\n", b+1, batches, strings.Join(names, ", "))
+		for j, r := range runOn(idx, fa.command) {
+			results[idx[j]] = r
+		}
+		done = idx[len(idx)-1] + 1
+
+		// Health-check the servers where the command succeeded.
+		if check != "" {
+			var ok []int
+			for _, i := range idx {
+				if results[i].OK() {
+					ok = append(ok, i)
+				}
+			}
+			if len(ok) > 0 {
+				fmt.Fprintf(os.Stderr, "Checking batch %d/%d: %s\n", b+1, batches, check)
+				for j, r := range runOn(ok, check) {
+					r := r
+					checks[ok[j]] = &r
+				}
+			}
+		}
+
+		for _, i := range idx {
+			if !results[i].OK() || (checks[i] != nil && !checks[i].OK()) {
+				failed++
+			}
+		}
+		if failed > maxFailures {
+			if done < len(targets) {
+				aborted = fmt.Errorf("rollout aborted after batch %d of %d: %d servers failed (--max-failures %d)", b+1, batches, failed, maxFailures)
+			}
+			break
+		}
+	}
+
+	w := nameWidth(targets)
+	fmt.Fprintln(os.Stderr)
+	for i, t := range targets {
+		if i >= done {
+			fmt.Fprintf(os.Stderr, "%-*s  %7s  skipped\n", w, t.Name, "")
+			continue
+		}
+		r := results[i]
+		status := describeResult(r)
+		if c := checks[i]; c != nil {
+			r.Duration += c.Duration
+			if !c.OK() {
+				status = "health check failed: " + describeResult(*c)
+			}
+		}
+		fmt.Fprintf(os.Stderr, "%-*s  %6.1fs  %s\n", w, t.Name, r.Duration.Seconds(), status)
+	}
+	fmt.Fprintf(os.Stderr, "%d servers: %d ok, %d failed, %d skipped\n", len(targets), done-failed, failed, len(targets)-done)
+
+	if aborted != nil {
+		return aborted
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d servers failed", failed, len(targets))
+	}
+	return nil
+}
+
+func cmdSocks() error {
+	if len(os.Args) != 4 {
+		return fmt.Errorf("usage: essh socks <name> [bind:]port\n  e.g. essh socks bastion 1080")
+	}
+	name := os.Args[2]
+
+	f, err := ssh.ParseDynamicForward(os.Args[3])
+	if err != nil {
+		return err
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("not initialized — run 'essh init' first")
+	}
+
+	store, err := storage.Load(cfg.StoragePath)
+	if err != nil {
+		return err
+	}
+
+	srv, err := findServer(store, name)
+	if err != nil {
+		return err
+	}
+	name = srv.Name
+
+	target, err := unlockTarget(cfg, store, srv)
+	if err != nil {
+		return err
+	}
+	return ssh.RunForwards(target, []ssh.Forward{f})
+}
+
+// parseForwards parses -L and -R specs.
+func parseForwards(local, remote []string) ([]ssh.Forward, error) {
+	forwards := make([]ssh.Forward, 0, len(local)+len(remote))
+	for _, s := range local {
+		f, err := ssh.ParseForward(s, false)
+		if err != nil {
+			return nil, err
+		}
+		forwards = append(forwards, f)
+	}
+	for _, s := range remote {
+		f, err := ssh.ParseForward(s, true)
+		if err != nil {
+			return nil, err
+		}
+		forwards = append(forwards, f)
+	}
+	return forwards, nil
+}
+
+// tunnelArgs formats a saved tunnel as the -L/-R flags that created it.
+func tunnelArgs(t storage.Tunnel) string {
+	var args []string
+	for _, s := range t.Local {
+		args = append(args, "-L "+s)
+	}
+	for _, s := range t.Remote {
+		args = append(args, "-R "+s)
+	}
+	return strings.Join(args, " ")
+}
+
+func cmdConnect(name string) error {
+	var local, remote []string
+	args := os.Args[2:]
+	for i := 0; i < len(args); i++ {
+		switch a := args[i]; a {
+		case "-L", "-R":
+			v, err := nextArg(args, &i)
+			if err != nil {
+				return err
+			}
+			if a == "-L" {
+				local = append(local, v)
+			} else {
+				remote = append(remote, v)
+			}
+		default:
+			return fmt.Errorf("unexpected argument %q", a)
+		}
+	}
+	forwards, err := parseForwards(local, remote)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("not initialized — run 'essh init' first")
+	}
+
+	store, err := storage.Load(cfg.StoragePath)
+	if err != nil {
+		return err
+	}
+
+	// Try exact match first, then selectors, then prefix match
+	matches, err := selectServers(store, name)
+	if err != nil {
+		return err
+	}
+	if len(matches) == 0 && !storage.IsSelector(name) {
+		for i := range store.Servers {
+			if strings.HasPrefix(store.Servers[i].Name, name) {
+				matches = append(matches, &store.Servers[i])
 			}
-			return fmt.Errorf("be more specific")
+		}
+	}
+	var srv *storage.Server
+	switch len(matches) {
+	case 0:
+		return notFound(name)
+	case 1:
+		srv = matches[0]
+	default:
+		if srv, err = chooseServer(fmt.Sprintf("Multiple servers match %q:", name), matches, ""); err != nil {
+			return err
 		}
 	}
 
@@ -913,19 +3000,21 @@ func cmdConnect(name string) error {
 		return err
 	}
 
-	key, err := verifyWithCache(store, keyfile)
+	key, err := verifyWithCache(cfg, store, keyfile)
 	if err != nil {
 		return err
 	}
 
-	sshPassword, err := crypto.Decrypt(key, srv.EncryptedPassword)
+	target, err := newTarget(cfg, store, key, srv)
 	if err != nil {
-		return fmt.Errorf("decrypting password: %w", err)
+		return err
 	}
 
+	target.Forwards = forwards
+
 	saveLast(srv.Name)
 	fmt.Printf("Connecting to %s@%s:%d...\n", srv.User, srv.Host, srv.Port)
-	return ssh.Connect(srv.Host, srv.Port, srv.User, sshPassword)
+	return ssh.Connect(target)
 }
 
 func parseTarget(target string) (user, host string, port int, err error) {